@@ -0,0 +1,115 @@
+package joy
+
+import (
+	"math"
+	"math/big"
+)
+
+// Integers are int64 until a result does not fit, when they are promoted
+// to a *big.Int in Value.Big; a big result that fits is demoted again, so
+// Big is only ever set for values outside the int64 range. Int then holds
+// the value clamped to that range, which keeps its sign and keeps it from
+// being mistaken for zero or a small count by code that only reads Int.
+
+// BigIntVal returns the integer b, as a plain integer if it fits in an
+// int64. The value keeps b, which must not be changed afterwards.
+func BigIntVal(b *big.Int) Value {
+	if b.IsInt64() {
+		return IntVal(b.Int64())
+	}
+	v := Value{Typ: TypeInteger, Int: math.MaxInt64, ref: b}
+	if b.Sign() < 0 {
+		v.Int = math.MinInt64
+	}
+	return v
+}
+
+// intArg returns the integer v, which the builtin name reads as a count,
+// an index or a character code. Such a reader has no use for Int's clamped
+// value, so an integer outside the int64 range raises a range error; a
+// rational or complex number, whose Int is zero, raises a type error.
+func intArg(name string, v Value) int64 {
+	switch {
+	case v.Typ == TypeRational, v.Typ == TypeComplex:
+		joyErrKind(ErrType, "%s: integer expected", name)
+	case v.Big() != nil:
+		joyErrKind(ErrRange, "%s: %s out of range", name, v.Big())
+	}
+	return v.Int
+}
+
+// bigInt returns the integer value of v, a Boolean, Char or Integer, as a
+// new *big.Int.
+func (v Value) bigInt() *big.Int {
+	if b := v.Big(); b != nil {
+		return new(big.Int).Set(b)
+	}
+	return big.NewInt(v.Int)
+}
+
+func addInts(a, b Value) Value {
+	if a.Big() == nil && b.Big() == nil {
+		if s := a.Int + b.Int; (s^a.Int)&(s^b.Int) >= 0 {
+			return IntVal(s)
+		}
+	}
+	return BigIntVal(new(big.Int).Add(a.bigInt(), b.bigInt()))
+}
+
+func subInts(a, b Value) Value {
+	if a.Big() == nil && b.Big() == nil {
+		if d := a.Int - b.Int; (a.Int^b.Int)&(a.Int^d) >= 0 {
+			return IntVal(d)
+		}
+	}
+	return BigIntVal(new(big.Int).Sub(a.bigInt(), b.bigInt()))
+}
+
+func mulInts(a, b Value) Value {
+	if a.Big() == nil && b.Big() == nil {
+		p := a.Int * b.Int
+		if a.Int == 0 || (p/a.Int == b.Int && !(a.Int == -1 && b.Int == math.MinInt64)) {
+			return IntVal(p)
+		}
+	}
+	return BigIntVal(new(big.Int).Mul(a.bigInt(), b.bigInt()))
+}
+
+// quoInts and remInts truncate towards zero, like Go's / and %. The
+// divisor must not be zero.
+func quoInts(a, b Value) Value {
+	if a.Big() == nil && b.Big() == nil && !(a.Int == math.MinInt64 && b.Int == -1) {
+		return IntVal(a.Int / b.Int)
+	}
+	return BigIntVal(new(big.Int).Quo(a.bigInt(), b.bigInt()))
+}
+
+func remInts(a, b Value) Value {
+	if a.Big() == nil && b.Big() == nil {
+		return IntVal(a.Int % b.Int)
+	}
+	return BigIntVal(new(big.Int).Rem(a.bigInt(), b.bigInt()))
+}
+
+func negInt(a Value) Value {
+	if a.Big() == nil && a.Int != math.MinInt64 {
+		return IntVal(-a.Int)
+	}
+	return BigIntVal(new(big.Int).Neg(a.bigInt()))
+}
+
+// bigFloat returns b as the nearest float64.
+func bigFloat(b *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(b).Float64()
+	return f
+}
+
+// floatInt converts an integral float to an integer, promoting it when it
+// is out of the int64 range. Infinities and NaN convert as Go does.
+func floatInt(f float64) Value {
+	if f >= -(1<<63) && f < 1<<63 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return IntVal(int64(f))
+	}
+	b, _ := big.NewFloat(f).Int(nil)
+	return BigIntVal(b)
+}
@@ -1,5 +1,12 @@
-package main
+package joy
 
+import (
+	"fmt"
+	"strings"
+)
+
+// builtins holds the default primitives registered by the builtins_*.go
+// files. Every Machine starts with its own copy in Machine.Builtins.
 var builtins = map[string]BuiltinFunc{}
 
 func register(name string, fn BuiltinFunc) {
@@ -13,3 +20,123 @@ func registerAlias(alias, target string) {
 	}
 	builtins[alias] = fn
 }
+
+func defaultBuiltins() map[string]BuiltinFunc {
+	table := make(map[string]BuiltinFunc, len(builtins))
+	for name, fn := range builtins {
+		table[name] = fn
+	}
+	return table
+}
+
+// Register adds or replaces a primitive in this machine's builtin table.
+// Source parsed after the call resolves name to fn; code that was already
+// parsed keeps the function it was bound to.
+//
+// fn may change m.Stack in any way: before it runs, Register saves the
+// values that combinators such as ifte put back afterwards (see mark),
+// which the builtins of the default table leave to Pop and NeedStack.
+func (m *Machine) Register(name string, fn BuiltinFunc) {
+	m.Builtins[name] = func(m *Machine) {
+		m.modify(0)
+		fn(m)
+	}
+}
+
+// HostFunc is a Go function registered with RegisterFunc. It receives its
+// parameters in stack order (deepest first) and returns its results in the
+// order they are pushed.
+type HostFunc func(args []Value) []Value
+
+// paramKind is the type a RegisterFunc parameter letter accepts.
+type paramKind struct {
+	desc  string
+	match func(Value) bool
+}
+
+func isType(typs ...ValueType) func(Value) bool {
+	return func(v Value) bool {
+		for _, t := range typs {
+			if v.Typ == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// paramKinds maps the leading letter of a stack-effect parameter to the
+// accepted type, following the letters used in the Joy manual.
+var paramKinds = map[byte]paramKind{
+	'X': {"value", func(Value) bool { return true }},
+	'Y': {"value", func(Value) bool { return true }},
+	'Z': {"value", func(Value) bool { return true }},
+	'B': {"logical", isType(TypeBoolean)},
+	'C': {"char", isType(TypeChar)},
+	'I': {"integer", isType(TypeInteger)},
+	'J': {"integer", isType(TypeInteger)},
+	'K': {"integer", isType(TypeInteger)},
+	'F': {"float", isType(TypeFloat)},
+	'G': {"float", isType(TypeFloat)},
+	'H': {"float", isType(TypeFloat)},
+	'N': {"numeric", isType(TypeInteger, TypeFloat)},
+	'S': {"string", isType(TypeString)},
+	'T': {"string", isType(TypeString)},
+	'L': {"list", isType(TypeList)},
+	'Q': {"quotation", isType(TypeList)},
+	'A': {"aggregate", isType(TypeList, TypeString, TypeSet)},
+	'M': {"map", isType(TypeMap)},
+}
+
+// RegisterFunc registers fn as a primitive with the given stack effect,
+// written the way the builtins are documented: "I J -> K", "S -> L",
+// "X ->". Each parameter is a letter, optionally followed by digits, that
+// selects the accepted type:
+//
+//	X Y Z  any value        B      logical
+//	C      char             I J K  integer
+//	F G H  float            N      integer or float
+//	S T    string           L Q    list / quotation
+//	A      aggregate (list, string or set)
+//	M      map
+//
+// The generated builtin checks the stack depth and parameter types before
+// calling fn, and checks that fn returned as many values as the effect
+// declares results.
+func (m *Machine) RegisterFunc(name, effect string, fn HostFunc) error {
+	lhs, rhs, ok := strings.Cut(effect, "->")
+	if !ok {
+		return fmt.Errorf("RegisterFunc %s: stack effect %q has no ->", name, effect)
+	}
+	var kinds []paramKind
+	for _, p := range strings.Fields(lhs) {
+		kind, ok := paramKinds[p[0]]
+		if !ok || strings.Trim(p[1:], "0123456789") != "" {
+			return fmt.Errorf("RegisterFunc %s: unknown parameter type %q", name, p)
+		}
+		kinds = append(kinds, kind)
+	}
+	nIn := len(kinds)
+	nOut := len(strings.Fields(rhs))
+	// The builtin changes only the values NeedStack checked for, so it
+	// can skip Register's save
+	m.Builtins[name] = func(m *Machine) {
+		m.NeedStack(nIn, name)
+		args := make([]Value, nIn)
+		copy(args, m.Stack[len(m.Stack)-nIn:])
+		for i, arg := range args {
+			if !kinds[i].match(arg) {
+				joyErrKind(ErrType, "%s: %s expected as parameter %d", name, kinds[i].desc, i+1)
+			}
+		}
+		m.Stack = m.Stack[:len(m.Stack)-nIn]
+		results := fn(args)
+		if len(results) != nOut {
+			joyErr("%s: returned %d values, stack effect declares %d", name, len(results), nOut)
+		}
+		for _, r := range results {
+			m.Push(r)
+		}
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
-package main
+package joy
 
 import (
 	"fmt"
+	"math"
+	"math/big"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 func init() {
@@ -14,22 +17,21 @@ func init() {
 		item := m.Pop()
 		switch agg.Typ {
 		case TypeList:
+			m.checkList("cons", len(agg.List)+1)
 			newList := make([]Value, 0, len(agg.List)+1)
 			newList = append(newList, item)
 			newList = append(newList, agg.List...)
 			m.Push(ListVal(newList))
 		case TypeString:
 			if item.Typ != TypeChar {
-				joyErr("cons: char expected for string aggregate")
+				joyErrKind(ErrType, "cons: char expected for string aggregate")
 			}
+			m.checkString("cons", len(agg.Str)+utf8.RuneLen(rune(item.Int)))
 			m.Push(StringVal(string(rune(item.Int)) + agg.Str))
 		case TypeSet:
-			if item.Int < 0 || item.Int >= SetSize {
-				joyErr("cons: set member out of range")
-			}
-			m.Push(SetVal(agg.Int | (1 << item.Int)))
+			m.Push(agg.setWith("cons", intArg("cons", item), 1))
 		default:
-			joyErr("cons: aggregate expected")
+			joyErrKind(ErrType, "cons: aggregate expected")
 		}
 	})
 
@@ -46,26 +48,22 @@ func init() {
 		switch a.Typ {
 		case TypeList:
 			if len(a.List) == 0 {
-				joyErr("first: empty list")
+				joyErrKind(ErrRange, "first: empty list")
 			}
 			m.Push(a.List[0])
 		case TypeString:
 			if a.Str == "" {
-				joyErr("first: empty string")
+				joyErrKind(ErrRange, "first: empty string")
 			}
-			m.Push(CharVal(int64(a.Str[0])))
+			r, _ := utf8.DecodeRuneInString(a.Str)
+			m.Push(CharVal(int64(r)))
 		case TypeSet:
-			if a.Int == 0 {
-				joyErr("first: empty set")
-			}
-			for i := 0; i < SetSize; i++ {
-				if a.Int&(1<<i) != 0 {
-					m.Push(IntVal(int64(i)))
-					return
-				}
+			if a.setEmpty() {
+				joyErrKind(ErrRange, "first: empty set")
 			}
+			m.Push(IntVal(a.setFirst()))
 		default:
-			joyErr("first: aggregate expected")
+			joyErrKind(ErrType, "first: aggregate expected")
 		}
 	})
 
@@ -75,27 +73,22 @@ func init() {
 		switch a.Typ {
 		case TypeList:
 			if len(a.List) == 0 {
-				joyErr("rest: empty list")
+				joyErrKind(ErrRange, "rest: empty list")
 			}
 			m.Push(ListVal(a.List[1:]))
 		case TypeString:
 			if a.Str == "" {
-				joyErr("rest: empty string")
+				joyErrKind(ErrRange, "rest: empty string")
 			}
-			m.Push(StringVal(a.Str[1:]))
+			_, n := utf8.DecodeRuneInString(a.Str)
+			m.Push(StringVal(a.Str[n:]))
 		case TypeSet:
-			if a.Int == 0 {
-				joyErr("rest: empty set")
-			}
-			// remove lowest bit
-			for i := 0; i < SetSize; i++ {
-				if a.Int&(1<<i) != 0 {
-					m.Push(SetVal(a.Int &^ (1 << i)))
-					return
-				}
+			if a.setEmpty() {
+				joyErrKind(ErrRange, "rest: empty set")
 			}
+			m.Push(a.setWith("rest", a.setFirst(), 0))
 		default:
-			joyErr("rest: aggregate expected")
+			joyErrKind(ErrType, "rest: aggregate expected")
 		}
 	})
 
@@ -131,17 +124,13 @@ func init() {
 		case TypeList:
 			m.Push(IntVal(int64(len(a.List))))
 		case TypeString:
-			m.Push(IntVal(int64(len(a.Str))))
+			m.Push(IntVal(int64(m.runeLen(a.Str))))
 		case TypeSet:
-			count := int64(0)
-			bits := a.Int
-			for bits != 0 {
-				count++
-				bits &= bits - 1
-			}
-			m.Push(IntVal(count))
+			m.Push(IntVal(int64(a.setSize())))
+		case TypeBytes:
+			m.Push(IntVal(int64(len(a.Bytes()))))
 		default:
-			joyErr("size: aggregate expected")
+			joyErrKind(ErrType, "size: aggregate expected")
 		}
 	})
 
@@ -149,20 +138,25 @@ func init() {
 		m.NeedStack(2, "at")
 		idx := m.Pop()
 		agg := m.Pop()
-		i := int(idx.Int)
+		i := int(intArg("at", idx))
 		switch agg.Typ {
 		case TypeList:
 			if i < 0 || i >= len(agg.List) {
-				joyErr("at: index %d out of range", i)
+				joyErrKind(ErrRange, "at: index %d out of range", i)
 			}
 			m.Push(agg.List[i])
 		case TypeString:
-			if i < 0 || i >= len(agg.Str) {
-				joyErr("at: index %d out of range", i)
+			if i < 0 || i >= m.runeLen(agg.Str) {
+				joyErrKind(ErrRange, "at: index %d out of range", i)
+			}
+			m.Push(CharVal(int64(m.runeAt(agg.Str, i))))
+		case TypeBytes:
+			if i < 0 || i >= len(agg.Bytes()) {
+				joyErrKind(ErrRange, "at: index %d out of range", i)
 			}
-			m.Push(CharVal(int64(agg.Str[i])))
+			m.Push(IntVal(int64(agg.Bytes()[i])))
 		default:
-			joyErr("at: list or string expected")
+			joyErrKind(ErrType, "at: list or string expected")
 		}
 	})
 
@@ -181,24 +175,33 @@ func init() {
 		switch a.Typ {
 		case TypeList:
 			if b.Typ != TypeList {
-				joyErr("concat: two lists expected")
+				joyErrKind(ErrType, "concat: two lists expected")
 			}
+			m.checkList("concat", len(a.List)+len(b.List))
 			newList := make([]Value, 0, len(a.List)+len(b.List))
 			newList = append(newList, a.List...)
 			newList = append(newList, b.List...)
 			m.Push(ListVal(newList))
 		case TypeString:
 			if b.Typ != TypeString {
-				joyErr("concat: two strings expected")
+				joyErrKind(ErrType, "concat: two strings expected")
 			}
+			m.checkString("concat", len(a.Str)+len(b.Str))
 			m.Push(StringVal(a.Str + b.Str))
+		case TypeBytes:
+			if b.Typ != TypeBytes {
+				joyErrKind(ErrType, "concat: two byte strings expected")
+			}
+			x, y := a.Bytes(), b.Bytes()
+			m.checkString("concat", len(x)+len(y))
+			m.Push(BytesVal(append(x[:len(x):len(x)], y...)))
 		case TypeSet:
 			if b.Typ != TypeSet {
-				joyErr("concat: two sets expected")
+				joyErrKind(ErrType, "concat: two sets expected")
 			}
-			m.Push(SetVal(a.Int | b.Int))
+			m.Push(setOp(a, b, func(x, y int64) int64 { return x | y }, (*big.Int).Or))
 		default:
-			joyErr("concat: aggregate expected")
+			joyErrKind(ErrType, "concat: aggregate expected")
 		}
 	})
 
@@ -215,7 +218,7 @@ func init() {
 		m.NeedStack(2, "take")
 		n := m.Pop()
 		a := m.Pop()
-		count := int(n.Int)
+		count := int(intArg("take", n))
 		switch a.Typ {
 		case TypeList:
 			if count > len(a.List) {
@@ -226,15 +229,20 @@ func init() {
 			}
 			m.Push(ListVal(a.List[:count]))
 		case TypeString:
-			if count > len(a.Str) {
-				count = len(a.Str)
+			if count < 0 {
+				count = 0
+			}
+			m.Push(StringVal(a.Str[:m.runeOffset(a.Str, count)]))
+		case TypeBytes:
+			if count > len(a.Bytes()) {
+				count = len(a.Bytes())
 			}
 			if count < 0 {
 				count = 0
 			}
-			m.Push(StringVal(a.Str[:count]))
+			m.Push(BytesVal(a.Bytes()[:count:count]))
 		default:
-			joyErr("take: list or string expected")
+			joyErrKind(ErrType, "take: list or string expected")
 		}
 	})
 
@@ -242,7 +250,7 @@ func init() {
 		m.NeedStack(2, "drop")
 		n := m.Pop()
 		a := m.Pop()
-		count := int(n.Int)
+		count := int(intArg("drop", n))
 		switch a.Typ {
 		case TypeList:
 			if count > len(a.List) {
@@ -253,15 +261,20 @@ func init() {
 			}
 			m.Push(ListVal(a.List[count:]))
 		case TypeString:
-			if count > len(a.Str) {
-				count = len(a.Str)
+			if count < 0 {
+				count = 0
+			}
+			m.Push(StringVal(a.Str[m.runeOffset(a.Str, count):]))
+		case TypeBytes:
+			if count > len(a.Bytes()) {
+				count = len(a.Bytes())
 			}
 			if count < 0 {
 				count = 0
 			}
-			m.Push(StringVal(a.Str[count:]))
+			m.Push(BytesVal(a.Bytes()[count:]))
 		default:
-			joyErr("drop: list or string expected")
+			joyErrKind(ErrType, "drop: list or string expected")
 		}
 	})
 
@@ -279,13 +292,9 @@ func init() {
 			}
 			m.Push(BoolVal(false))
 		case TypeSet:
-			if item.Int >= 0 && item.Int < SetSize {
-				m.Push(BoolVal(agg.Int&(1<<item.Int) != 0))
-			} else {
-				m.Push(BoolVal(false))
-			}
+			m.Push(BoolVal(agg.setHas(intArg("has", item))))
 		default:
-			joyErr("has: aggregate expected")
+			joyErrKind(ErrType, "has: aggregate expected")
 		}
 	})
 
@@ -315,7 +324,7 @@ func init() {
 			}
 			m.Push(StringVal(string(runes)))
 		default:
-			joyErr("reverse: list or string expected")
+			joyErrKind(ErrType, "reverse: list or string expected")
 		}
 	})
 
@@ -328,7 +337,7 @@ func init() {
 		case TypeUserDef:
 			m.Push(StringVal(a.Str))
 		default:
-			joyErr("name: function expected")
+			joyErrKind(ErrType, "name: function expected")
 		}
 	})
 
@@ -336,11 +345,11 @@ func init() {
 		m.NeedStack(1, "body")
 		a := m.Pop()
 		if a.Typ != TypeUserDef {
-			joyErr("body: user-defined symbol expected")
+			joyErrKind(ErrType, "body: user-defined symbol expected")
 		}
-		body, ok := m.Dict[a.Str]
+		body, ok := m.Lookup(a.Str)
 		if !ok {
-			joyErr("body: undefined: %s", a.Str)
+			joyErrKind(ErrUndefined, "body: undefined: %s", a.Str)
 		}
 		m.Push(ListVal(body))
 	})
@@ -354,7 +363,11 @@ func init() {
 		case TypeString:
 			m.Push(BoolVal(a.Str == ""))
 		case TypeSet:
-			m.Push(BoolVal(a.Int == 0))
+			m.Push(BoolVal(a.setEmpty()))
+		case TypeMap:
+			m.Push(BoolVal(a.Map().Len() == 0))
+		case TypeBytes:
+			m.Push(BoolVal(len(a.Bytes()) == 0))
 		case TypeInteger, TypeChar:
 			m.Push(BoolVal(a.Int == 0))
 		case TypeFloat:
@@ -373,10 +386,14 @@ func init() {
 		case TypeList:
 			m.Push(BoolVal(len(a.List) <= 1))
 		case TypeString:
-			m.Push(BoolVal(len(a.Str) <= 1))
+			_, n := utf8.DecodeRuneInString(a.Str)
+			m.Push(BoolVal(n == len(a.Str)))
 		case TypeSet:
-			// 0 or 1 bits
-			m.Push(BoolVal(a.Int == 0 || (a.Int&(a.Int-1)) == 0))
+			m.Push(BoolVal(a.setSize() <= 1))
+		case TypeMap:
+			m.Push(BoolVal(a.Map().Len() <= 1))
+		case TypeBytes:
+			m.Push(BoolVal(len(a.Bytes()) <= 1))
 		case TypeInteger, TypeChar:
 			m.Push(BoolVal(a.Int == 0 || a.Int == 1))
 		case TypeFloat:
@@ -394,36 +411,41 @@ func init() {
 		quot := m.Pop()
 		agg := m.Pop()
 		if quot.Typ != TypeList {
-			joyErr("split: quotation expected")
-		}
-		if agg.Typ != TypeList {
-			joyErr("split: list expected as second parameter")
-		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		var yes, no []Value
-		for _, item := range agg.List {
-			m.Stack = make([]Value, len(savedStack))
-			copy(m.Stack, savedStack)
-			m.Push(item)
-			m.Execute(quot.List)
-			result := m.Pop()
-			if result.IsTruthy() {
-				yes = append(yes, item)
-			} else {
-				no = append(no, item)
+			joyErrKind(ErrType, "split: quotation expected")
+		}
+		if agg.Typ != TypeList && agg.Typ != TypeString {
+			joyErrKind(ErrType, "split: list or string expected as second parameter")
+		}
+		items := members(agg, "split")
+		savedStack := m.copyStack()
+		yes := make([]Value, 0, len(items))
+		no := make([]Value, 0, len(items))
+		var next func(i int)
+		next = func(i int) {
+			m.restoreStack(savedStack)
+			if i == len(items) {
+				if agg.Typ == TypeString {
+					m.Push(runeString(yes))
+					m.Push(runeString(no))
+					return
+				}
+				m.Push(ListVal(yes))
+				m.Push(ListVal(no))
+				return
 			}
+			item := items[i]
+			m.Push(item)
+			m.call(quot.List, func(m *Machine) {
+				result := m.Pop()
+				if result.IsTruthy() {
+					yes = append(yes, item)
+				} else {
+					no = append(no, item)
+				}
+				next(i + 1)
+			})
 		}
-		if yes == nil {
-			yes = []Value{}
-		}
-		if no == nil {
-			no = []Value{}
-		}
-		m.Stack = make([]Value, len(savedStack))
-		copy(m.Stack, savedStack)
-		m.Push(ListVal(yes))
-		m.Push(ListVal(no))
+		next(0)
 	})
 
 	register("shunt", func(m *Machine) {
@@ -431,8 +453,9 @@ func init() {
 		source := m.Pop()
 		target := m.Pop()
 		if source.Typ != TypeList || target.Typ != TypeList {
-			joyErr("shunt: two lists expected")
+			joyErrKind(ErrType, "shunt: two lists expected")
 		}
+		m.checkList("shunt", len(target.List)+len(source.List))
 		result := make([]Value, len(target.List))
 		copy(result, target.List)
 		for _, v := range source.List {
@@ -446,7 +469,7 @@ func init() {
 		b := m.Pop()
 		a := m.Pop()
 		if a.Typ != TypeList || b.Typ != TypeList {
-			joyErr("zip: two lists expected")
+			joyErrKind(ErrType, "zip: two lists expected")
 		}
 		n := len(a.List)
 		if len(b.List) < n {
@@ -476,7 +499,7 @@ func init() {
 		m.NeedStack(1, "unpair")
 		a := m.Pop()
 		if a.Typ != TypeList || len(a.List) < 2 {
-			joyErr("unpair: list of at least 2 elements expected")
+			joyErrKind(ErrType, "unpair: list of at least 2 elements expected")
 		}
 		m.Push(a.List[0])
 		m.Push(a.List[1])
@@ -486,7 +509,7 @@ func init() {
 		m.NeedStack(1, "flatten")
 		a := m.Pop()
 		if a.Typ != TypeList {
-			joyErr("flatten: list expected")
+			joyErrKind(ErrType, "flatten: list expected")
 		}
 		var flat []Value
 		for _, item := range a.List {
@@ -495,6 +518,7 @@ func init() {
 			} else {
 				flat = append(flat, item)
 			}
+			m.checkList("flatten", len(flat))
 		}
 		if flat == nil {
 			flat = []Value{}
@@ -506,14 +530,14 @@ func init() {
 		m.NeedStack(1, "intern")
 		a := m.Pop()
 		if a.Typ != TypeString {
-			joyErr("intern: string expected")
+			joyErrKind(ErrType, "intern: string expected")
 		}
 		// Parse the string as Joy source and return the first token as a value
 		tokens := NewScanner(a.Str).ScanAll()
 		if len(tokens) > 0 && tokens[0].Typ == TokAtom {
-			m.Push(UserDefVal(tokens[0].Str))
+			m.Push(m.userDef(tokens[0].Str))
 		} else {
-			joyErr("intern: atom expected")
+			joyErrKind(ErrType, "intern: atom expected")
 		}
 	})
 
@@ -528,18 +552,26 @@ func init() {
 		c := m.Pop() // format char
 		x := m.Pop() // value
 
-		width := int(i.Int)
-		prec := int(j.Int)
-		ch := rune(c.Int)
+		width := int(intArg("format", i))
+		prec := int(intArg("format", j))
+		ch := rune(intArg("format", c))
+		m.checkString("format", width)
+		m.checkString("format", prec)
 
+		var n any
+		if b := x.Big(); b != nil {
+			n = b
+		} else if ch == 'd' || ch == 'o' || ch == 'x' {
+			n = intArg("format", x)
+		}
 		var result string
 		switch ch {
 		case 'd':
-			result = fmt.Sprintf("%*d", width, x.Int)
+			result = fmt.Sprintf("%*d", width, n)
 		case 'o':
-			result = fmt.Sprintf("%*o", width, x.Int)
+			result = fmt.Sprintf("%*o", width, n)
 		case 'x':
-			result = fmt.Sprintf("%*x", width, x.Int)
+			result = fmt.Sprintf("%*x", width, n)
 		case 'f':
 			result = fmt.Sprintf("%*.*f", width, prec, x.NumericVal())
 		case 'e':
@@ -566,10 +598,11 @@ func init() {
 		base := m.Pop()
 		s := m.Pop()
 		if s.Typ != TypeString {
-			joyErr("strtol: string expected")
+			joyErrKind(ErrType, "strtol: string expected")
 		}
 		n := int64(0)
-		b := base.Int
+		var bn *big.Int // n once it overflows
+		b := intArg("strtol", base)
 		for _, ch := range s.Str {
 			var digit int64
 			if ch >= '0' && ch <= '9' {
@@ -584,9 +617,20 @@ func init() {
 			if digit >= b {
 				break
 			}
-			n = n*b + digit
+			if bn == nil && n > (math.MaxInt64-digit)/b {
+				bn = big.NewInt(n)
+			}
+			if bn != nil {
+				bn.Mul(bn, big.NewInt(b)).Add(bn, big.NewInt(digit))
+			} else {
+				n = n*b + digit
+			}
+		}
+		if bn != nil {
+			m.Push(BigIntVal(bn))
+		} else {
+			m.Push(IntVal(n))
 		}
-		m.Push(IntVal(n))
 	})
 
 	// sort: A -> B — sort list by Value.Compare or string by rune
@@ -608,7 +652,7 @@ func init() {
 			})
 			m.Push(StringVal(string(runes)))
 		default:
-			joyErr("sort: list or string expected")
+			joyErrKind(ErrType, "sort: list or string expected")
 		}
 	})
 
@@ -616,7 +660,7 @@ func init() {
 		m.NeedStack(1, "strtod")
 		s := m.Pop()
 		if s.Typ != TypeString {
-			joyErr("strtod: string expected")
+			joyErrKind(ErrType, "strtod: string expected")
 		}
 		s.Str = strings.TrimSpace(s.Str)
 		var f float64
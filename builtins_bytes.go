@@ -0,0 +1,60 @@
+package joy
+
+import "unicode/utf8"
+
+func init() {
+	// tobytes: S -> Y — the UTF-8 encoding of string S
+	// tobytes: L -> Y — the bytes of a list of integers 0..255
+	register("tobytes", func(m *Machine) {
+		m.NeedStack(1, "tobytes")
+		a := m.Pop()
+		switch a.Typ {
+		case TypeString:
+			m.Push(BytesVal([]byte(a.Str)))
+		case TypeList:
+			m.checkString("tobytes", len(a.List))
+			b := make([]byte, len(a.List))
+			for i, v := range a.List {
+				if v.Typ != TypeInteger && v.Typ != TypeChar || v.Int < 0 || v.Int > 255 {
+					joyErrKind(ErrType, "tobytes: byte expected, got %s", v)
+				}
+				b[i] = byte(v.Int)
+			}
+			m.Push(BytesVal(b))
+		case TypeBytes:
+			m.Push(a)
+		default:
+			joyErrKind(ErrType, "tobytes: string or list expected")
+		}
+	})
+
+	// bytestr: Y -> S — the string whose UTF-8 encoding is Y
+	register("bytestr", func(m *Machine) {
+		m.NeedStack(1, "bytestr")
+		a := popBytes(m, "bytestr")
+		if !utf8.Valid(a) {
+			joyErr("bytestr: invalid UTF-8")
+		}
+		m.Push(StringVal(string(a)))
+	})
+
+	// bytelist: Y -> L — the bytes of Y as a list of integers
+	register("bytelist", func(m *Machine) {
+		m.NeedStack(1, "bytelist")
+		a := popBytes(m, "bytelist")
+		m.checkList("bytelist", len(a))
+		list := make([]Value, len(a))
+		for i, c := range a {
+			list[i] = IntVal(int64(c))
+		}
+		m.Push(ListVal(list))
+	})
+}
+
+func popBytes(m *Machine, name string) []byte {
+	a := m.Pop()
+	if a.Typ != TypeBytes {
+		joyErrKind(ErrType, "%s: byte string expected", name)
+	}
+	return a.Bytes()
+}
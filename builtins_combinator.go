@@ -1,4 +1,10 @@
-package main
+package joy
+
+import "math/big"
+
+// Combinators do not run their quotations themselves: they schedule them
+// with m.call, passing what is left to do once a quotation has finished as
+// a continuation. Loops are continuations that schedule the next round.
 
 func init() {
 	// i: [P] -> ... — execute quotation or builtin
@@ -7,13 +13,13 @@ func init() {
 		q := m.Pop()
 		switch q.Typ {
 		case TypeList:
-			m.Execute(q.List)
+			m.call(q.List, nil)
 		case TypeBuiltin:
-			q.Fn(m)
+			q.Fn()(m)
 		case TypeUserDef:
-			m.Execute([]Value{q})
+			m.call([]Value{q}, nil)
 		default:
-			joyErr("i: quotation expected")
+			joyErrKind(ErrType, "i: quotation expected")
 		}
 	})
 
@@ -22,9 +28,22 @@ func init() {
 		m.NeedStack(1, "x")
 		q := m.Peek()
 		if q.Typ != TypeList {
-			joyErr("x: quotation expected")
+			joyErrKind(ErrType, "x: quotation expected")
+		}
+		m.call(q.List, nil)
+	})
+
+	// callcc: [P] -> ... — push the continuation of callcc as a quotation K
+	// and execute P; running K later, from anywhere, carries on from after
+	// callcc with the stack as it is then
+	register("callcc", func(m *Machine) {
+		m.NeedStack(1, "callcc")
+		q := m.Pop()
+		if q.Typ != TypeList {
+			joyErrKind(ErrType, "callcc: quotation expected")
 		}
-		m.Execute(q.List)
+		m.Push(m.capture().quotation())
+		m.call(q.List, nil)
 	})
 
 	// dip: X [P] -> ... X — execute P under X
@@ -33,10 +52,10 @@ func init() {
 		q := m.Pop()
 		x := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("dip: quotation expected")
+			joyErrKind(ErrType, "dip: quotation expected")
 		}
-		m.Execute(q.List)
-		m.Push(x)
+		m.hold(x)
+		m.call(q.List, nil)
 	})
 
 	// dipd: Y X [P] -> ... Y X — execute P under two values
@@ -46,11 +65,10 @@ func init() {
 		x := m.Pop()
 		y := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("dipd: quotation expected")
+			joyErrKind(ErrType, "dipd: quotation expected")
 		}
-		m.Execute(q.List)
-		m.Push(y)
-		m.Push(x)
+		m.hold(y, x)
+		m.call(q.List, nil)
 	})
 
 	// dipdd: Z Y X [P] -> ... Z Y X
@@ -61,12 +79,10 @@ func init() {
 		y := m.Pop()
 		z := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("dipdd: quotation expected")
+			joyErrKind(ErrType, "dipdd: quotation expected")
 		}
-		m.Execute(q.List)
-		m.Push(z)
-		m.Push(y)
-		m.Push(x)
+		m.hold(z, y, x)
+		m.call(q.List, nil)
 	})
 
 	// app1: X [P] -> R — apply P to X
@@ -74,9 +90,9 @@ func init() {
 		m.NeedStack(2, "app1")
 		q := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("app1: quotation expected")
+			joyErrKind(ErrType, "app1: quotation expected")
 		}
-		m.Execute(q.List)
+		m.call(q.List, nil)
 	})
 
 	// app2: X Y [P] -> Rx Ry
@@ -86,16 +102,9 @@ func init() {
 		y := m.Pop()
 		x := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("app2: quotation expected")
+			joyErrKind(ErrType, "app2: quotation expected")
 		}
-		m.Push(x)
-		m.Execute(q.List)
-		rx := m.Pop()
-		m.Push(y)
-		m.Execute(q.List)
-		ry := m.Pop()
-		m.Push(rx)
-		m.Push(ry)
+		applyEach(m, []Value{x, y}, q.List)
 	})
 
 	// app3: X Y Z [P] -> Rx Ry Rz
@@ -106,20 +115,9 @@ func init() {
 		y := m.Pop()
 		x := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("app3: quotation expected")
-		}
-		m.Push(x)
-		m.Execute(q.List)
-		rx := m.Pop()
-		m.Push(y)
-		m.Execute(q.List)
-		ry := m.Pop()
-		m.Push(z)
-		m.Execute(q.List)
-		rz := m.Pop()
-		m.Push(rx)
-		m.Push(ry)
-		m.Push(rz)
+			joyErrKind(ErrType, "app3: quotation expected")
+		}
+		applyEach(m, []Value{x, y, z}, q.List)
 	})
 
 	// branch: B [T] [F] -> ... — if B then T else F
@@ -129,12 +127,12 @@ func init() {
 		tBranch := m.Pop()
 		cond := m.Pop()
 		if tBranch.Typ != TypeList || fBranch.Typ != TypeList {
-			joyErr("branch: two quotations expected")
+			joyErrKind(ErrType, "branch: two quotations expected")
 		}
 		if cond.IsTruthy() {
-			m.Execute(tBranch.List)
+			m.call(tBranch.List, nil)
 		} else {
-			m.Execute(fBranch.List)
+			m.call(fBranch.List, nil)
 		}
 	})
 
@@ -146,26 +144,23 @@ func init() {
 		tBranch := m.Pop()
 		test := m.Pop()
 		if fBranch.Typ != TypeList || tBranch.Typ != TypeList {
-			joyErr("ifte: two quotation branches expected")
+			joyErrKind(ErrType, "ifte: two quotation branches expected")
 		}
 		if test.Typ == TypeList {
 			// save stack, run test, restore stack, then branch
-			savedStack := make([]Value, len(m.Stack))
-			copy(savedStack, m.Stack)
-			m.Execute(test.List)
-			cond := m.Pop()
-			m.Stack = savedStack
-			if cond.IsTruthy() {
-				m.Execute(tBranch.List)
-			} else {
-				m.Execute(fBranch.List)
-			}
+			m.test(test.List, func(m *Machine, ok bool) {
+				if ok {
+					m.call(tBranch.List, nil)
+				} else {
+					m.call(fBranch.List, nil)
+				}
+			})
 		} else {
 			// non-quotation condition: use directly
 			if test.IsTruthy() {
-				m.Execute(tBranch.List)
+				m.call(tBranch.List, nil)
 			} else {
-				m.Execute(fBranch.List)
+				m.call(fBranch.List, nil)
 			}
 		}
 	})
@@ -177,40 +172,12 @@ func init() {
 		m.NeedStack(1, "cond")
 		clauses := m.Pop()
 		if clauses.Typ != TypeList {
-			joyErr("cond: list of clauses expected")
+			joyErrKind(ErrType, "cond: list of clauses expected")
 		}
-		n := len(clauses.List)
-		if n == 0 {
+		if len(clauses.List) == 0 {
 			return
 		}
-		// Try all clauses except the last as [test body...]
-		for i := 0; i < n-1; i++ {
-			clause := clauses.List[i]
-			if clause.Typ != TypeList || len(clause.List) == 0 {
-				joyErr("cond: each clause must be a non-empty list")
-			}
-			test := clause.List[0]
-			body := clause.List[1:]
-			if test.Typ == TypeList {
-				savedStack := make([]Value, len(m.Stack))
-				copy(savedStack, m.Stack)
-				m.Execute(test.List)
-				cond := m.Pop()
-				m.Stack = savedStack
-				if cond.IsTruthy() {
-					m.Execute(body)
-					return
-				}
-			} else if test.IsTruthy() {
-				m.Execute(body)
-				return
-			}
-		}
-		// Last clause is the default — execute entire clause body
-		def := clauses.List[n-1]
-		if def.Typ == TypeList {
-			m.Execute(def.List)
-		}
+		condFrom(m, clauses.List, 0)
 	})
 
 	// times: N [P] -> ... — execute P, N times
@@ -219,12 +186,9 @@ func init() {
 		q := m.Pop()
 		n := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("times: quotation expected")
-		}
-		count := n.Int
-		for i := int64(0); i < count; i++ {
-			m.Execute(q.List)
+			joyErrKind(ErrType, "times: quotation expected")
 		}
+		m.repeat(q.List, intArg("times", n))
 	})
 
 	// step: A [P] -> ... — execute P for each element of aggregate
@@ -233,29 +197,9 @@ func init() {
 		q := m.Pop()
 		agg := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("step: quotation expected")
-		}
-		switch agg.Typ {
-		case TypeList:
-			for _, item := range agg.List {
-				m.Push(item)
-				m.Execute(q.List)
-			}
-		case TypeString:
-			for _, ch := range agg.Str {
-				m.Push(CharVal(int64(ch)))
-				m.Execute(q.List)
-			}
-		case TypeSet:
-			for i := 0; i < SetSize; i++ {
-				if agg.Int&(1<<i) != 0 {
-					m.Push(IntVal(int64(i)))
-					m.Execute(q.List)
-				}
-			}
-		default:
-			joyErr("step: aggregate expected")
+			joyErrKind(ErrType, "step: quotation expected")
 		}
+		m.each(members(agg, "step"), q.List)
 	})
 
 	// map: A [P] -> B — apply P to each element (SAVESTACK: restores stack between iterations)
@@ -264,58 +208,52 @@ func init() {
 		q := m.Pop()
 		agg := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("map: quotation expected")
-		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		switch agg.Typ {
-		case TypeList:
-			result := make([]Value, 0, len(agg.List))
-			for _, item := range agg.List {
-				m.Stack = make([]Value, len(savedStack))
-				copy(m.Stack, savedStack)
-				m.Push(item)
-				m.Execute(q.List)
-				result = append(result, m.Pop())
+			joyErrKind(ErrType, "map: quotation expected")
+		}
+		items := members(agg, "map")
+		savedStack := m.copyStack()
+		results := make([]Value, len(items))
+		var next func(i int)
+		next = func(i int) {
+			m.restoreStack(savedStack)
+			if i < len(items) {
+				m.Push(items[i])
+				m.call(q.List, func(m *Machine) {
+					results[i] = m.Pop()
+					next(i + 1)
+				})
+				return
 			}
-			m.Stack = make([]Value, len(savedStack))
-			copy(m.Stack, savedStack)
-			m.Push(ListVal(result))
-		case TypeString:
-			var result []byte
-			for _, ch := range agg.Str {
-				m.Stack = make([]Value, len(savedStack))
-				copy(m.Stack, savedStack)
-				m.Push(CharVal(int64(ch)))
-				m.Execute(q.List)
-				r := m.Pop()
-				if r.Typ == TypeChar || r.Typ == TypeInteger {
-					result = append(result, byte(r.Int))
+			switch agg.Typ {
+			case TypeList:
+				m.Push(ListVal(append([]Value{}, results...)))
+			case TypeString:
+				var chars []Value
+				for _, r := range results {
+					if r.Typ == TypeChar || r.Typ == TypeInteger {
+						chars = append(chars, r)
+					}
 				}
-			}
-			m.Stack = make([]Value, len(savedStack))
-			copy(m.Stack, savedStack)
-			m.Push(StringVal(string(result)))
-		case TypeSet:
-			var bits int64
-			for i := 0; i < SetSize; i++ {
-				if agg.Int&(1<<i) != 0 {
-					m.Stack = make([]Value, len(savedStack))
-					copy(m.Stack, savedStack)
-					m.Push(IntVal(int64(i)))
-					m.Execute(q.List)
-					r := m.Pop()
-					if r.Int >= 0 && r.Int < SetSize {
-						bits |= 1 << r.Int
+				m.Push(runeString(chars))
+			case TypeSet:
+				bits := new(big.Int)
+				for _, r := range results {
+					if n := intArg("map", r); n >= 0 && n < SetSize {
+						bits.SetBit(bits, int(n), 1)
 					}
 				}
+				m.Push(setOf(bits))
+			case TypeMap:
+				// A map of [key value] pairs maps to a map, as filter gives;
+				// any other results, such as the values alone, form a list.
+				if pairs(results) {
+					m.Push(mapOf("map", results))
+				} else {
+					m.Push(ListVal(append([]Value{}, results...)))
+				}
 			}
-			m.Stack = make([]Value, len(savedStack))
-			copy(m.Stack, savedStack)
-			m.Push(SetVal(bits))
-		default:
-			joyErr("map: aggregate expected")
 		}
+		next(0)
 	})
 
 	// mapr2: A B [P] -> C — zip-map: apply P to corresponding elements of A and B
@@ -325,24 +263,31 @@ func init() {
 		b := m.Pop()
 		a := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("mapr2: quotation expected")
+			joyErrKind(ErrType, "mapr2: quotation expected")
 		}
 		if a.Typ != TypeList || b.Typ != TypeList {
-			joyErr("mapr2: two lists expected")
+			joyErrKind(ErrType, "mapr2: two lists expected")
 		}
 		la, lb := a.List, b.List
 		n := len(la)
 		if len(lb) < n {
 			n = len(lb)
 		}
-		result := make([]Value, 0, n)
-		for i := 0; i < n; i++ {
+		result := make([]Value, n)
+		var next func(i int)
+		next = func(i int) {
+			if i == n {
+				m.Push(ListVal(append([]Value{}, result...)))
+				return
+			}
 			m.Push(la[i])
 			m.Push(lb[i])
-			m.Execute(q.List)
-			result = append(result, m.Pop())
+			m.call(q.List, func(m *Machine) {
+				result[i] = m.Pop()
+				next(i + 1)
+			})
 		}
-		m.Push(ListVal(result))
+		next(0)
 	})
 
 	// filter: A [P] -> B — keep elements where P is true
@@ -352,64 +297,58 @@ func init() {
 		q := m.Pop()
 		agg := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("filter: quotation expected")
-		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		switch agg.Typ {
-		case TypeList:
-			var result []Value
-			for _, item := range agg.List {
-				m.Stack = make([]Value, len(savedStack))
-				copy(m.Stack, savedStack)
-				m.Push(item)
-				m.Execute(q.List)
-				cond := m.Pop()
-				if cond.IsTruthy() {
-					result = append(result, item)
-				}
-			}
-			if result == nil {
-				result = []Value{}
+			joyErrKind(ErrType, "filter: quotation expected")
+		}
+		items := members(agg, "filter")
+		savedStack := m.copyStack()
+		keep := make([]bool, len(items))
+		var next func(i int)
+		next = func(i int) {
+			m.restoreStack(savedStack)
+			if i < len(items) {
+				m.Push(items[i])
+				m.call(q.List, func(m *Machine) {
+					keep[i] = m.Pop().IsTruthy()
+					next(i + 1)
+				})
+				return
 			}
-			m.Stack = make([]Value, len(savedStack))
-			copy(m.Stack, savedStack)
-			m.Push(ListVal(result))
-		case TypeString:
-			var result []byte
-			for _, ch := range agg.Str {
-				m.Stack = make([]Value, len(savedStack))
-				copy(m.Stack, savedStack)
-				m.Push(CharVal(int64(ch)))
-				m.Execute(q.List)
-				cond := m.Pop()
-				if cond.IsTruthy() {
-					result = append(result, byte(ch))
+			switch agg.Typ {
+			case TypeList:
+				result := []Value{}
+				for j, item := range items {
+					if keep[j] {
+						result = append(result, item)
+					}
 				}
-			}
-			m.Stack = make([]Value, len(savedStack))
-			copy(m.Stack, savedStack)
-			m.Push(StringVal(string(result)))
-		case TypeSet:
-			var bits int64
-			for i := 0; i < SetSize; i++ {
-				if agg.Int&(1<<i) != 0 {
-					m.Stack = make([]Value, len(savedStack))
-					copy(m.Stack, savedStack)
-					m.Push(IntVal(int64(i)))
-					m.Execute(q.List)
-					cond := m.Pop()
-					if cond.IsTruthy() {
-						bits |= 1 << i
+				m.Push(ListVal(result))
+			case TypeString:
+				var chars []Value
+				for j, item := range items {
+					if keep[j] {
+						chars = append(chars, item)
+					}
+				}
+				m.Push(runeString(chars))
+			case TypeSet:
+				bits := new(big.Int)
+				for j, item := range items {
+					if keep[j] {
+						bits.SetBit(bits, int(item.Int), 1)
+					}
+				}
+				m.Push(setOf(bits))
+			case TypeMap:
+				var result []Value
+				for j, item := range items {
+					if keep[j] {
+						result = append(result, item)
 					}
 				}
+				m.Push(mapOf("filter", result))
 			}
-			m.Stack = make([]Value, len(savedStack))
-			copy(m.Stack, savedStack)
-			m.Push(SetVal(bits))
-		default:
-			joyErr("filter: aggregate expected")
 		}
+		next(0)
 	})
 
 	// fold: V0 A [P] -> V — left fold
@@ -419,29 +358,9 @@ func init() {
 		agg := m.Pop()
 		// V0 is already on stack
 		if q.Typ != TypeList {
-			joyErr("fold: quotation expected")
-		}
-		switch agg.Typ {
-		case TypeList:
-			for _, item := range agg.List {
-				m.Push(item)
-				m.Execute(q.List)
-			}
-		case TypeString:
-			for _, ch := range agg.Str {
-				m.Push(CharVal(int64(ch)))
-				m.Execute(q.List)
-			}
-		case TypeSet:
-			for i := 0; i < SetSize; i++ {
-				if agg.Int&(1<<i) != 0 {
-					m.Push(IntVal(int64(i)))
-					m.Execute(q.List)
-				}
-			}
-		default:
-			joyErr("fold: aggregate expected")
+			joyErrKind(ErrType, "fold: quotation expected")
 		}
+		m.each(members(agg, "fold"), q.List)
 	})
 
 	// construct: [P] [[Q1] [Q2] ...] -> ... — apply each Qi, collect results
@@ -450,26 +369,34 @@ func init() {
 		specs := m.Pop()
 		test := m.Pop()
 		if test.Typ != TypeList || specs.Typ != TypeList {
-			joyErr("construct: two quotations expected")
+			joyErrKind(ErrType, "construct: two quotations expected")
 		}
 		// Apply test first
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		m.Execute(test.List)
-		postStack := make([]Value, len(m.Stack))
-		copy(postStack, m.Stack)
-		// Apply each spec
-		results := make([]Value, len(specs.List))
-		for i, spec := range specs.List {
-			m.Stack = make([]Value, len(postStack))
-			copy(m.Stack, postStack)
-			if spec.Typ == TypeList {
-				m.Execute(spec.List)
+		savedStack := m.copyStack()
+		m.call(test.List, func(m *Machine) {
+			postStack := m.copyStack()
+			// Apply each spec
+			results := make([]Value, len(specs.List))
+			var next func(i int)
+			next = func(i int) {
+				if i == len(specs.List) {
+					m.restoreStack(savedStack)
+					m.Push(ListVal(append([]Value{}, results...)))
+					return
+				}
+				m.restoreStack(postStack)
+				done := func(m *Machine) {
+					results[i] = m.Pop()
+					next(i + 1)
+				}
+				if spec := specs.List[i]; spec.Typ == TypeList {
+					m.call(spec.List, done)
+				} else {
+					done(m)
+				}
 			}
-			results[i] = m.Pop()
-		}
-		m.Stack = savedStack
-		m.Push(ListVal(results))
+			next(0)
+		})
 	})
 
 	// nullary: [P] -> R — execute P, push single result
@@ -477,14 +404,9 @@ func init() {
 		m.NeedStack(1, "nullary")
 		q := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("nullary: quotation expected")
+			joyErrKind(ErrType, "nullary: quotation expected")
 		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		m.Execute(q.List)
-		result := m.Pop()
-		m.Stack = savedStack
-		m.Push(result)
+		m.keep(q.List, 0)
 	})
 
 	// unary: X [P] -> R
@@ -492,14 +414,9 @@ func init() {
 		m.NeedStack(2, "unary")
 		q := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("unary: quotation expected")
+			joyErrKind(ErrType, "unary: quotation expected")
 		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		m.Execute(q.List)
-		result := m.Pop()
-		m.Stack = savedStack[:len(savedStack)-1] // remove the argument
-		m.Push(result)
+		m.keep(q.List, 1) // remove the argument
 	})
 
 	// binary: X Y [P] -> R
@@ -507,14 +424,9 @@ func init() {
 		m.NeedStack(3, "binary")
 		q := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("binary: quotation expected")
+			joyErrKind(ErrType, "binary: quotation expected")
 		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		m.Execute(q.List)
-		result := m.Pop()
-		m.Stack = savedStack[:len(savedStack)-2] // remove the two arguments
-		m.Push(result)
+		m.keep(q.List, 2) // remove the two arguments
 	})
 
 	// ternary: X Y Z [P] -> R
@@ -522,14 +434,9 @@ func init() {
 		m.NeedStack(4, "ternary")
 		q := m.Pop()
 		if q.Typ != TypeList {
-			joyErr("ternary: quotation expected")
+			joyErrKind(ErrType, "ternary: quotation expected")
 		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		m.Execute(q.List)
-		result := m.Pop()
-		m.Stack = savedStack[:len(savedStack)-3]
-		m.Push(result)
+		m.keep(q.List, 3)
 	})
 
 	// cleave: X [P] [Q] -> ... — apply P and Q each to X
@@ -538,19 +445,19 @@ func init() {
 		q2 := m.Pop()
 		q1 := m.Pop()
 		if q1.Typ != TypeList || q2.Typ != TypeList {
-			joyErr("cleave: two quotations expected")
-		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		m.Execute(q1.List)
-		r1 := m.Pop()
-		m.Stack = make([]Value, len(savedStack))
-		copy(m.Stack, savedStack)
-		m.Execute(q2.List)
-		r2 := m.Pop()
-		m.Stack = savedStack[:len(savedStack)-1] // remove X
-		m.Push(r1)
-		m.Push(r2)
+			joyErrKind(ErrType, "cleave: two quotations expected")
+		}
+		savedStack := m.copyStack()
+		m.call(q1.List, func(m *Machine) {
+			r1 := m.Pop()
+			m.restoreStack(savedStack)
+			m.call(q2.List, func(m *Machine) {
+				r2 := m.Pop()
+				m.restoreStack(savedStack[:len(savedStack)-1]) // remove X
+				m.Push(r1)
+				m.Push(r2)
+			})
+		})
 	})
 
 	// infra: L1 [P] -> L2 — execute P within the list as a stack
@@ -559,22 +466,24 @@ func init() {
 		q := m.Pop()
 		agg := m.Pop()
 		if q.Typ != TypeList || agg.Typ != TypeList {
-			joyErr("infra: list and quotation expected")
+			joyErrKind(ErrType, "infra: list and quotation expected")
 		}
-		savedStack := m.Stack
+		savedStack := m.copyStack()
 		// Use the list as the stack (reverse: first element on top)
+		m.modify(0)
 		m.Stack = make([]Value, len(agg.List))
 		for i, v := range agg.List {
 			m.Stack[len(agg.List)-1-i] = v
 		}
-		m.Execute(q.List)
-		// Convert stack back to list
-		result := make([]Value, len(m.Stack))
-		for i, v := range m.Stack {
-			result[len(m.Stack)-1-i] = v
-		}
-		m.Stack = savedStack
-		m.Push(ListVal(result))
+		m.call(q.List, func(m *Machine) {
+			// Convert stack back to list
+			result := make([]Value, len(m.Stack))
+			for i, v := range m.Stack {
+				result[len(m.Stack)-1-i] = v
+			}
+			m.restoreStack(savedStack)
+			m.Push(ListVal(result))
+		})
 	})
 
 	// treestep: T [P] treestep — depth-first leaf traversal
@@ -584,9 +493,9 @@ func init() {
 		p := m.Pop()
 		t := m.Pop()
 		if p.Typ != TypeList {
-			joyErr("treestep: quotation expected")
+			joyErrKind(ErrType, "treestep: quotation expected")
 		}
-		treestepAux(m, t, p.List)
+		treestep(m, t, p.List)
 	})
 
 	// treerec: T [O] [C] treerec — tree recursion
@@ -597,9 +506,9 @@ func init() {
 		o := m.Pop()
 		t := m.Pop()
 		if o.Typ != TypeList || c.Typ != TypeList {
-			joyErr("treerec: two quotations expected")
+			joyErrKind(ErrType, "treerec: two quotations expected")
 		}
-		treerecAux(m, t, o.List, c.List)
+		treerec(m, t, o.List, c.List)
 	})
 
 	// treegenrec: T [O1] [O2] [C] treegenrec — general tree recursion
@@ -613,19 +522,20 @@ func init() {
 		o1 := m.Pop()
 		t := m.Pop()
 		if o1.Typ != TypeList || o2.Typ != TypeList || c.Typ != TypeList {
-			joyErr("treegenrec: three quotations expected")
+			joyErrKind(ErrType, "treegenrec: three quotations expected")
 		}
 		if t.Typ != TypeList {
 			// leaf
 			m.Push(t)
-			m.Execute(o1.List)
+			m.call(o1.List, nil)
 		} else {
 			// branch
 			m.Push(t)
-			m.Execute(o2.List)
-			selfQuot := []Value{o1, o2, c, BuiltinVal("treegenrec", treegenrecFn)}
-			m.Push(ListVal(selfQuot))
-			m.Execute(c.List)
+			m.call(o2.List, func(m *Machine) {
+				selfQuot := []Value{o1, o2, c, BuiltinVal("treegenrec", treegenrecFn)}
+				m.Push(ListVal(selfQuot))
+				m.call(c.List, nil)
+			})
 		}
 	}
 	register("treegenrec", treegenrecFn)
@@ -636,58 +546,9 @@ func init() {
 		b := m.Pop()
 		a := m.Pop()
 		if b.Typ != TypeList {
-			joyErr("some: quotation expected")
+			joyErrKind(ErrType, "some: quotation expected")
 		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		switch a.Typ {
-		case TypeList:
-			for _, item := range a.List {
-				m.Stack = make([]Value, len(savedStack))
-				copy(m.Stack, savedStack)
-				m.Push(item)
-				m.Execute(b.List)
-				if m.Pop().IsTruthy() {
-					m.Stack = make([]Value, len(savedStack))
-					copy(m.Stack, savedStack)
-					m.Push(BoolVal(true))
-					return
-				}
-			}
-		case TypeString:
-			for _, ch := range a.Str {
-				m.Stack = make([]Value, len(savedStack))
-				copy(m.Stack, savedStack)
-				m.Push(CharVal(int64(ch)))
-				m.Execute(b.List)
-				if m.Pop().IsTruthy() {
-					m.Stack = make([]Value, len(savedStack))
-					copy(m.Stack, savedStack)
-					m.Push(BoolVal(true))
-					return
-				}
-			}
-		case TypeSet:
-			for i := 0; i < SetSize; i++ {
-				if a.Int&(1<<i) != 0 {
-					m.Stack = make([]Value, len(savedStack))
-					copy(m.Stack, savedStack)
-					m.Push(IntVal(int64(i)))
-					m.Execute(b.List)
-					if m.Pop().IsTruthy() {
-						m.Stack = make([]Value, len(savedStack))
-						copy(m.Stack, savedStack)
-						m.Push(BoolVal(true))
-						return
-					}
-				}
-			}
-		default:
-			joyErr("some: aggregate expected")
-		}
-		m.Stack = make([]Value, len(savedStack))
-		copy(m.Stack, savedStack)
-		m.Push(BoolVal(false))
+		search(m, members(a, "some"), b.List, true)
 	})
 
 	// all: A [B] -> X — true if all members satisfy B (SAVESTACK)
@@ -696,58 +557,9 @@ func init() {
 		b := m.Pop()
 		a := m.Pop()
 		if b.Typ != TypeList {
-			joyErr("all: quotation expected")
-		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
-		switch a.Typ {
-		case TypeList:
-			for _, item := range a.List {
-				m.Stack = make([]Value, len(savedStack))
-				copy(m.Stack, savedStack)
-				m.Push(item)
-				m.Execute(b.List)
-				if !m.Pop().IsTruthy() {
-					m.Stack = make([]Value, len(savedStack))
-					copy(m.Stack, savedStack)
-					m.Push(BoolVal(false))
-					return
-				}
-			}
-		case TypeString:
-			for _, ch := range a.Str {
-				m.Stack = make([]Value, len(savedStack))
-				copy(m.Stack, savedStack)
-				m.Push(CharVal(int64(ch)))
-				m.Execute(b.List)
-				if !m.Pop().IsTruthy() {
-					m.Stack = make([]Value, len(savedStack))
-					copy(m.Stack, savedStack)
-					m.Push(BoolVal(false))
-					return
-				}
-			}
-		case TypeSet:
-			for i := 0; i < SetSize; i++ {
-				if a.Int&(1<<i) != 0 {
-					m.Stack = make([]Value, len(savedStack))
-					copy(m.Stack, savedStack)
-					m.Push(IntVal(int64(i)))
-					m.Execute(b.List)
-					if !m.Pop().IsTruthy() {
-						m.Stack = make([]Value, len(savedStack))
-						copy(m.Stack, savedStack)
-						m.Push(BoolVal(false))
-						return
-					}
-				}
-			}
-		default:
-			joyErr("all: aggregate expected")
+			joyErrKind(ErrType, "all: quotation expected")
 		}
-		m.Stack = make([]Value, len(savedStack))
-		copy(m.Stack, savedStack)
-		m.Push(BoolVal(true))
+		search(m, members(a, "all"), b.List, false)
 	})
 
 	// unary2: X Y [P] -> R S — apply P to X (yielding R), then to Y (yielding S)
@@ -757,21 +569,23 @@ func init() {
 		y := m.Pop()
 		// X is on top of stack now
 		if q.Typ != TypeList {
-			joyErr("unary2: quotation expected")
+			joyErrKind(ErrType, "unary2: quotation expected")
 		}
-		savedStack := make([]Value, len(m.Stack))
-		copy(savedStack, m.Stack)
+		savedStack := m.copyStack()
+		below := savedStack[:len(savedStack)-1]
 		// Execute P on X (X is on stack top)
-		m.Execute(q.List)
-		r := m.Pop()
-		// Restore stack minus X, push Y
-		m.Stack = savedStack[:len(savedStack)-1]
-		m.Push(y)
-		m.Execute(q.List)
-		s := m.Pop()
-		m.Stack = savedStack[:len(savedStack)-1]
-		m.Push(r)
-		m.Push(s)
+		m.call(q.List, func(m *Machine) {
+			r := m.Pop()
+			// Restore stack minus X, push Y
+			m.restoreStack(below)
+			m.Push(y)
+			m.call(q.List, func(m *Machine) {
+				s := m.Pop()
+				m.restoreStack(below)
+				m.Push(r)
+				m.Push(s)
+			})
+		})
 	})
 
 	// while: [B] [P] -> ... — while B is true, execute P
@@ -780,45 +594,207 @@ func init() {
 		body := m.Pop()
 		test := m.Pop()
 		if test.Typ != TypeList || body.Typ != TypeList {
-			joyErr("while: two quotations expected")
-		}
-		for {
-			savedStack := make([]Value, len(m.Stack))
-			copy(savedStack, m.Stack)
-			m.Execute(test.List)
-			cond := m.Pop()
-			m.Stack = savedStack
-			if !cond.IsTruthy() {
-				break
-			}
-			m.Execute(body.List)
+			joyErrKind(ErrType, "while: two quotations expected")
+		}
+		var loop func(m *Machine)
+		loop = func(m *Machine) {
+			m.test(test.List, func(m *Machine, ok bool) {
+				if ok {
+					m.call(body.List, loop)
+				}
+			})
 		}
+		loop(m)
+	})
+}
+
+// copyStack returns a copy of the stack for restoreStack.
+func (m *Machine) copyStack() []Value {
+	return append([]Value(nil), m.Stack...)
+}
+
+// restoreStack makes the stack a copy of saved, leaving saved as it was
+// so that it can be restored again.
+func (m *Machine) restoreStack(saved []Value) {
+	m.modify(0)
+	m.Stack = append(m.Stack[:0], saved...)
+}
+
+// test runs the quotation p and passes whether the value it leaves on top
+// is true to k, with the stack put back as it was before p.
+func (m *Machine) test(p []Value, k func(m *Machine, ok bool)) {
+	m.then(func(m *Machine) {
+		k(m, m.Pop().IsTruthy())
+	})
+	m.keep(p, 0)
+}
+
+// repeat runs q n times.
+func (m *Machine) repeat(q []Value, n int64) {
+	if n <= 0 {
+		return
+	}
+	m.call(q, func(m *Machine) {
+		m.repeat(q, n-1)
 	})
 }
 
-func treestepAux(m *Machine, t Value, p []Value) {
+// each pushes each of items in turn and runs q after it. A single frame
+// walks the items, with no continuation allocated per item.
+func (m *Machine) each(items []Value, q []Value) {
+	if len(items) == 0 {
+		return
+	}
+	m.pushFrame(frame{c: m.compile(q), base: len(m.frames), cur: m.cur, kind: frameEach, mark: len(m.held)})
+	m.held = append(m.held, ListVal(items))
+}
+
+// members returns the elements of an aggregate in order: list items,
+// the characters of a string or the members of a set.
+func members(agg Value, name string) []Value {
+	switch agg.Typ {
+	case TypeList:
+		return agg.List
+	case TypeString:
+		var items []Value
+		for _, ch := range agg.Str {
+			items = append(items, CharVal(int64(ch)))
+		}
+		return items
+	case TypeSet:
+		var items []Value
+		for _, n := range agg.setMembers() {
+			items = append(items, IntVal(n))
+		}
+		return items
+	case TypeMap:
+		return agg.Map().entries()
+	}
+	joyErrKind(ErrType, "%s: aggregate expected", name)
+	return nil
+}
+
+// applyEach runs q once for each of args, pushing just that value each
+// time, then pushes the results in order (app2, app3).
+func applyEach(m *Machine, args []Value, q []Value) {
+	results := make([]Value, len(args))
+	var next func(i int)
+	next = func(i int) {
+		if i == len(args) {
+			for _, r := range results {
+				m.Push(r)
+			}
+			return
+		}
+		m.Push(args[i])
+		m.call(q, func(m *Machine) {
+			results[i] = m.Pop()
+			next(i + 1)
+		})
+	}
+	next(0)
+}
+
+// search runs b on each of items, each time on the stack as it was, and
+// pushes want as soon as b yields want for one of them, !want if it never
+// does (some, all).
+func search(m *Machine, items []Value, b []Value, want bool) {
+	savedStack := m.copyStack()
+	var next func(i int)
+	next = func(i int) {
+		m.restoreStack(savedStack)
+		if i == len(items) {
+			m.Push(BoolVal(!want))
+			return
+		}
+		m.Push(items[i])
+		m.call(b, func(m *Machine) {
+			if m.Pop().IsTruthy() == want {
+				m.restoreStack(savedStack)
+				m.Push(BoolVal(want))
+				return
+			}
+			next(i + 1)
+		})
+	}
+	next(0)
+}
+
+// condFrom tries the clauses of cond from the i-th on.
+func condFrom(m *Machine, clauses []Value, i int) {
+	n := len(clauses)
+	if i == n-1 {
+		// Last clause is the default — execute entire clause body
+		if def := clauses[n-1]; def.Typ == TypeList {
+			m.call(def.List, nil)
+		}
+		return
+	}
+	// Try all clauses except the last as [test body...]
+	clause := clauses[i]
+	if clause.Typ != TypeList || len(clause.List) == 0 {
+		joyErrKind(ErrType, "cond: each clause must be a non-empty list")
+	}
+	test := clause.List[0]
+	body := clause.List[1:]
+	if test.Typ == TypeList {
+		m.test(test.List, func(m *Machine, ok bool) {
+			if ok {
+				m.call(body, nil)
+			} else {
+				condFrom(m, clauses, i+1)
+			}
+		})
+	} else if test.IsTruthy() {
+		m.call(body, nil)
+	} else {
+		condFrom(m, clauses, i+1)
+	}
+}
+
+func treestep(m *Machine, t Value, p []Value) {
 	if t.Typ != TypeList {
 		// leaf
 		m.Push(t)
-		m.Execute(p)
+		m.call(p, nil)
 	} else {
 		// branch — recurse on each child
-		for _, child := range t.List {
-			treestepAux(m, child, p)
-		}
+		treestepChildren(m, t.List, p)
 	}
 }
 
-func treerecAux(m *Machine, t Value, o, c []Value) {
+func treestepChildren(m *Machine, children []Value, p []Value) {
+	if len(children) == 0 {
+		return
+	}
+	if len(children) > 1 {
+		m.then(func(m *Machine) {
+			treestepChildren(m, children[1:], p)
+		})
+	}
+	treestep(m, children[0], p)
+}
+
+func treerec(m *Machine, t Value, o, c []Value) {
 	if t.Typ != TypeList {
 		// leaf
 		m.Push(t)
-		m.Execute(o)
+		m.call(o, nil)
 	} else {
 		// branch — recurse on each child, then combine
-		for _, child := range t.List {
-			treerecAux(m, child, o, c)
-		}
-		m.Execute(c)
+		m.call(c, nil)
+		treerecChildren(m, t.List, o, c)
+	}
+}
+
+func treerecChildren(m *Machine, children []Value, o, c []Value) {
+	if len(children) == 0 {
+		return
+	}
+	if len(children) > 1 {
+		m.then(func(m *Machine) {
+			treerecChildren(m, children[1:], o, c)
+		})
 	}
+	treerec(m, children[0], o, c)
 }
@@ -0,0 +1,81 @@
+package joy
+
+func init() {
+	// catch: [P] [H] -> ... — run P; if it raises an error, restore the
+	// stack to what it was before P, push the error and run H
+	register("catch", func(m *Machine) {
+		m.NeedStack(2, "catch")
+		handler := m.Pop()
+		body := m.Pop()
+		if body.Typ != TypeList || handler.Typ != TypeList {
+			joyErrKind(ErrType, "catch: two quotations expected")
+		}
+		m.guard(body.List, handler.List)
+	})
+
+	// throw: X -> — raise a user error carrying X; an error value from
+	// catch is raised again unchanged
+	register("throw", func(m *Machine) {
+		m.NeedStack(1, "throw")
+		x := m.Pop()
+		if x.Typ == TypeError {
+			panic(*x.Err())
+		}
+		msg := x.Str
+		if x.Typ != TypeString {
+			msg = x.String()
+		}
+		panic(JoyError{Msg: msg, Data: &x})
+	})
+
+	// errmsg: E -> S — the error message
+	register("errmsg", func(m *Machine) {
+		e := popError(m, "errmsg")
+		m.Push(StringVal(e.Msg))
+	})
+
+	// errkind: E -> S — what went wrong: "type", "underflow", "undefined",
+	// "range", "permission", "user" (from throw) or "runtime"
+	register("errkind", func(m *Machine) {
+		e := popError(m, "errkind")
+		m.Push(StringVal(e.class()))
+	})
+
+	// errword: E -> S — the word that raised the error ("" if unknown)
+	register("errword", func(m *Machine) {
+		e := popError(m, "errword")
+		m.Push(StringVal(e.Word))
+	})
+
+	// errdata: E -> X — the value given to throw, or the message
+	register("errdata", func(m *Machine) {
+		e := popError(m, "errdata")
+		if e.Data != nil {
+			m.Push(*e.Data)
+		} else {
+			m.Push(StringVal(e.Msg))
+		}
+	})
+}
+
+func popError(m *Machine, name string) *JoyError {
+	m.NeedStack(1, name)
+	a := m.Pop()
+	if a.Typ != TypeError {
+		joyErrKind(ErrType, "%s: error expected", name)
+	}
+	return a.Err()
+}
+
+// class classifies a catchable error for errkind.
+func (e JoyError) class() string {
+	switch {
+	case e.Data != nil:
+		return "user"
+	case e.Kind == ErrPermission:
+		return "permission"
+	case e.Kind == ErrRuntime:
+		return "runtime"
+	}
+	return string(e.Kind)
+}
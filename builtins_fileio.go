@@ -1,6 +1,7 @@
-package main
+package joy
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -19,10 +20,11 @@ func init() {
 	// fopen: P M -> S — open file at path P with mode M
 	register("fopen", func(m *Machine) {
 		m.NeedStack(2, "fopen")
+		m.require(CapFile, "fopen")
 		mode := m.Pop()
 		path := m.Pop()
 		if path.Typ != TypeString || mode.Typ != TypeString {
-			joyErr("fopen: two strings expected")
+			joyErrKind(ErrType, "fopen: two strings expected")
 		}
 		flags, ok := fopenModes[mode.Str]
 		if !ok {
@@ -41,10 +43,10 @@ func init() {
 		m.NeedStack(1, "fclose")
 		a := m.Pop()
 		if a.Typ != TypeFile {
-			joyErr("fclose: file expected")
+			joyErrKind(ErrType, "fclose: file expected")
 		}
-		if a.File != nil {
-			a.File.Close()
+		if a.File() != nil {
+			a.File().Close()
 		}
 	})
 
@@ -52,13 +54,10 @@ func init() {
 	register("feof", func(m *Machine) {
 		m.NeedStack(1, "feof")
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("feof: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "feof: open file expected")
 		}
-		cur, _ := a.File.Seek(0, io.SeekCurrent)
-		end, _ := a.File.Seek(0, io.SeekEnd)
-		a.File.Seek(cur, io.SeekStart)
-		m.Push(BoolVal(cur >= end))
+		m.Push(BoolVal(a.File().AtEOF()))
 	})
 
 	// ferror: S -> S B — check for error (always false in simple impl)
@@ -66,7 +65,7 @@ func init() {
 		m.NeedStack(1, "ferror")
 		a := m.Peek()
 		if a.Typ != TypeFile {
-			joyErr("ferror: file expected")
+			joyErrKind(ErrType, "ferror: file expected")
 		}
 		m.Push(BoolVal(false))
 	})
@@ -75,24 +74,25 @@ func init() {
 	register("fflush", func(m *Machine) {
 		m.NeedStack(1, "fflush")
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fflush: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fflush: open file expected")
 		}
-		a.File.Sync()
+		a.File().Flush()
 	})
 
 	// fgets: S -> S L — read line as list of characters
 	register("fgets", func(m *Machine) {
 		m.NeedStack(1, "fgets")
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fgets: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fgets: open file expected")
 		}
 		var chars []Value
 		buf := make([]byte, 1)
 		for {
-			n, err := a.File.Read(buf)
+			n, err := a.File().Read(buf)
 			if n > 0 {
+				m.checkList("fgets", len(chars)+1)
 				chars = append(chars, CharVal(int64(buf[0])))
 				if buf[0] == '\n' {
 					break
@@ -108,15 +108,40 @@ func init() {
 		m.Push(ListVal(chars))
 	})
 
+	// fgetsb: S -> S Y — read line as byte string
+	register("fgetsb", func(m *Machine) {
+		m.NeedStack(1, "fgetsb")
+		a := m.Peek()
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fgetsb: open file expected")
+		}
+		var line []byte
+		buf := make([]byte, 1)
+		for {
+			n, err := a.File().Read(buf)
+			if n > 0 {
+				m.checkString("fgetsb", len(line)+1)
+				line = append(line, buf[0])
+				if buf[0] == '\n' {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		m.Push(BytesVal(line))
+	})
+
 	// fgetch: S -> S C — read single character; push -1 on EOF
 	register("fgetch", func(m *Machine) {
 		m.NeedStack(1, "fgetch")
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fgetch: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fgetch: open file expected")
 		}
 		buf := make([]byte, 1)
-		n, _ := a.File.Read(buf)
+		n, _ := a.File().Read(buf)
 		if n == 0 {
 			m.Push(IntVal(-1))
 		} else {
@@ -129,34 +154,64 @@ func init() {
 		m.NeedStack(2, "fread")
 		count := m.Pop()
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fread: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fread: open file expected")
 		}
-		buf := make([]byte, count.Int)
-		n, _ := a.File.Read(buf)
-		chars := make([]Value, n)
-		for i := 0; i < n; i++ {
-			chars[i] = IntVal(int64(buf[i]))
+		buf := readAtMost(a.File(), intArg("fread", count), m.MaxListLen)
+		m.checkList("fread", len(buf))
+		chars := make([]Value, len(buf))
+		for i, b := range buf {
+			chars[i] = IntVal(int64(b))
 		}
 		m.Push(ListVal(chars))
 	})
 
+	// freadb: S I -> S Y — read I bytes as byte string
+	register("freadb", func(m *Machine) {
+		m.NeedStack(2, "freadb")
+		count := m.Pop()
+		a := m.Peek()
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "freadb: open file expected")
+		}
+		if count.Typ != TypeInteger || intArg("freadb", count) < 0 {
+			joyErrKind(ErrType, "freadb: non-negative integer expected")
+		}
+		buf := readAtMost(a.File(), count.Int, m.MaxStringLen)
+		m.checkString("freadb", len(buf))
+		m.Push(BytesVal(buf[:len(buf):len(buf)]))
+	})
+
 	// fwrite: S L -> S — write list of integers as bytes
 	register("fwrite", func(m *Machine) {
 		m.NeedStack(2, "fwrite")
 		data := m.Pop()
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fwrite: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fwrite: open file expected")
 		}
 		if data.Typ != TypeList {
-			joyErr("fwrite: list expected")
+			joyErrKind(ErrType, "fwrite: list expected")
 		}
 		buf := make([]byte, len(data.List))
 		for i, v := range data.List {
 			buf[i] = byte(v.Int)
 		}
-		a.File.Write(buf)
+		a.File().Write(buf)
+	})
+
+	// fwriteb: S Y -> S — write byte string
+	register("fwriteb", func(m *Machine) {
+		m.NeedStack(2, "fwriteb")
+		data := m.Pop()
+		a := m.Peek()
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fwriteb: open file expected")
+		}
+		if data.Typ != TypeBytes {
+			joyErrKind(ErrType, "fwriteb: byte string expected")
+		}
+		a.File().Write(data.Bytes())
 	})
 
 	// fput: S X -> S — write value string representation to file
@@ -164,10 +219,10 @@ func init() {
 		m.NeedStack(2, "fput")
 		x := m.Pop()
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fput: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fput: open file expected")
 		}
-		fmt.Fprint(a.File, x.String())
+		fmt.Fprint(a.File(), x.String())
 	})
 
 	// fputch: S C -> S — write single character to file
@@ -175,13 +230,13 @@ func init() {
 		m.NeedStack(2, "fputch")
 		ch := m.Pop()
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fputch: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fputch: open file expected")
 		}
 		if ch.Typ == TypeChar || ch.Typ == TypeInteger {
-			fmt.Fprint(a.File, string(rune(ch.Int)))
+			fmt.Fprint(a.File(), string(rune(intArg("fputch", ch))))
 		} else {
-			fmt.Fprint(a.File, ch.String())
+			fmt.Fprint(a.File(), ch.String())
 		}
 	})
 
@@ -190,13 +245,13 @@ func init() {
 		m.NeedStack(2, "fputchars")
 		s := m.Pop()
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fputchars: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fputchars: open file expected")
 		}
 		if s.Typ == TypeString {
-			fmt.Fprint(a.File, s.Str)
+			fmt.Fprint(a.File(), s.Str)
 		} else {
-			fmt.Fprint(a.File, s.String())
+			fmt.Fprint(a.File(), s.String())
 		}
 	})
 
@@ -208,29 +263,30 @@ func init() {
 		whence := m.Pop()
 		pos := m.Pop()
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("fseek: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "fseek: open file expected")
 		}
-		a.File.Seek(pos.Int, int(whence.Int))
+		a.File().Seek(intArg("fseek", pos), int(intArg("fseek", whence)))
 	})
 
 	// ftell: S -> S I — get current file position
 	register("ftell", func(m *Machine) {
 		m.NeedStack(1, "ftell")
 		a := m.Peek()
-		if a.Typ != TypeFile || a.File == nil {
-			joyErr("ftell: open file expected")
+		if a.Typ != TypeFile || a.File() == nil {
+			joyErrKind(ErrType, "ftell: open file expected")
 		}
-		pos, _ := a.File.Seek(0, io.SeekCurrent)
+		pos, _ := a.File().Seek(0, io.SeekCurrent)
 		m.Push(IntVal(pos))
 	})
 
 	// fremove: P -> B — remove file at path P
 	register("fremove", func(m *Machine) {
 		m.NeedStack(1, "fremove")
+		m.require(CapFile, "fremove")
 		path := m.Pop()
 		if path.Typ != TypeString {
-			joyErr("fremove: string expected")
+			joyErrKind(ErrType, "fremove: string expected")
 		}
 		err := os.Remove(path.Str)
 		m.Push(BoolVal(err == nil))
@@ -239,38 +295,52 @@ func init() {
 	// frename: P1 P2 -> B — rename file P1 to P2
 	register("frename", func(m *Machine) {
 		m.NeedStack(2, "frename")
+		m.require(CapFile, "frename")
 		newPath := m.Pop()
 		oldPath := m.Pop()
 		if oldPath.Typ != TypeString || newPath.Typ != TypeString {
-			joyErr("frename: two strings expected")
+			joyErrKind(ErrType, "frename: two strings expected")
 		}
 		err := os.Rename(oldPath.Str, newPath.Str)
 		m.Push(BoolVal(err == nil))
 	})
 
-	// stdin: -> S — push stdin file
+	// stdin: -> S — push the machine's input stream
 	register("stdin", func(m *Machine) {
-		m.Push(FileVal(os.Stdin, "stdin"))
+		m.Push(StreamVal(m.stdinStream(), "stdin"))
 	})
 
-	// stdout: -> S — push stdout file
+	// stdout: -> S — push the machine's output stream
 	register("stdout", func(m *Machine) {
-		m.Push(FileVal(os.Stdout, "stdout"))
+		m.Push(StreamVal(m.stdoutStream(), "stdout"))
 	})
 
-	// stderr: -> S — push stderr file
+	// stderr: -> S — push the machine's error stream
 	register("stderr", func(m *Machine) {
-		m.Push(FileVal(os.Stderr, "stderr"))
+		m.Push(StreamVal(m.stderrStream(), "stderr"))
 	})
 
 	// include: S -> — load and execute a Joy source file
+	// Without CapInclude only IncludeDirs and the embedded libs are readable.
 	register("include", func(m *Machine) {
 		m.NeedStack(1, "include")
 		a := m.Pop()
 		if a.Typ != TypeString {
-			joyErr("include: string expected")
+			joyErrKind(ErrType, "include: string expected")
 		}
 		if err := m.RunFile(a.Str); err != nil {
+			// quit, cancellation and quota errors keep unwinding as they are
+			if je, ok := err.(JoyError); ok && !je.Kind.catchable() {
+				panic(je)
+			}
+			if errors.Is(err, errPermission) {
+				joyErrKind(ErrPermission, "include: %v", err)
+			}
+			if je, ok := err.(JoyError); ok && je.Line > 0 {
+				// keep the position inside the included file
+				je.Msg = "include: " + je.Msg
+				panic(je)
+			}
 			joyErr("include: %v", err)
 		}
 	})
@@ -290,7 +360,21 @@ func init() {
 				verb = rune(mode.Int)
 			}
 		}
-		fmtStr := fmt.Sprintf("%%%d.%d%c", width.Int, prec.Int, verb)
+		w, p := intArg("formatf", width), intArg("formatf", prec)
+		m.checkString("formatf", int(w))
+		m.checkString("formatf", int(p))
+		fmtStr := fmt.Sprintf("%%%d.%d%c", w, p, verb)
 		m.Push(StringVal(fmt.Sprintf(fmtStr, f.NumericVal())))
 	})
 }
+
+// readAtMost reads up to n bytes from r. With a quota limit set it stops
+// one byte past the limit, enough for the caller's check to fail, so a
+// large n costs no more than the data actually read.
+func readAtMost(r io.Reader, n int64, limit int) []byte {
+	if limit > 0 && n > int64(limit) {
+		n = int64(limit) + 1
+	}
+	buf, _ := io.ReadAll(io.LimitReader(r, n))
+	return buf
+}
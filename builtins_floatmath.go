@@ -1,12 +1,19 @@
-package main
+package joy
 
-import "math"
+import (
+	"math"
+	"math/cmplx"
+)
 
 func init() {
 	// sin: F -> G — sine
 	register("sin", func(m *Machine) {
 		m.NeedStack(1, "sin")
 		a := m.Pop()
+		if a.Typ == TypeComplex {
+			m.Push(ComplexVal(cmplx.Sin(a.complex())))
+			return
+		}
 		m.Push(FloatVal(math.Sin(a.NumericVal())))
 	})
 
@@ -14,6 +21,10 @@ func init() {
 	register("cos", func(m *Machine) {
 		m.NeedStack(1, "cos")
 		a := m.Pop()
+		if a.Typ == TypeComplex {
+			m.Push(ComplexVal(cmplx.Cos(a.complex())))
+			return
+		}
 		m.Push(FloatVal(math.Cos(a.NumericVal())))
 	})
 
@@ -57,6 +68,10 @@ func init() {
 	register("log", func(m *Machine) {
 		m.NeedStack(1, "log")
 		a := m.Pop()
+		if a.Typ == TypeComplex {
+			m.Push(ComplexVal(cmplx.Log(a.complex())))
+			return
+		}
 		m.Push(FloatVal(math.Log(a.NumericVal())))
 	})
 
@@ -71,6 +86,10 @@ func init() {
 	register("exp", func(m *Machine) {
 		m.NeedStack(1, "exp")
 		a := m.Pop()
+		if a.Typ == TypeComplex {
+			m.Push(ComplexVal(cmplx.Exp(a.complex())))
+			return
+		}
 		m.Push(FloatVal(math.Exp(a.NumericVal())))
 	})
 
@@ -79,6 +98,10 @@ func init() {
 		m.NeedStack(2, "pow")
 		g := m.Pop()
 		f := m.Pop()
+		if f.Typ == TypeComplex || g.Typ == TypeComplex {
+			m.Push(ComplexVal(cmplx.Pow(f.complex(), g.complex())))
+			return
+		}
 		m.Push(FloatVal(math.Pow(f.NumericVal(), g.NumericVal())))
 	})
 
@@ -87,7 +110,7 @@ func init() {
 		m.NeedStack(2, "ldexp")
 		i := m.Pop()
 		f := m.Pop()
-		m.Push(FloatVal(math.Ldexp(f.NumericVal(), int(i.Int))))
+		m.Push(FloatVal(math.Ldexp(f.NumericVal(), int(intArg("ldexp", i)))))
 	})
 
 	// frexp: F -> G I — split F into fraction G and exponent I
@@ -107,4 +130,40 @@ func init() {
 		m.Push(FloatVal(frac))
 		m.Push(FloatVal(integer))
 	})
+
+	// complex: F G -> C — the complex number F+Gi
+	register("complex", func(m *Machine) {
+		m.NeedStack(2, "complex")
+		g := m.Pop()
+		f := m.Pop()
+		m.Push(ComplexVal(complex(f.NumericVal(), g.NumericVal())))
+	})
+
+	// re: C -> F — real part
+	register("re", func(m *Machine) {
+		m.NeedStack(1, "re")
+		a := m.Pop()
+		m.Push(FloatVal(real(a.complex())))
+	})
+
+	// im: C -> F — imaginary part
+	register("im", func(m *Machine) {
+		m.NeedStack(1, "im")
+		a := m.Pop()
+		m.Push(FloatVal(imag(a.complex())))
+	})
+
+	// conj: C -> D — complex conjugate
+	register("conj", func(m *Machine) {
+		m.NeedStack(1, "conj")
+		a := m.Pop()
+		m.Push(ComplexVal(cmplx.Conj(a.complex())))
+	})
+
+	// cabs: C -> F — absolute value (modulus)
+	register("cabs", func(m *Machine) {
+		m.NeedStack(1, "cabs")
+		a := m.Pop()
+		m.Push(FloatVal(cmplx.Abs(a.complex())))
+	})
 }
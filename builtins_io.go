@@ -1,13 +1,16 @@
-package main
+package joy
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+)
 
 func init() {
 	// put: print top of stack followed by space
 	register("put", func(m *Machine) {
 		m.NeedStack(1, "put")
 		a := m.Pop()
-		fmt.Print(a.String())
+		fmt.Fprint(m.Stdout, a.String())
 	})
 
 	// putch: print character value (no quotes)
@@ -15,9 +18,9 @@ func init() {
 		m.NeedStack(1, "putch")
 		a := m.Pop()
 		if a.Typ == TypeChar || a.Typ == TypeInteger {
-			fmt.Print(string(rune(a.Int)))
+			fmt.Fprint(m.Stdout, string(rune(intArg("putch", a))))
 		} else {
-			fmt.Print(a.String())
+			fmt.Fprint(m.Stdout, a.String())
 		}
 	})
 
@@ -26,9 +29,9 @@ func init() {
 		m.NeedStack(1, "putchars")
 		a := m.Pop()
 		if a.Typ == TypeString {
-			fmt.Print(a.Str)
+			fmt.Fprint(m.Stdout, a.Str)
 		} else {
-			fmt.Print(a.String())
+			fmt.Fprint(m.Stdout, a.String())
 		}
 	})
 
@@ -36,28 +39,30 @@ func init() {
 	register(".", func(m *Machine) {
 		m.NeedStack(1, ".")
 		a := m.Pop()
-		fmt.Println(a.String())
+		fmt.Fprintln(m.Stdout, a.String())
 	})
 
 	// .s : print stack without consuming
 	register(".s", func(m *Machine) {
-		fmt.Println(m.PrintStack())
+		fmt.Fprintln(m.Stdout, m.PrintStack())
 	})
 
 	// newline
 	register("newline", func(m *Machine) {
-		fmt.Println()
+		fmt.Fprintln(m.Stdout)
 	})
 
-	// get: -> X — read a line from stdin, parse as Joy, push result
+	// get: -> X — read a line from the input stream, parse as Joy, push result
 	register("get", func(m *Machine) {
-		if m.Input == nil {
+		if m.Stdin == nil {
 			joyErr("get: no input source available")
 		}
-		if !m.Input.Scan() {
+		line, err := m.ReadLine()
+		if err == io.EOF {
 			joyErr("get: end of input")
+		} else if err != nil {
+			joyErr("get: %v", err)
 		}
-		line := m.Input.Text()
 		tokens := NewScanner(line).ScanAll()
 		program := NewParser(tokens, m).Parse()
 		// Push each parsed value onto the stack
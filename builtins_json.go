@@ -0,0 +1,201 @@
+package joy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// JSON objects are maps from strings, in the order of their keys, arrays
+// are lists and null is the symbol null. Numbers without a fraction or
+// exponent are integers, others floats. >json writes sets as arrays and
+// records as objects of their fields. Error positions are byte offsets
+// from 0.
+
+func init() {
+	// json>: S -> X — the value of the JSON text S
+	register("json>", func(m *Machine) {
+		m.NeedStack(1, "json>")
+		s := popString(m, "json>")
+		m.Push(m.decodeJSON(s))
+	})
+
+	// >json: X -> S — X as compact JSON text
+	register(">json", func(m *Machine) {
+		m.NeedStack(1, ">json")
+		var b bytes.Buffer
+		encodeJSON(&b, m.Pop())
+		m.checkString(">json", b.Len())
+		m.Push(StringVal(b.String()))
+	})
+
+	// >jsonpretty: X -> S — X as JSON text indented by two spaces
+	register(">jsonpretty", func(m *Machine) {
+		m.NeedStack(1, ">jsonpretty")
+		var b, out bytes.Buffer
+		encodeJSON(&b, m.Pop())
+		json.Indent(&out, b.Bytes(), "", "  ")
+		m.checkString(">jsonpretty", out.Len())
+		m.Push(StringVal(out.String()))
+	})
+}
+
+func (m *Machine) decodeJSON(s string) Value {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	fail := func(err error) {
+		var syn *json.SyntaxError
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			joyErr("json>: unexpected end of JSON input at byte %d", len(s))
+		case errors.As(err, &syn) && syn.Error() == "unexpected end of JSON input":
+			joyErr("json>: %s at byte %d", syn.Error(), len(s))
+		case errors.As(err, &syn):
+			// Offset counts the bytes read, the bad one included
+			joyErr("json>: %s at byte %d", syn.Error(), syn.Offset-1)
+		}
+		joyErr("json>: %v at byte %d", err, dec.InputOffset())
+	}
+	var value func() Value
+	value = func() Value {
+		tok, err := dec.Token()
+		if err != nil {
+			fail(err)
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			if t == '[' {
+				items := []Value{}
+				for dec.More() {
+					m.checkList("json>", len(items)+1)
+					items = append(items, value())
+				}
+				if _, err := dec.Token(); err != nil {
+					fail(err)
+				}
+				return ListVal(items)
+			}
+			d := newMap(0)
+			for dec.More() {
+				m.checkList("json>", d.Len()+1)
+				key := value()
+				d = d.put(mapKey("json>", key), key, value())
+			}
+			if _, err := dec.Token(); err != nil {
+				fail(err)
+			}
+			return mapVal(d)
+		case json.Number:
+			return jsonNumber(string(t))
+		case string:
+			m.checkString("json>", len(t))
+			return StringVal(t)
+		case bool:
+			return BoolVal(t)
+		}
+		// null as the parser reads it, which is the null builtin
+		if fn, ok := m.Builtins["null"]; ok {
+			return BuiltinVal("null", fn)
+		}
+		return m.userDef("null")
+	}
+	v := value()
+	off := int(dec.InputOffset())
+	for off < len(s) && strings.IndexByte(" \t\r\n", s[off]) >= 0 {
+		off++
+	}
+	if off < len(s) {
+		joyErr("json>: unexpected data after the value at byte %d", off)
+	}
+	return v
+}
+
+func jsonNumber(s string) Value {
+	if !strings.ContainsAny(s, ".eE") {
+		if n, ok := new(big.Int).SetString(s, 10); ok {
+			return BigIntVal(n)
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		joyErrKind(ErrRange, "json>: number %s out of range", s)
+	}
+	return FloatVal(f)
+}
+
+func encodeJSON(b *bytes.Buffer, v Value) {
+	switch v.Typ {
+	case TypeBoolean:
+		b.WriteString(v.String())
+	case TypeInteger:
+		b.WriteString(v.String())
+	case TypeFloat:
+		if math.IsInf(v.Flt, 0) || math.IsNaN(v.Flt) {
+			joyErr(">json: cannot encode %s", v)
+		}
+		b.WriteString(v.String())
+	case TypeString:
+		jsonString(b, v.Str)
+	case TypeChar:
+		jsonString(b, string(rune(v.Int)))
+	case TypeList, TypeSet:
+		items := v.List
+		if v.Typ == TypeSet {
+			items = members(v, ">json")
+		}
+		b.WriteByte('[')
+		for i, item := range items {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			encodeJSON(b, item)
+		}
+		b.WriteByte(']')
+	case TypeMap:
+		b.WriteByte('{')
+		d := v.Map()
+		for i, key := range d.keys {
+			if key.Typ != TypeString {
+				joyErr(">json: object key %s is not a string", key)
+			}
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			jsonString(b, key.Str)
+			b.WriteByte(':')
+			encodeJSON(b, d.vals[i])
+		}
+		b.WriteByte('}')
+	case TypeRecord:
+		b.WriteByte('{')
+		for i, field := range v.Rec().Fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			jsonString(b, field)
+			b.WriteByte(':')
+			encodeJSON(b, v.List[i])
+		}
+		b.WriteByte('}')
+	case TypeUserDef, TypeBuiltin:
+		// as in [true null], where they are symbols
+		if v.Str != "null" && v.Str != "true" && v.Str != "false" {
+			joyErr(">json: cannot encode %s", v)
+		}
+		b.WriteString(v.Str)
+	default:
+		joyErr(">json: cannot encode %s", v)
+	}
+}
+
+func jsonString(b *bytes.Buffer, s string) {
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	b.Truncate(b.Len() - 1) // the newline Encode adds
+}
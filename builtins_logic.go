@@ -1,4 +1,6 @@
-package main
+package joy
+
+import "math/big"
 
 func init() {
 	register("and", func(m *Machine) {
@@ -6,7 +8,7 @@ func init() {
 		b := m.Pop()
 		a := m.Pop()
 		if a.Typ == TypeSet && b.Typ == TypeSet {
-			m.Push(SetVal(a.Int & b.Int))
+			m.Push(setOp(a, b, func(x, y int64) int64 { return x & y }, (*big.Int).And))
 		} else {
 			m.Push(BoolVal(a.IsTruthy() && b.IsTruthy()))
 		}
@@ -17,7 +19,7 @@ func init() {
 		b := m.Pop()
 		a := m.Pop()
 		if a.Typ == TypeSet && b.Typ == TypeSet {
-			m.Push(SetVal(a.Int | b.Int))
+			m.Push(setOp(a, b, func(x, y int64) int64 { return x | y }, (*big.Int).Or))
 		} else {
 			m.Push(BoolVal(a.IsTruthy() || b.IsTruthy()))
 		}
@@ -28,7 +30,7 @@ func init() {
 		b := m.Pop()
 		a := m.Pop()
 		if a.Typ == TypeSet && b.Typ == TypeSet {
-			m.Push(SetVal(a.Int ^ b.Int))
+			m.Push(setOp(a, b, func(x, y int64) int64 { return x ^ y }, (*big.Int).Xor))
 		} else {
 			m.Push(BoolVal(a.IsTruthy() != b.IsTruthy()))
 		}
@@ -38,7 +40,9 @@ func init() {
 		m.NeedStack(1, "not")
 		a := m.Pop()
 		if a.Typ == TypeSet {
-			m.Push(SetVal(^a.Int & ((1 << SetSize) - 1)))
+			// The complement spans the whole of 0..SetSize-1.
+			m.checkBytes("not", SetSize/8)
+			m.Push(setComplement(a))
 		} else {
 			m.Push(BoolVal(!a.IsTruthy()))
 		}
@@ -0,0 +1,78 @@
+package joy
+
+// Maps are values: mput and mdel leave the map they are given as it was
+// and push a changed copy. step, map, filter and fold see the entries of
+// a map as [key value] lists, in insertion order.
+
+func init() {
+	// mget: M K -> V — the value of key K
+	register("mget", func(m *Machine) {
+		m.NeedStack(2, "mget")
+		key := m.Pop()
+		d := popMap(m, "mget")
+		i, ok := d.find(mapKey("mget", key))
+		if !ok {
+			joyErr("mget: key %s not found", key)
+		}
+		m.Push(d.vals[i])
+	})
+
+	// mput: M K V -> M' — M with key K set to V
+	register("mput", func(m *Machine) {
+		m.NeedStack(3, "mput")
+		val := m.Pop()
+		key := m.Pop()
+		d := popMap(m, "mput")
+		h := mapKey("mput", key)
+		if _, ok := d.find(h); !ok {
+			m.checkList("mput", d.Len()+1)
+		}
+		m.Push(mapVal(d.put(h, key, val)))
+	})
+
+	// mdel: M K -> M' — M without key K
+	register("mdel", func(m *Machine) {
+		m.NeedStack(2, "mdel")
+		key := m.Pop()
+		d := popMap(m, "mdel")
+		m.Push(mapVal(d.del(mapKey("mdel", key))))
+	})
+
+	// mhas: M K -> B — whether M has key K
+	register("mhas", func(m *Machine) {
+		m.NeedStack(2, "mhas")
+		key := m.Pop()
+		d := popMap(m, "mhas")
+		_, ok := d.Get(key)
+		m.Push(BoolVal(ok))
+	})
+
+	// mkeys: M -> [K ...] — the keys of M in insertion order
+	register("mkeys", func(m *Machine) {
+		m.NeedStack(1, "mkeys")
+		d := popMap(m, "mkeys")
+		m.Push(ListVal(append([]Value{}, d.keys...)))
+	})
+
+	// mvals: M -> [V ...] — the values of M, in the order of mkeys
+	register("mvals", func(m *Machine) {
+		m.NeedStack(1, "mvals")
+		d := popMap(m, "mvals")
+		m.Push(ListVal(append([]Value{}, d.vals...)))
+	})
+
+	// msize: M -> N — the number of entries of M
+	register("msize", func(m *Machine) {
+		m.NeedStack(1, "msize")
+		d := popMap(m, "msize")
+		m.Push(IntVal(int64(d.Len())))
+	})
+}
+
+func popMap(m *Machine, name string) *Map {
+	a := m.Pop()
+	if a.Typ != TypeMap {
+		joyErrKind(ErrType, "%s: map expected", name)
+	}
+	return a.Map()
+}
@@ -1,6 +1,11 @@
-package main
+package joy
 
-import "math"
+import (
+	"math"
+	"math/big"
+	"math/cmplx"
+	"strconv"
+)
 
 func init() {
 	// Arithmetic
@@ -8,50 +13,49 @@ func init() {
 		m.NeedStack(2, "+")
 		b := m.Pop()
 		a := m.Pop()
-		if a.Typ == TypeFloat || b.Typ == TypeFloat {
-			m.Push(FloatVal(a.NumericVal() + b.NumericVal()))
-		} else {
-			m.Push(IntVal(a.Int + b.Int))
-		}
+		m.Push(add(a, b))
 	})
 
 	register("-", func(m *Machine) {
 		m.NeedStack(2, "-")
 		b := m.Pop()
 		a := m.Pop()
-		if a.Typ == TypeFloat || b.Typ == TypeFloat {
-			m.Push(FloatVal(a.NumericVal() - b.NumericVal()))
-		} else {
-			m.Push(IntVal(a.Int - b.Int))
-		}
+		m.Push(sub(a, b))
 	})
 
 	register("*", func(m *Machine) {
 		m.NeedStack(2, "*")
 		b := m.Pop()
 		a := m.Pop()
-		if a.Typ == TypeFloat || b.Typ == TypeFloat {
-			m.Push(FloatVal(a.NumericVal() * b.NumericVal()))
-		} else {
-			m.Push(IntVal(a.Int * b.Int))
-		}
+		m.Push(mul(a, b))
 	})
 
 	register("/", func(m *Machine) {
 		m.NeedStack(2, "/")
 		b := m.Pop()
 		a := m.Pop()
-		if a.Typ == TypeFloat || b.Typ == TypeFloat {
+		if a.Typ == TypeComplex || b.Typ == TypeComplex {
+			bv := b.complex()
+			if bv == 0 {
+				joyErrKind(ErrRange, "/: division by zero")
+			}
+			m.Push(ComplexVal(a.complex() / bv))
+		} else if a.Typ == TypeFloat || b.Typ == TypeFloat {
 			bv := b.NumericVal()
 			if bv == 0 {
-				joyErr("/: division by zero")
+				joyErrKind(ErrRange, "/: division by zero")
 			}
 			m.Push(FloatVal(a.NumericVal() / bv))
+		} else if a.Typ == TypeRational || b.Typ == TypeRational {
+			if b.Typ != TypeRational && b.Int == 0 {
+				joyErrKind(ErrRange, "/: division by zero")
+			}
+			m.Push(RatVal(new(big.Rat).Quo(a.rat(), b.rat())))
 		} else {
 			if b.Int == 0 {
-				joyErr("/: division by zero")
+				joyErrKind(ErrRange, "/: division by zero")
 			}
-			m.Push(IntVal(a.Int / b.Int))
+			m.Push(quoInts(a, b))
 		}
 	})
 
@@ -59,55 +63,69 @@ func init() {
 		m.NeedStack(2, "rem")
 		b := m.Pop()
 		a := m.Pop()
+		if a.Typ == TypeRational || b.Typ == TypeRational || a.Typ == TypeComplex || b.Typ == TypeComplex {
+			joyErrKind(ErrType, "rem: integers expected")
+		}
 		if b.Int == 0 {
-			joyErr("rem: division by zero")
+			joyErrKind(ErrRange, "rem: division by zero")
 		}
-		m.Push(IntVal(a.Int % b.Int))
+		m.Push(remInts(a, b))
 	})
 
 	register("div", func(m *Machine) {
 		m.NeedStack(2, "div")
 		b := m.Pop()
 		a := m.Pop()
+		if a.Typ == TypeRational || b.Typ == TypeRational || a.Typ == TypeComplex || b.Typ == TypeComplex {
+			joyErrKind(ErrType, "div: integers expected")
+		}
 		if b.Int == 0 {
-			joyErr("div: division by zero")
+			joyErrKind(ErrRange, "div: division by zero")
 		}
-		m.Push(IntVal(a.Int / b.Int))
+		m.Push(quoInts(a, b))
 	})
 
 	register("succ", func(m *Machine) {
 		m.NeedStack(1, "succ")
 		a := m.Pop()
-		m.Push(IntVal(a.Int + 1))
+		m.Push(add(a, IntVal(1)))
 	})
 
 	register("pred", func(m *Machine) {
 		m.NeedStack(1, "pred")
 		a := m.Pop()
-		m.Push(IntVal(a.Int - 1))
+		m.Push(sub(a, IntVal(1)))
 	})
 
 	register("neg", func(m *Machine) {
 		m.NeedStack(1, "neg")
 		a := m.Pop()
-		if a.Typ == TypeFloat {
+		switch a.Typ {
+		case TypeFloat:
 			m.Push(FloatVal(-a.Flt))
-		} else {
-			m.Push(IntVal(-a.Int))
+		case TypeComplex:
+			m.Push(ComplexVal(-a.complex()))
+		case TypeRational:
+			m.Push(RatVal(new(big.Rat).Neg(a.Rat())))
+		default:
+			m.Push(negInt(a))
 		}
 	})
 
 	register("abs", func(m *Machine) {
 		m.NeedStack(1, "abs")
 		a := m.Pop()
-		if a.Typ == TypeFloat {
+		switch {
+		case a.Typ == TypeFloat:
 			m.Push(FloatVal(math.Abs(a.Flt)))
-		} else {
-			if a.Int < 0 {
-				m.Push(IntVal(-a.Int))
-			} else {
-				m.Push(a)
-			}
+		case a.Typ == TypeRational:
+			m.Push(RatVal(new(big.Rat).Abs(a.Rat())))
+		case a.Typ == TypeComplex:
+			m.Push(FloatVal(cmplx.Abs(a.complex())))
+		case a.Int < 0:
+			m.Push(negInt(a))
+		default:
+			m.Push(a)
 		}
 	})
 
@@ -155,14 +173,14 @@ func init() {
 		case TypeInteger:
 			m.Push(a)
 		default:
-			joyErr("ord: char or integer expected")
+			joyErrKind(ErrType, "ord: char or integer expected")
 		}
 	})
 
 	register("chr", func(m *Machine) {
 		m.NeedStack(1, "chr")
 		a := m.Pop()
-		m.Push(CharVal(a.Int))
+		m.Push(CharVal(intArg("chr", a)))
 	})
 
 	// Comparisons
@@ -219,24 +237,154 @@ func init() {
 	register("sqrt", func(m *Machine) {
 		m.NeedStack(1, "sqrt")
 		a := m.Pop()
+		if a.Typ == TypeComplex {
+			m.Push(ComplexVal(cmplx.Sqrt(a.complex())))
+			return
+		}
 		m.Push(FloatVal(math.Sqrt(a.NumericVal())))
 	})
 
 	register("floor", func(m *Machine) {
 		m.NeedStack(1, "floor")
 		a := m.Pop()
-		m.Push(IntVal(int64(math.Floor(a.NumericVal()))))
+		switch a.Typ {
+		case TypeInteger:
+			m.Push(a)
+		case TypeRational:
+			m.Push(ratInt(a.Rat(), "floor"))
+		default:
+			m.Push(floatInt(math.Floor(a.NumericVal())))
+		}
 	})
 
 	register("ceil", func(m *Machine) {
 		m.NeedStack(1, "ceil")
 		a := m.Pop()
-		m.Push(IntVal(int64(math.Ceil(a.NumericVal()))))
+		switch a.Typ {
+		case TypeInteger:
+			m.Push(a)
+		case TypeRational:
+			m.Push(ratInt(a.Rat(), "ceil"))
+		default:
+			m.Push(floatInt(math.Ceil(a.NumericVal())))
+		}
 	})
 
 	register("trunc", func(m *Machine) {
 		m.NeedStack(1, "trunc")
 		a := m.Pop()
-		m.Push(IntVal(int64(math.Trunc(a.NumericVal()))))
+		switch a.Typ {
+		case TypeInteger:
+			m.Push(a)
+		case TypeRational:
+			m.Push(ratInt(a.Rat(), "trunc"))
+		default:
+			m.Push(floatInt(math.Trunc(a.NumericVal())))
+		}
+	})
+
+	// Rationals
+	// ratio: I J -> R — the exact fraction I/J
+	register("ratio", func(m *Machine) {
+		m.NeedStack(2, "ratio")
+		b := m.Pop()
+		a := m.Pop()
+		if a.Typ != TypeInteger || b.Typ != TypeInteger {
+			joyErrKind(ErrType, "ratio: two integers expected")
+		}
+		if b.Int == 0 {
+			joyErrKind(ErrRange, "ratio: division by zero")
+		}
+		m.Push(RatVal(new(big.Rat).SetFrac(a.bigInt(), b.bigInt())))
 	})
+
+	register("numerator", func(m *Machine) {
+		m.NeedStack(1, "numerator")
+		a := m.Pop()
+		switch a.Typ {
+		case TypeRational:
+			m.Push(BigIntVal(new(big.Int).Set(a.Rat().Num())))
+		case TypeInteger:
+			m.Push(a)
+		default:
+			joyErrKind(ErrType, "numerator: rational or integer expected")
+		}
+	})
+
+	register("denominator", func(m *Machine) {
+		m.NeedStack(1, "denominator")
+		a := m.Pop()
+		switch a.Typ {
+		case TypeRational:
+			m.Push(BigIntVal(new(big.Int).Set(a.Rat().Denom())))
+		case TypeInteger:
+			m.Push(IntVal(1))
+		default:
+			joyErrKind(ErrType, "denominator: rational or integer expected")
+		}
+	})
+
+	// tofloat: N -> F — the nearest float to a number
+	register("tofloat", func(m *Machine) {
+		m.NeedStack(1, "tofloat")
+		a := m.Pop()
+		m.Push(FloatVal(a.NumericVal()))
+	})
+
+	// torational: N -> R — a float as the fraction its shortest decimal
+	// form stands for: 0.1 torational is 1/10r
+	register("torational", func(m *Machine) {
+		m.NeedStack(1, "torational")
+		a := m.Pop()
+		switch a.Typ {
+		case TypeFloat:
+			r, ok := new(big.Rat).SetString(strconv.FormatFloat(a.Flt, 'g', -1, 64))
+			if !ok {
+				joyErrKind(ErrType, "torational: finite float expected")
+			}
+			m.Push(RatVal(r))
+		case TypeInteger, TypeRational:
+			m.Push(a)
+		default:
+			joyErrKind(ErrType, "torational: number expected")
+		}
+	})
+}
+
+// add, sub and mul are +, - and * on numbers: the result is complex or
+// a float if either operand is, and exact otherwise.
+func add(a, b Value) Value {
+	switch {
+	case a.Typ == TypeComplex || b.Typ == TypeComplex:
+		return ComplexVal(a.complex() + b.complex())
+	case a.Typ == TypeFloat || b.Typ == TypeFloat:
+		return FloatVal(a.NumericVal() + b.NumericVal())
+	case a.Typ == TypeRational || b.Typ == TypeRational:
+		return RatVal(new(big.Rat).Add(a.rat(), b.rat()))
+	}
+	return addInts(a, b)
+}
+
+func sub(a, b Value) Value {
+	switch {
+	case a.Typ == TypeComplex || b.Typ == TypeComplex:
+		return ComplexVal(a.complex() - b.complex())
+	case a.Typ == TypeFloat || b.Typ == TypeFloat:
+		return FloatVal(a.NumericVal() - b.NumericVal())
+	case a.Typ == TypeRational || b.Typ == TypeRational:
+		return RatVal(new(big.Rat).Sub(a.rat(), b.rat()))
+	}
+	return subInts(a, b)
+}
+
+func mul(a, b Value) Value {
+	switch {
+	case a.Typ == TypeComplex || b.Typ == TypeComplex:
+		return ComplexVal(a.complex() * b.complex())
+	case a.Typ == TypeFloat || b.Typ == TypeFloat:
+		return FloatVal(a.NumericVal() * b.NumericVal())
+	case a.Typ == TypeRational || b.Typ == TypeRational:
+		return RatVal(new(big.Rat).Mul(a.rat(), b.rat()))
+	}
+	return mulInts(a, b)
 }
@@ -1,4 +1,4 @@
-package main
+package joy
 
 import (
 	"fmt"
@@ -21,6 +21,7 @@ func init() {
 	})
 
 	register("setsize", func(m *Machine) {
+		// the cap on members, 0..setsize-1, not the width of a set
 		m.Push(IntVal(SetSize))
 	})
 
@@ -34,10 +35,12 @@ func init() {
 	})
 
 	register("argc", func(m *Machine) {
+		m.require(CapProcess, "argc")
 		m.Push(IntVal(int64(len(os.Args))))
 	})
 
 	register("argv", func(m *Machine) {
+		m.require(CapProcess, "argv")
 		var args []Value
 		for _, a := range os.Args {
 			args = append(args, StringVal(a))
@@ -45,17 +48,24 @@ func init() {
 		m.Push(ListVal(args))
 	})
 
+	// quit unwinds to the host with an ErrQuit error; the joy command
+	// exits when it sees one.
 	register("quit", func(m *Machine) {
-		os.Exit(0)
+		joyErrKind(ErrQuit, "quit")
 	})
 
 	register("abort", func(m *Machine) {
 		joyErr("abort")
 	})
 
+	// typeof: X -> I — the type code of X; for a record, its type name
 	register("typeof", func(m *Machine) {
 		m.NeedStack(1, "typeof")
 		a := m.Pop()
+		if a.Typ == TypeRecord {
+			m.Push(UserDefVal(a.Rec().Name))
+			return
+		}
 		m.Push(IntVal(int64(a.Typ)))
 	})
 
@@ -98,7 +108,7 @@ func init() {
 		cases := m.Pop()
 		x := m.Peek()
 		if cases.Typ != TypeList {
-			joyErr("opcase: list expected")
+			joyErrKind(ErrType, "opcase: list expected")
 		}
 		for _, c := range cases.List {
 			if c.Typ == TypeList && len(c.List) > 0 {
@@ -124,7 +134,7 @@ func init() {
 		cases := m.Pop()
 		x := m.Pop()
 		if cases.Typ != TypeList {
-			joyErr("case: list expected")
+			joyErrKind(ErrType, "case: list expected")
 		}
 		n := len(cases.List)
 		if n == 0 {
@@ -136,7 +146,7 @@ func init() {
 			if c.Typ == TypeList && len(c.List) >= 1 {
 				if c.List[0].Equal(x) {
 					// Match: pop both X and case-list (already done), execute body
-					m.Execute(c.List[1:])
+					m.call(c.List[1:], nil)
 					return
 				}
 			}
@@ -145,7 +155,7 @@ func init() {
 		m.Push(x)
 		last := cases.List[n-1]
 		if last.Typ == TypeList {
-			m.Execute(last.List)
+			m.call(last.List, nil)
 		}
 	})
 
@@ -153,13 +163,13 @@ func init() {
 	register("setautoput", func(m *Machine) {
 		m.NeedStack(1, "setautoput")
 		a := m.Pop()
-		m.Autoput = int(a.Int)
+		m.Autoput = int(intArg("setautoput", a))
 	})
 
 	register("setecho", func(m *Machine) {
 		m.NeedStack(1, "setecho")
 		a := m.Pop()
-		m.Echo = int(a.Int)
+		m.Echo = int(intArg("setecho", a))
 	})
 
 	// GC trace toggle — no-op in this implementation, pops one arg
@@ -171,23 +181,23 @@ func init() {
 	register("setundeferror", func(m *Machine) {
 		m.NeedStack(1, "setundeferror")
 		a := m.Pop()
-		m.UndefError = int(a.Int)
+		m.UndefError = int(intArg("setundeferror", a))
 	})
 
 	register("help", func(m *Machine) {
-		fmt.Println("Joy interpreter — built-in operators:")
+		fmt.Fprintln(m.Stdout, "Joy interpreter — built-in operators:")
 		count := 0
-		for name := range builtins {
-			fmt.Printf("  %-16s", name)
+		for name := range m.Builtins {
+			fmt.Fprintf(m.Stdout, "  %-16s", name)
 			count++
 			if count%5 == 0 {
-				fmt.Println()
+				fmt.Fprintln(m.Stdout)
 			}
 		}
 		if count%5 != 0 {
-			fmt.Println()
+			fmt.Fprintln(m.Stdout)
 		}
-		fmt.Printf("\nTotal: %d built-in operators\n", count)
+		fmt.Fprintf(m.Stdout, "\nTotal: %d built-in operators\n", count)
 	})
 
 	register("helpdetail", func(m *Machine) {
@@ -195,12 +205,12 @@ func init() {
 		a := m.Pop()
 		if a.Typ == TypeList {
 			for _, item := range a.List {
-				if _, ok := builtins[item.Str]; ok {
-					fmt.Printf("%s : built-in\n", item.Str)
-				} else if _, ok := m.Dict[item.Str]; ok {
-					fmt.Printf("%s : user-defined\n", item.Str)
+				if _, ok := m.Builtins[item.Str]; ok {
+					fmt.Fprintf(m.Stdout, "%s : built-in\n", item.Str)
+				} else if _, ok := m.Lookup(item.Str); ok {
+					fmt.Fprintf(m.Stdout, "%s : user-defined\n", item.Str)
 				} else {
-					fmt.Printf("%s : unknown\n", item.Str)
+					fmt.Fprintf(m.Stdout, "%s : unknown\n", item.Str)
 				}
 			}
 		}
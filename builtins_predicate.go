@@ -1,4 +1,4 @@
-package main
+package joy
 
 func init() {
 	register("integer", func(m *Machine) {
@@ -7,6 +7,12 @@ func init() {
 		m.Push(BoolVal(a.Typ == TypeInteger))
 	})
 
+	register("rational", func(m *Machine) {
+		m.NeedStack(1, "rational")
+		a := m.Pop()
+		m.Push(BoolVal(a.Typ == TypeRational))
+	})
+
 	register("char", func(m *Machine) {
 		m.NeedStack(1, "char")
 		a := m.Pop()
@@ -43,6 +49,19 @@ func init() {
 		m.Push(BoolVal(a.Typ == TypeSet))
 	})
 
+	register("bytes", func(m *Machine) {
+		m.NeedStack(1, "bytes")
+		a := m.Pop()
+		m.Push(BoolVal(a.Typ == TypeBytes))
+	})
+
+	// dict: X -> B — whether X is a map; map is the combinator
+	register("dict", func(m *Machine) {
+		m.NeedStack(1, "dict")
+		a := m.Pop()
+		m.Push(BoolVal(a.Typ == TypeMap))
+	})
+
 	register("leaf", func(m *Machine) {
 		m.NeedStack(1, "leaf")
 		a := m.Pop()
@@ -69,9 +88,9 @@ func init() {
 			fBranch := m.Pop()
 			tBranch := m.Pop()
 			if m.Peek().Typ == typ {
-				m.Execute(tBranch.List)
+				m.call(tBranch.List, nil)
 			} else {
-				m.Execute(fBranch.List)
+				m.call(fBranch.List, nil)
 			}
 		})
 	}
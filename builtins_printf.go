@@ -0,0 +1,150 @@
+package joy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+func init() {
+	// sprintf: S L -> T — the values of L formatted by the format S
+	register("sprintf", func(m *Machine) {
+		m.NeedStack(2, "sprintf")
+		f, args := popFormat(m, "sprintf")
+		m.Push(StringVal(m.sprintf("sprintf", f, args)))
+	})
+
+	// printf: S L -> — write the values of L formatted by the format S
+	register("printf", func(m *Machine) {
+		m.NeedStack(2, "printf")
+		f, args := popFormat(m, "printf")
+		fmt.Fprint(m.Stdout, m.sprintf("printf", f, args))
+	})
+}
+
+func popFormat(m *Machine, name string) (string, []Value) {
+	l := m.Pop()
+	f := m.Pop()
+	if f.Typ != TypeString || l.Typ != TypeList {
+		joyErrKind(ErrType, "%s: format string and list expected", name)
+	}
+	return f.Str, l.List
+}
+
+// sprintf formats args by f, in which %% is a percent sign and each other
+// verb formats the next argument. A verb is written as for Go's fmt:
+// %[flags][width][.precision]verb, where the flags are - + # 0 and space
+// and the verbs are
+//
+//	d x X o b integer (x and X also take a string or byte string)
+//	f e g     real number
+//	s         string, char, symbol or byte string, without quotes
+//	c         char or integer, as the character with that code
+//	v         any value, as it prints
+func (m *Machine) sprintf(name, f string, args []Value) string {
+	var b strings.Builder
+	next := 0
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			b.WriteByte(f[i])
+			continue
+		}
+		start := i
+		i++
+		for i < len(f) && strings.IndexByte("-+# 0", f[i]) >= 0 {
+			i++
+		}
+		m.formatNumber(name, f, &i)
+		if i < len(f) && f[i] == '.' {
+			i++
+			m.formatNumber(name, f, &i)
+		}
+		if i == len(f) {
+			joyErr("%s: incomplete verb %q at end of format", name, f[start:])
+		}
+		verb, size := utf8.DecodeRuneInString(f[i:])
+		i += size - 1
+		spec := f[start : i+1]
+		if verb == '%' {
+			if spec != "%%" {
+				joyErr("%s: unknown verb %s", name, spec)
+			}
+			b.WriteByte('%')
+			continue
+		}
+		if next == len(args) {
+			joyErr("%s: missing argument for %s", name, spec)
+		}
+		b.WriteString(formatArg(name, spec, args[next]))
+		next++
+		m.checkString(name, b.Len())
+	}
+	if next < len(args) {
+		joyErr("%s: %d arguments but the format uses %d", name, len(args), next)
+	}
+	return b.String()
+}
+
+// formatNumber skips the width or precision at f[*i:].
+func (m *Machine) formatNumber(name, f string, i *int) {
+	start := *i
+	for *i < len(f) && f[*i] >= '0' && f[*i] <= '9' {
+		*i++
+	}
+	if *i == start {
+		return
+	}
+	n, err := strconv.Atoi(f[start:*i])
+	if err != nil || n > 1e6 {
+		joyErr("%s: width or precision %s too large", name, f[start:*i])
+	}
+	m.checkString(name, n)
+}
+
+// formatArg formats v by spec, a single verb.
+func formatArg(name, spec string, v Value) string {
+	verb, _ := utf8.DecodeLastRuneInString(spec)
+	mismatch := func(want string) {
+		joyErrKind(ErrType, "%s: %s expects %s, got %s", name, spec, want, v)
+	}
+	switch verb {
+	case 'd', 'x', 'X', 'o', 'b':
+		switch {
+		case v.Typ == TypeInteger && v.Big() != nil:
+			return fmt.Sprintf(spec, v.Big())
+		case v.Typ == TypeInteger || v.Typ == TypeChar:
+			return fmt.Sprintf(spec, v.Int)
+		case (verb == 'x' || verb == 'X') && v.Typ == TypeString:
+			return fmt.Sprintf(spec, v.Str)
+		case (verb == 'x' || verb == 'X') && v.Typ == TypeBytes:
+			return fmt.Sprintf(spec, v.Bytes())
+		}
+		mismatch("an integer")
+	case 'f', 'e', 'g':
+		switch v.Typ {
+		case TypeInteger, TypeChar, TypeFloat, TypeRational:
+			return fmt.Sprintf(spec, v.NumericVal())
+		}
+		mismatch("a real number")
+	case 's':
+		switch v.Typ {
+		case TypeString, TypeUserDef, TypeBuiltin:
+			return fmt.Sprintf(spec, v.Str)
+		case TypeChar:
+			return fmt.Sprintf(spec, string(rune(v.Int)))
+		case TypeBytes:
+			return fmt.Sprintf(spec, v.Bytes())
+		}
+		mismatch("a string")
+	case 'c':
+		if v.Typ == TypeChar || v.Typ == TypeInteger {
+			return fmt.Sprintf(spec, rune(v.Int))
+		}
+		mismatch("a char")
+	case 'v':
+		return fmt.Sprintf(spec[:len(spec)-1]+"s", v.String())
+	}
+	joyErr("%s: unknown verb %s", name, spec)
+	return ""
+}
@@ -1,4 +1,4 @@
-package main
+package joy
 
 import "math/rand"
 
@@ -1,8 +1,8 @@
-package main
+package joy
 
 func init() {
 	// tailrec: [P] [T] [R] tailrec
-	// Tail-recursive combinator. Go for-loop, no Go recursion.
+	// Tail-recursive combinator: each round is a continuation of the last.
 	// Save stack, test P, restore. If truthy → T, done. If falsy → R, loop.
 	register("tailrec", func(m *Machine) {
 		m.NeedStack(3, "tailrec")
@@ -10,20 +10,9 @@ func init() {
 		t := m.Pop()
 		p := m.Pop()
 		if p.Typ != TypeList || t.Typ != TypeList || r.Typ != TypeList {
-			joyErr("tailrec: three quotations expected")
-		}
-		for {
-			saved := make([]Value, len(m.Stack))
-			copy(saved, m.Stack)
-			m.Execute(p.List)
-			cond := m.Pop()
-			m.Stack = saved
-			if cond.IsTruthy() {
-				m.Execute(t.List)
-				return
-			}
-			m.Execute(r.List)
+			joyErrKind(ErrType, "tailrec: three quotations expected")
 		}
+		tailrec(m, p.List, t.List, r.List)
 	})
 
 	// linrec: [P] [T] [R1] [R2] linrec
@@ -35,9 +24,9 @@ func init() {
 		t := m.Pop()
 		p := m.Pop()
 		if p.Typ != TypeList || t.Typ != TypeList || r1.Typ != TypeList || r2.Typ != TypeList {
-			joyErr("linrec: four quotations expected")
+			joyErrKind(ErrType, "linrec: four quotations expected")
 		}
-		linrecAux(m, p.List, t.List, r1.List, r2.List)
+		linrec(m, p.List, t.List, r1.List, r2.List)
 	})
 
 	// binrec: [P] [T] [R1] [R2] binrec
@@ -49,9 +38,9 @@ func init() {
 		t := m.Pop()
 		p := m.Pop()
 		if p.Typ != TypeList || t.Typ != TypeList || r1.Typ != TypeList || r2.Typ != TypeList {
-			joyErr("binrec: four quotations expected")
+			joyErrKind(ErrType, "binrec: four quotations expected")
 		}
-		binrecAux(m, p.List, t.List, r1.List, r2.List)
+		binrec(m, p.List, t.List, r1.List, r2.List)
 	})
 
 	// genrec: [P] [T] [R1] [R2] genrec
@@ -64,24 +53,22 @@ func init() {
 		t := m.Pop()
 		p := m.Pop()
 		if p.Typ != TypeList || t.Typ != TypeList || r1.Typ != TypeList || r2.Typ != TypeList {
-			joyErr("genrec: four quotations expected")
-		}
-		saved := make([]Value, len(m.Stack))
-		copy(saved, m.Stack)
-		m.Execute(p.List)
-		cond := m.Pop()
-		m.Stack = saved
-		if cond.IsTruthy() {
-			m.Execute(t.List)
-		} else {
-			m.Execute(r1.List)
-			// Push [P T R1 R2 genrec] quotation
-			selfQuot := make([]Value, 0, 5)
-			selfQuot = append(selfQuot, p, t, r1, r2)
-			selfQuot = append(selfQuot, BuiltinVal("genrec", genrecFn))
-			m.Push(ListVal(selfQuot))
-			m.Execute(r2.List)
+			joyErrKind(ErrType, "genrec: four quotations expected")
 		}
+		m.test(p.List, func(m *Machine, ok bool) {
+			if ok {
+				m.call(t.List, nil)
+				return
+			}
+			m.call(r1.List, func(m *Machine) {
+				// Push [P T R1 R2 genrec] quotation
+				selfQuot := make([]Value, 0, 5)
+				selfQuot = append(selfQuot, p, t, r1, r2)
+				selfQuot = append(selfQuot, BuiltinVal("genrec", genrecFn))
+				m.Push(ListVal(selfQuot))
+				m.call(r2.List, nil)
+			})
+		})
 	}
 	register("genrec", genrecFn)
 
@@ -91,9 +78,9 @@ func init() {
 		m.NeedStack(1, "condlinrec")
 		clauses := m.Pop()
 		if clauses.Typ != TypeList {
-			joyErr("condlinrec: list of clauses expected")
+			joyErrKind(ErrType, "condlinrec: list of clauses expected")
 		}
-		condlinrecAux(m, clauses.List)
+		condlinrec(m, clauses.List, 0)
 	})
 
 	// primrec: X [I] [C] primrec — primitive recursion
@@ -104,57 +91,32 @@ func init() {
 		i := m.Pop()
 		x := m.Pop()
 		if i.Typ != TypeList || c.Typ != TypeList {
-			joyErr("primrec: two quotations expected")
+			joyErrKind(ErrType, "primrec: two quotations expected")
 		}
+		var n int64
 		switch x.Typ {
 		case TypeInteger:
 			// Push x, x-1, ..., 1
-			n := x.Int
+			n = intArg("primrec", x)
 			if n < 0 {
-				joyErr("primrec: non-negative integer expected")
+				joyErrKind(ErrType, "primrec: non-negative integer expected")
 			}
 			for k := n; k >= 1; k-- {
 				m.Push(IntVal(k))
 			}
-			m.Execute(i.List)
-			for k := int64(0); k < n; k++ {
-				m.Execute(c.List)
-			}
-		case TypeList:
+		case TypeList, TypeString, TypeSet:
 			// Push each element (first deepest, last on top)
-			for _, item := range x.List {
+			items := members(x, "primrec")
+			for _, item := range items {
 				m.Push(item)
 			}
-			m.Execute(i.List)
-			for range x.List {
-				m.Execute(c.List)
-			}
-		case TypeString:
-			runes := []rune(x.Str)
-			for _, r := range runes {
-				m.Push(CharVal(int64(r)))
-			}
-			m.Execute(i.List)
-			for range runes {
-				m.Execute(c.List)
-			}
-		case TypeSet:
-			var members []int
-			for bit := 0; bit < SetSize; bit++ {
-				if x.Int&(1<<bit) != 0 {
-					members = append(members, bit)
-				}
-			}
-			for _, mb := range members {
-				m.Push(IntVal(int64(mb)))
-			}
-			m.Execute(i.List)
-			for range members {
-				m.Execute(c.List)
-			}
+			n = int64(len(items))
 		default:
-			joyErr("primrec: aggregate or integer expected")
+			joyErrKind(ErrType, "primrec: aggregate or integer expected")
 		}
+		m.call(i.List, func(m *Machine) {
+			m.repeat(c.List, n)
+		})
 	})
 
 	// condnestrec: [[C1 R1 R2 ...] [C2 ...] ... [D ...]] condnestrec
@@ -163,140 +125,170 @@ func init() {
 		m.NeedStack(1, "condnestrec")
 		clauses := m.Pop()
 		if clauses.Typ != TypeList {
-			joyErr("condnestrec: list of clauses expected")
+			joyErrKind(ErrType, "condnestrec: list of clauses expected")
 		}
-		condnestrecAux(m, clauses.List)
+		condnestrec(m, clauses.List, 0)
 	})
 }
 
-func linrecAux(m *Machine, p, t, r1, r2 []Value) {
-	saved := make([]Value, len(m.Stack))
-	copy(saved, m.Stack)
-	m.Execute(p)
-	cond := m.Pop()
-	m.Stack = saved
-	if cond.IsTruthy() {
-		m.Execute(t)
-	} else {
-		m.Execute(r1)
-		linrecAux(m, p, t, r1, r2)
-		m.Execute(r2)
+// linrec and binrec build their continuations once and share them
+// between the levels of the recursion, so that a level allocates nothing.
+// Like test, each level runs P under keep, leaving its result on top for
+// the continuation.
+
+func tailrec(m *Machine, p, t, r []Value) {
+	var loop, branch func(m *Machine)
+	loop = func(m *Machine) {
+		m.then(branch)
+		m.keep(p, 0)
+	}
+	branch = func(m *Machine) {
+		if m.Pop().IsTruthy() {
+			m.call(t, nil)
+			return
+		}
+		m.call(r, loop)
 	}
+	loop(m)
 }
 
-func binrecAux(m *Machine, p, t, r1, r2 []Value) {
-	saved := make([]Value, len(m.Stack))
-	copy(saved, m.Stack)
-	m.Execute(p)
-	cond := m.Pop()
-	m.Stack = saved
-	if cond.IsTruthy() {
-		m.Execute(t)
-	} else {
-		m.Execute(r1)
-		second := m.Pop()
-		binrecAux(m, p, t, r1, r2)
-		m.Push(second)
-		binrecAux(m, p, t, r1, r2)
-		m.Execute(r2)
+func linrec(m *Machine, p, t, r1, r2 []Value) {
+	var rec, branch func(m *Machine)
+	rec = func(m *Machine) {
+		m.then(branch)
+		m.keep(p, 0)
 	}
+	branch = func(m *Machine) {
+		if m.Pop().IsTruthy() {
+			m.call(t, nil)
+			return
+		}
+		m.call(r2, nil)
+		m.call(r1, rec)
+	}
+	rec(m)
 }
 
-func condlinrecAux(m *Machine, clauses []Value) {
-	for i, clause := range clauses {
-		if clause.Typ != TypeList || len(clause.List) == 0 {
-			joyErr("condlinrec: each clause must be a non-empty list")
+func binrec(m *Machine, p, t, r1, r2 []Value) {
+	var rec, branch, both func(m *Machine)
+	rec = func(m *Machine) {
+		m.then(branch)
+		m.keep(p, 0)
+	}
+	branch = func(m *Machine) {
+		if m.Pop().IsTruthy() {
+			m.call(t, nil)
+			return
 		}
-		isLast := i == len(clauses)-1
+		m.call(r1, both)
+	}
+	both = func(m *Machine) {
+		// Recurse on the top value, then on the one under it, which is
+		// held meanwhile, then combine them
+		second := m.Pop()
+		m.call(r2, nil)
+		m.then(rec)
+		m.hold(second)
+		rec(m)
+	}
+	rec(m)
+}
 
-		if !isLast {
-			// Non-default clause: [Condition Body PostBody?]
-			cond := clause.List[0]
-			if cond.Typ != TypeList {
-				joyErr("condlinrec: condition must be a quotation")
-			}
-			saved := make([]Value, len(m.Stack))
-			copy(saved, m.Stack)
-			m.Execute(cond.List)
-			result := m.Pop()
-			m.Stack = saved
-			if result.IsTruthy() {
-				if len(clause.List) > 1 {
-					body := clause.List[1]
-					if body.Typ == TypeList {
-						m.Execute(body.List)
-					}
-				}
-				if len(clause.List) > 2 {
-					post := clause.List[2]
-					if post.Typ == TypeList && len(post.List) > 0 {
-						condlinrecAux(m, clauses)
-						m.Execute(post.List)
-					}
-				}
+// condlinrec tries the clauses from the i-th on. A clause's body runs,
+// then, if it has one, the recursion and its post part.
+func condlinrec(m *Machine, clauses []Value, i int) {
+	if i == len(clauses) {
+		return
+	}
+	clause := clauses[i]
+	if clause.Typ != TypeList || len(clause.List) == 0 {
+		joyErrKind(ErrType, "condlinrec: each clause must be a non-empty list")
+	}
+	recurse := func(m *Machine) {
+		condlinrec(m, clauses, 0)
+	}
+	if i < len(clauses)-1 {
+		// Non-default clause: [Condition Body PostBody?]
+		cond := clause.List[0]
+		if cond.Typ != TypeList {
+			joyErrKind(ErrType, "condlinrec: condition must be a quotation")
+		}
+		m.test(cond.List, func(m *Machine, ok bool) {
+			if !ok {
+				condlinrec(m, clauses, i+1)
 				return
 			}
-		} else {
-			// Default clause: [Body PostBody?]
-			if len(clause.List) > 0 {
-				body := clause.List[0]
-				if body.Typ == TypeList {
-					m.Execute(body.List)
+			if len(clause.List) > 2 {
+				post := clause.List[2]
+				if post.Typ == TypeList && len(post.List) > 0 {
+					m.call(post.List, nil)
+					m.then(recurse)
 				}
 			}
 			if len(clause.List) > 1 {
-				post := clause.List[1]
-				if post.Typ == TypeList {
-					condlinrecAux(m, clauses)
-					m.Execute(post.List)
+				body := clause.List[1]
+				if body.Typ == TypeList {
+					m.call(body.List, nil)
 				}
 			}
-			return
+		})
+		return
+	}
+	// Default clause: [Body PostBody?]
+	if len(clause.List) > 1 {
+		post := clause.List[1]
+		if post.Typ == TypeList {
+			m.call(post.List, nil)
+			m.then(recurse)
 		}
 	}
+	body := clause.List[0]
+	if body.Typ == TypeList {
+		m.call(body.List, nil)
+	}
 }
 
-func condnestrecAux(m *Machine, clauses []Value) {
-	for i, clause := range clauses {
-		if clause.Typ != TypeList || len(clause.List) == 0 {
-			joyErr("condnestrec: each clause must be a non-empty list")
+// condnestrec tries the clauses from the i-th on. The parts of the chosen
+// clause run with a recursive call between each pair.
+func condnestrec(m *Machine, clauses []Value, i int) {
+	if i == len(clauses) {
+		return
+	}
+	clause := clauses[i]
+	if clause.Typ != TypeList || len(clause.List) == 0 {
+		joyErrKind(ErrType, "condnestrec: each clause must be a non-empty list")
+	}
+	if i < len(clauses)-1 {
+		// Non-default clause: [Condition R1 R2 R3 ...]
+		cond := clause.List[0]
+		if cond.Typ != TypeList {
+			joyErrKind(ErrType, "condnestrec: condition must be a quotation")
 		}
-		isLast := i == len(clauses)-1
-
-		if !isLast {
-			// Non-default clause: [Condition R1 R2 R3 ...]
-			cond := clause.List[0]
-			if cond.Typ != TypeList {
-				joyErr("condnestrec: condition must be a quotation")
+		m.test(cond.List, func(m *Machine, ok bool) {
+			if ok {
+				executeNested(m, clauses, clause.List[1:])
+			} else {
+				condnestrec(m, clauses, i+1)
 			}
-			saved := make([]Value, len(m.Stack))
-			copy(saved, m.Stack)
-			m.Execute(cond.List)
-			result := m.Pop()
-			m.Stack = saved
-			if result.IsTruthy() {
-				parts := clause.List[1:]
-				executeNested(m, clauses, parts)
-				return
-			}
-		} else {
-			// Default clause: [R1 R2 R3 ...]
-			parts := clause.List
-			executeNested(m, clauses, parts)
-			return
-		}
+		})
+		return
 	}
+	// Default clause: [R1 R2 R3 ...]
+	executeNested(m, clauses, clause.List)
 }
 
 // executeNested runs parts with recursive calls between each pair.
 // [r1 r2 r3] → execute r1, recurse, r2, recurse, r3
+// Frames run last-scheduled first, so the parts are scheduled backwards.
 func executeNested(m *Machine, clauses []Value, parts []Value) {
-	for i, part := range parts {
-		if part.Typ == TypeList {
-			m.Execute(part.List)
-		}
+	for i := len(parts) - 1; i >= 0; i-- {
 		if i < len(parts)-1 {
-			condnestrecAux(m, clauses)
+			m.then(func(m *Machine) {
+				condnestrec(m, clauses, 0)
+			})
+		}
+		if part := parts[i]; part.Typ == TypeList {
+			m.call(part.List, nil)
 		}
 	}
 }
@@ -0,0 +1,120 @@
+package joy
+
+import "regexp"
+
+// maxRegexps bounds the patterns a machine keeps compiled.
+const maxRegexps = 256
+
+func init() {
+	// rematch: S P -> B — whether S contains a match of pattern P
+	register("rematch", func(m *Machine) {
+		m.NeedStack(2, "rematch")
+		re, s := m.popRegexp("rematch")
+		m.Push(BoolVal(re.MatchString(s)))
+	})
+
+	// refind: S P -> T — the leftmost match of P in S, "" if there is none
+	register("refind", func(m *Machine) {
+		m.NeedStack(2, "refind")
+		re, s := m.popRegexp("refind")
+		m.Push(StringVal(re.FindString(s)))
+	})
+
+	// refindall: S P -> L — the successive matches of P in S
+	register("refindall", func(m *Machine) {
+		m.NeedStack(2, "refindall")
+		re, s := m.popRegexp("refindall")
+		parts := re.FindAllString(s, m.matchLimit())
+		m.checkList("refindall", len(parts))
+		m.Push(stringList(parts))
+	})
+
+	// resubmatch: S P -> L — the leftmost match of P in S followed by its
+	// capture groups, [] if there is none; groups that did not take part
+	// in the match are ""
+	register("resubmatch", func(m *Machine) {
+		m.NeedStack(2, "resubmatch")
+		re, s := m.popRegexp("resubmatch")
+		parts := re.FindStringSubmatch(s)
+		m.checkList("resubmatch", len(parts))
+		m.Push(stringList(parts))
+	})
+
+	// rereplace: S P R -> T — S with each match of P replaced by R, in
+	// which $1 or ${name} stands for a capture group
+	register("rereplace", func(m *Machine) {
+		m.NeedStack(3, "rereplace")
+		r := m.Pop()
+		if r.Typ != TypeString {
+			joyErrKind(ErrType, "rereplace: replacement string expected")
+		}
+		re, s := m.popRegexp("rereplace")
+		// As ReplaceAllString, but checking the quota as the result grows
+		var t []byte
+		last := 0
+		for _, loc := range re.FindAllStringSubmatchIndex(s, -1) {
+			t = append(t, s[last:loc[0]]...)
+			t = re.ExpandString(t, r.Str, s, loc)
+			m.checkString("rereplace", len(t))
+			last = loc[1]
+		}
+		t = append(t, s[last:]...)
+		m.checkString("rereplace", len(t))
+		m.Push(StringVal(string(t)))
+	})
+
+	// resplit: S P -> L — the substrings of S between matches of P
+	register("resplit", func(m *Machine) {
+		m.NeedStack(2, "resplit")
+		re, s := m.popRegexp("resplit")
+		parts := re.Split(s, m.matchLimit())
+		m.checkList("resplit", len(parts))
+		m.Push(stringList(parts))
+	})
+}
+
+// popRegexp pops a pattern and the string below it, returning the
+// compiled pattern.
+func (m *Machine) popRegexp(name string) (*regexp.Regexp, string) {
+	p := m.Pop()
+	s := m.Pop()
+	if s.Typ != TypeString || p.Typ != TypeString {
+		joyErrKind(ErrType, "%s: string and pattern expected", name)
+	}
+	return m.regexp(name, p.Str), s.Str
+}
+
+// regexp returns the compiled pattern, from the machine's cache if it
+// was compiled before.
+func (m *Machine) regexp(name, pattern string) *regexp.Regexp {
+	if re, ok := m.regexps[pattern]; ok {
+		return re
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		joyErr("%s: %v", name, err)
+	}
+	if m.regexps == nil || len(m.regexps) >= maxRegexps {
+		m.regexps = make(map[string]*regexp.Regexp)
+	}
+	m.regexps[pattern] = re
+	return re
+}
+
+// matchLimit returns the n to pass to FindAllString or Split: with
+// MaxListLen set, one result more than it allows, enough for checkList to
+// fail without collecting every match; otherwise all of them.
+func (m *Machine) matchLimit() int {
+	if m.MaxListLen > 0 {
+		return m.MaxListLen + 1
+	}
+	return -1
+}
+
+func stringList(ss []string) Value {
+	items := make([]Value, len(ss))
+	for i, s := range ss {
+		items[i] = StringVal(s)
+	}
+	return ListVal(items)
+}
@@ -1,4 +1,4 @@
-package main
+package joy
 
 func init() {
 	register("pop", func(m *Machine) {
@@ -43,11 +43,13 @@ func init() {
 	})
 
 	register("newstack", func(m *Machine) {
+		m.modify(0)
 		m.Stack = nil
 	})
 
 	register("stack", func(m *Machine) {
 		// Push a list of the current stack (top on front)
+		m.checkList("stack", len(m.Stack))
 		items := make([]Value, len(m.Stack))
 		for i, v := range m.Stack {
 			items[len(m.Stack)-1-i] = v
@@ -59,8 +61,9 @@ func init() {
 		m.NeedStack(1, "unstack")
 		top := m.Pop()
 		if top.Typ != TypeList {
-			joyErr("unstack: list expected")
+			joyErrKind(ErrType, "unstack: list expected")
 		}
+		m.modify(0)
 		m.Stack = nil
 		// list is top-first, push in reverse so first element ends on top
 		for i := len(top.List) - 1; i >= 0; i-- {
@@ -0,0 +1,171 @@
+package joy
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// String operations count in runes, like the aggregate builtins.
+
+func init() {
+	// strsplit: S T -> L — the substrings of S separated by T; the chars
+	// of S as strings if T is ""
+	register("strsplit", func(m *Machine) {
+		m.NeedStack(2, "strsplit")
+		s, t := popStrings2(m, "strsplit")
+		parts := strings.Split(s, t)
+		m.checkList("strsplit", len(parts))
+		m.Push(stringList(parts))
+	})
+
+	// strjoin: L S -> T — the strings of L with S between them
+	register("strjoin", func(m *Machine) {
+		m.NeedStack(2, "strjoin")
+		sep := m.Pop()
+		l := m.Pop()
+		if l.Typ != TypeList || sep.Typ != TypeString {
+			joyErrKind(ErrType, "strjoin: list and string expected")
+		}
+		parts := make([]string, len(l.List))
+		n := len(sep.Str) * max(len(parts)-1, 0)
+		for i, v := range l.List {
+			if v.Typ != TypeString {
+				joyErrKind(ErrType, "strjoin: list of strings expected")
+			}
+			parts[i] = v.Str
+			n += len(v.Str)
+		}
+		m.checkString("strjoin", n)
+		m.Push(StringVal(strings.Join(parts, sep.Str)))
+	})
+
+	// strtrim: S -> T — S without leading and trailing white space
+	register("strtrim", func(m *Machine) {
+		m.NeedStack(1, "strtrim")
+		s := popString(m, "strtrim")
+		m.Push(StringVal(strings.TrimSpace(s)))
+	})
+
+	// strupper: S -> T — S in upper case
+	register("strupper", func(m *Machine) {
+		m.NeedStack(1, "strupper")
+		t := strings.ToUpper(popString(m, "strupper"))
+		m.checkString("strupper", len(t))
+		m.Push(StringVal(t))
+	})
+
+	// strlower: S -> T — S in lower case
+	register("strlower", func(m *Machine) {
+		m.NeedStack(1, "strlower")
+		t := strings.ToLower(popString(m, "strlower"))
+		m.checkString("strlower", len(t))
+		m.Push(StringVal(t))
+	})
+
+	// strindex: S T -> I — the index of the first T in S, -1 if none
+	register("strindex", func(m *Machine) {
+		m.NeedStack(2, "strindex")
+		s, t := popStrings2(m, "strindex")
+		i := strings.Index(s, t)
+		if i > 0 {
+			i = utf8.RuneCountInString(s[:i])
+		}
+		m.Push(IntVal(int64(i)))
+	})
+
+	// strreplace: S T U -> V — S with each T replaced by U
+	register("strreplace", func(m *Machine) {
+		m.NeedStack(3, "strreplace")
+		u := popString(m, "strreplace")
+		s, t := popStrings2(m, "strreplace")
+		if n := strings.Count(s, t); n > 0 {
+			m.checkString("strreplace", len(s)+n*(len(u)-len(t)))
+		}
+		m.Push(StringVal(strings.ReplaceAll(s, t, u)))
+	})
+
+	// startswith: S T -> B — whether S begins with T
+	register("startswith", func(m *Machine) {
+		m.NeedStack(2, "startswith")
+		s, t := popStrings2(m, "startswith")
+		m.Push(BoolVal(strings.HasPrefix(s, t)))
+	})
+
+	// endswith: S T -> B — whether S ends with T
+	register("endswith", func(m *Machine) {
+		m.NeedStack(2, "endswith")
+		s, t := popStrings2(m, "endswith")
+		m.Push(BoolVal(strings.HasSuffix(s, t)))
+	})
+
+	// strrepeat: S I -> T — I copies of S
+	register("strrepeat", func(m *Machine) {
+		m.NeedStack(2, "strrepeat")
+		n := m.Pop()
+		s := popString(m, "strrepeat")
+		if n.Typ != TypeInteger || intArg("strrepeat", n) < 0 {
+			joyErrKind(ErrType, "strrepeat: non-negative integer expected")
+		}
+		if s != "" {
+			m.checkString("strrepeat", strLen("strrepeat", int64(len(s)), n.Int))
+		}
+		m.Push(StringVal(strings.Repeat(s, int(n.Int))))
+	})
+
+	// strpad: S I C -> T — S padded with C to I chars: on the left if I
+	// is positive, on the right if it is negative
+	register("strpad", func(m *Machine) {
+		m.NeedStack(3, "strpad")
+		c := m.Pop()
+		width := m.Pop()
+		s := popString(m, "strpad")
+		if width.Typ != TypeInteger || c.Typ != TypeChar {
+			joyErrKind(ErrType, "strpad: integer and char expected")
+		}
+		w := intArg("strpad", width)
+		left := w > 0
+		if w < 0 {
+			w = -w
+		}
+		pad := w - int64(m.runeLen(s))
+		if pad <= 0 {
+			m.Push(StringVal(s))
+			return
+		}
+		fill := string(rune(c.Int))
+		m.checkString("strpad", len(s)+strLen("strpad", int64(len(fill)), pad))
+		if left {
+			m.Push(StringVal(strings.Repeat(fill, int(pad)) + s))
+		} else {
+			m.Push(StringVal(s + strings.Repeat(fill, int(pad))))
+		}
+	})
+}
+
+// strLen returns the length of n copies of a string of size bytes,
+// raising an error if that is too long to build whatever the quotas.
+func strLen(name string, size, n int64) int {
+	if n > math.MaxInt32/size {
+		joyErr("%s: result too long", name)
+	}
+	return int(size * n)
+}
+
+func popString(m *Machine, name string) string {
+	a := m.Pop()
+	if a.Typ != TypeString {
+		joyErrKind(ErrType, "%s: string expected", name)
+	}
+	return a.Str
+}
+
+// popStrings2 pops two strings, returning them in stack order.
+func popStrings2(m *Machine, name string) (string, string) {
+	t := m.Pop()
+	s := m.Pop()
+	if s.Typ != TypeString || t.Typ != TypeString {
+		joyErrKind(ErrType, "%s: two strings expected", name)
+	}
+	return s.Str, t.Str
+}
@@ -1,4 +1,4 @@
-package main
+package joy
 
 import "os"
 
@@ -6,22 +6,32 @@ func init() {
 	// getenv: S -> S2 — get environment variable
 	register("getenv", func(m *Machine) {
 		m.NeedStack(1, "getenv")
+		m.require(CapEnv, "getenv")
 		a := m.Pop()
 		if a.Typ != TypeString {
-			joyErr("getenv: string expected")
+			joyErrKind(ErrType, "getenv: string expected")
 		}
 		m.Push(StringVal(os.Getenv(a.Str)))
 	})
 
+	// conts: -> [[P] [Q] ..] — push what is left to do, innermost first:
+	// the rest of each program being executed
+	register("conts", func(m *Machine) {
+		m.Push(ListVal(m.conts()))
+	})
+
 	// undefs: -> L — list undefined references in user definitions
 	register("undefs", func(m *Machine) {
 		seen := map[string]bool{}
 		var undefs []Value
-		for _, body := range m.Dict {
-			for _, v := range body {
+		for _, d := range m.defs {
+			if !d.Defined {
+				continue
+			}
+			for _, v := range d.Body {
 				if v.Typ == TypeUserDef {
-					if _, inDict := m.Dict[v.Str]; !inDict {
-						if _, inBuiltins := builtins[v.Str]; !inBuiltins {
+					if _, inDict := m.Lookup(v.Str); !inDict {
+						if _, inBuiltins := m.Builtins[v.Str]; !inBuiltins {
 							if !seen[v.Str] {
 								seen[v.Str] = true
 								undefs = append(undefs, StringVal(v.Str))
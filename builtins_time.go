@@ -1,4 +1,4 @@
-package main
+package joy
 
 import (
 	"fmt"
@@ -29,7 +29,7 @@ func init() {
 		m.NeedStack(1, "mktime")
 		a := m.Pop()
 		if a.Typ != TypeList || len(a.List) < 6 {
-			joyErr("mktime: time list with at least 6 elements expected")
+			joyErrKind(ErrType, "mktime: time list with at least 6 elements expected")
 		}
 		year := int(a.List[0].Int)
 		month := time.Month(a.List[1].Int)
@@ -47,10 +47,10 @@ func init() {
 		fmtStr := m.Pop()
 		tList := m.Pop()
 		if fmtStr.Typ != TypeString {
-			joyErr("strftime: format string expected")
+			joyErrKind(ErrType, "strftime: format string expected")
 		}
 		if tList.Typ != TypeList || len(tList.List) < 6 {
-			joyErr("strftime: time list expected")
+			joyErrKind(ErrType, "strftime: time list expected")
 		}
 		year := int(tList.List[0].Int)
 		month := time.Month(tList.List[1].Int)
@@ -0,0 +1,30 @@
+package joy
+
+import "errors"
+
+// Capabilities is the set of host facilities a Machine may use. A builtin
+// whose capability is missing fails with an ErrPermission error instead of
+// acting.
+type Capabilities uint
+
+const (
+	CapFile    Capabilities = 1 << iota // fopen, fremove, frename
+	CapEnv                              // getenv
+	CapProcess                          // argc, argv
+	CapInclude                          // include/RunFile from anywhere, not just IncludeDirs and the embedded libs
+
+	CapAll     = CapFile | CapEnv | CapProcess | CapInclude
+	CapSandbox = Capabilities(0) // nothing beyond the machine's own streams
+)
+
+// errPermission is wrapped by ReadFile when a path is outside what the
+// machine's capabilities allow.
+var errPermission = errors.New("permission denied")
+
+// require raises an ErrPermission error from builtin name unless the
+// machine has every capability in c.
+func (m *Machine) require(c Capabilities, name string) {
+	if m.Capabilities&c != c {
+		joyErrKind(ErrPermission, "%s: permission denied", name)
+	}
+}
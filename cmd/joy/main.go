@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/chzyer/readline"
+	"github.com/primal-host/joy"
+)
+
+func main() {
+	m := joy.NewMachine()
+
+	// Set up library paths
+	// 1. Exe-relative lib/ directory
+	if exe, err := os.Executable(); err == nil {
+		m.LibPaths = append(m.LibPaths, filepath.Join(filepath.Dir(exe), "lib"))
+	}
+	// 2. JOYLIB env var (colon-separated)
+	if joylib := os.Getenv("JOYLIB"); joylib != "" {
+		for _, p := range strings.Split(joylib, ":") {
+			if p != "" {
+				m.LibPaths = append(m.LibPaths, p)
+			}
+		}
+	}
+
+	// Parse flags
+	noStdlib := false
+	sandbox := false
+	var files []string
+	for _, arg := range os.Args[1:] {
+		switch arg {
+		case "--no-stdlib":
+			noStdlib = true
+		case "--sandbox":
+			sandbox = true
+		default:
+			files = append(files, arg)
+		}
+	}
+	if sandbox {
+		// Programs may only include the embedded libraries
+		m.Capabilities = joy.CapSandbox
+	}
+
+	// Auto-load standard library
+	if !noStdlib {
+		if err := m.RunFile("inilib.joy"); err != nil {
+			// Not fatal — inilib may not exist in all environments
+			_ = err
+		}
+	}
+
+	if len(files) > 0 {
+		// File execution mode
+		for _, path := range files {
+			if err := runFile(m, path, sandbox); err != nil {
+				exitOnQuit(err)
+				reportError(m, err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	// REPL mode
+	fmt.Fprintln(m.Stdout, "Joy interpreter (Go) — type 'quit' to exit")
+
+	if readline.IsTerminal(int(os.Stdin.Fd())) {
+		replReadline(m)
+	} else {
+		replPipe(m)
+	}
+}
+
+func replReadline(m *joy.Machine) {
+	homeDir, _ := os.UserHomeDir()
+	histFile := filepath.Join(homeDir, ".joy_history")
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:            "joy> ",
+		HistoryFile:       histFile,
+		HistorySearchFold: true,
+	})
+	if err != nil {
+		replPipe(m)
+		return
+	}
+	defer rl.Close()
+
+	for {
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			continue // Ctrl-C at the prompt discards the line
+		}
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if m.Echo > 0 {
+			fmt.Fprintln(m.Stdout, line)
+		}
+		if err := runInterruptible(m, line); err != nil {
+			exitOnQuit(err)
+			reportError(m, err)
+		} else if m.Autoput == 1 && len(m.Stack) > 0 {
+			fmt.Fprintln(m.Stdout, m.Stack[len(m.Stack)-1].String())
+		} else if m.Autoput == 2 && len(m.Stack) > 0 {
+			fmt.Fprintln(m.Stdout, m.PrintStack())
+		}
+	}
+	fmt.Fprintln(m.Stdout)
+}
+
+func replPipe(m *joy.Machine) {
+	for {
+		fmt.Fprint(m.Stdout, "joy> ")
+		line, err := m.ReadLine()
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if m.Echo > 0 {
+			fmt.Fprintln(m.Stdout, line)
+		}
+		if err := runInterruptible(m, line); err != nil {
+			exitOnQuit(err)
+			reportError(m, err)
+		} else if m.Autoput == 1 && len(m.Stack) > 0 {
+			fmt.Fprintln(m.Stdout, m.Stack[len(m.Stack)-1].String())
+		} else if m.Autoput == 2 && len(m.Stack) > 0 {
+			fmt.Fprintln(m.Stdout, m.PrintStack())
+		}
+	}
+	fmt.Fprintln(m.Stdout)
+}
+
+// runFile runs a script named on the command line. In sandbox mode the
+// machine cannot read host files itself, so the script is read here.
+func runFile(m *joy.Machine, path string, sandbox bool) error {
+	if !sandbox {
+		return m.RunFile(path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return m.RunSourceFile(path, string(data))
+}
+
+// exitOnQuit ends the process when the program ran quit.
+func exitOnQuit(err error) {
+	if je, ok := err.(joy.JoyError); ok && je.Kind == joy.ErrQuit {
+		os.Exit(0)
+	}
+}
+
+// runInterruptible runs one line of input with Ctrl-C cancelling the
+// computation instead of terminating the process.
+func runInterruptible(m *joy.Machine, line string) error {
+	program, err := m.Parse(line)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return m.RunContext(ctx, program)
+}
+
+func reportError(m *joy.Machine, err error) {
+	je, ok := err.(joy.JoyError)
+	if ok && je.File == "" && je.Line <= 1 && je.Col > 0 {
+		// a single line typed at the REPL
+		fmt.Fprintf(m.Stderr, "error at col %d: %s\n", je.Col, je.Msg)
+	} else if ok && je.Line > 0 {
+		fmt.Fprintf(m.Stderr, "error at %s: %s\n", je.Pos(), je.Msg)
+	} else {
+		fmt.Fprintf(m.Stderr, "error: %v\n", err)
+	}
+	if ok && len(je.Trace) > 0 {
+		fmt.Fprintf(m.Stderr, "  %s\n", je.Traceback())
+	}
+}
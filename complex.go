@@ -0,0 +1,30 @@
+package joy
+
+import "strconv"
+
+// Complex numbers keep their value as a complex128 in Value.ref.
+// Arithmetic with a complex operand is complex; other numbers take part
+// as complex numbers with no imaginary part.
+
+func ComplexVal(c complex128) Value {
+	return Value{Typ: TypeComplex, ref: c}
+}
+
+// complex returns v, a complex or real number, as a complex128.
+func (v Value) complex() complex128 {
+	if v.Typ == TypeComplex {
+		return v.ref.(complex128)
+	}
+	return complex(v.NumericVal(), 0)
+}
+
+// formatComplex writes c as the literal the scanner reads back exactly,
+// such as 1.5-2i.
+func formatComplex(c complex128) string {
+	re := strconv.FormatFloat(real(c), 'g', -1, 64)
+	im := strconv.FormatFloat(imag(c), 'g', -1, 64)
+	if im[0] != '-' && im[0] != '+' {
+		im = "+" + im
+	}
+	return re + im + "i"
+}
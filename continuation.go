@@ -0,0 +1,104 @@
+package joy
+
+import "slices"
+
+// A continuation is what is left to do at some point of a run: the
+// frames of the continuation stack above the innermost exec, with the
+// stack marks, held values and trace frames they refer to. callcc
+// captures one and wraps it in a quotation; running the quotation
+// replaces the frames of the running exec with a copy of the captured
+// ones, so a continuation may be resumed any number of times. The data
+// stack is not part of a continuation: it is passed along as it is when
+// the continuation is resumed.
+type continuation struct {
+	at     execLevel // where the captured frames started
+	frames []frame
+	marks  [][]Value // for each mark, the stack it rewinds to, topmost first
+	held   []Value
+	trace  []Frame
+}
+
+// capture returns the continuation of the running builtin.
+func (m *Machine) capture() *continuation {
+	lv := m.level
+	k := &continuation{
+		at:     lv,
+		frames: slices.Clone(m.vframes[lv.vframes:]),
+		held:   slices.Clone(m.held[lv.held:]),
+		trace:  slices.Clone(m.frames[lv.frames:]),
+	}
+	for i := lv.marks; i < len(m.marks); i++ {
+		mk := &m.marks[i]
+		img := slices.Clone(mk.undo)
+		for j := mk.floor - 1; j >= 0; j-- {
+			img = append(img, m.Stack[j])
+		}
+		k.marks = append(k.marks, img)
+	}
+	return k
+}
+
+// jump abandons what is left of the innermost exec and resumes k in its
+// place. The captured frames, marks and held values are moved to where
+// the current ones start.
+func (m *Machine) jump(k *continuation) {
+	lv := m.level
+	m.cut(lv)
+	m.frames = append(m.frames[:lv.frames], k.trace...)
+	for _, img := range k.marks {
+		// A mark with its floor at 0 has saved everything it rewinds to
+		m.marks = append(m.marks, stackMark{height: len(img), undo: slices.Clone(img), outer: m.floor})
+	}
+	m.held = append(m.held, k.held...)
+	for _, fr := range k.frames {
+		fr.base += lv.frames - k.at.frames
+		switch fr.kind {
+		case frameTest, frameKeep, frameCatch:
+			fr.mark += lv.marks - k.at.marks
+		case frameHold, frameEach:
+			fr.mark += lv.held - k.at.held
+		}
+		m.pushFrame(fr)
+	}
+}
+
+// quotation wraps k in a quotation that resumes it when run.
+func (k *continuation) quotation() Value {
+	resume := func(m *Machine) {
+		// Jump once the builtin has returned to the loop
+		m.then(func(m *Machine) {
+			m.jump(k)
+		})
+	}
+	return ListVal([]Value{BuiltinVal("continuation", resume)})
+}
+
+// conts returns what is left to do at each level of the continuation
+// stack, innermost first: the rest of each running program, and the
+// values dip and friends will push back.
+func (m *Machine) conts() []Value {
+	var levels []Value
+	end := len(m.held)
+	for i := len(m.vframes) - 1; i >= 0; i-- {
+		fr := &m.vframes[i]
+		switch {
+		case fr.kind < frameCont:
+			rest := []Value{}
+			if fr.pc < len(fr.c.ins) {
+				in := fr.c.ins[fr.pc]
+				at := int(in.at) - in.op.literals() // the fused quotations
+				rest = fr.c.src[at:]
+			}
+			levels = append(levels, ListVal(rest))
+		case fr.kind == frameHold:
+			levels = append(levels, ListVal(slices.Clone(m.held[fr.mark:end])))
+			end = fr.mark
+		case fr.kind == frameEach:
+			end = fr.mark
+		}
+	}
+	if levels == nil {
+		levels = []Value{}
+	}
+	return levels
+}
@@ -0,0 +1,19 @@
+// Package joy implements an interpreter for the Joy programming language.
+//
+// A Machine holds the data stack and the dictionary of user definitions.
+// Source is run with RunSource, RunLine or RunFile; already-parsed programs
+// are run with Execute or RunSafe. The standard libraries from lib/ are
+// embedded in the package, so RunFile("inilib.joy") works without any files
+// on disk:
+//
+//	m := joy.NewMachine()
+//	if err := m.RunFile("inilib.joy"); err != nil {
+//		log.Fatal(err)
+//	}
+//	if err := m.RunSource("3 4 + sqr"); err != nil {
+//		log.Fatal(err)
+//	}
+//	fmt.Println(m.Pop()) // 49
+//
+// The joy command in cmd/joy wraps a Machine in a REPL.
+package joy
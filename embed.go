@@ -1,6 +1,9 @@
-package main
+package joy
 
-import "embed"
+import (
+	"embed"
+	"io/fs"
+)
 
 //go:embed lib/*.joy
 var embeddedLibs embed.FS
@@ -8,3 +11,13 @@ var embeddedLibs embed.FS
 func readEmbeddedLib(name string) ([]byte, error) {
 	return embeddedLibs.ReadFile("lib/" + name)
 }
+
+// LibFS returns the embedded standard library (inilib.joy, seqlib.joy, ...).
+// RunFile and include fall back to it when a file is not found on disk.
+func LibFS() fs.FS {
+	sub, err := fs.Sub(embeddedLibs, "lib")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
@@ -1,6 +1,9 @@
-package main
+package joy
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func benchMachine(b *testing.B) *Machine {
 	b.Helper()
@@ -92,3 +95,19 @@ func BenchmarkLazyTake(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkStringAt walks a long non-ASCII string with at.
+func BenchmarkStringAt(b *testing.B) {
+	m := benchMachine(b)
+	if err := m.RunLine(`DEFINE walk == 0 [dup2 swap size <] [dup2 at pop succ] while pop2.`); err != nil {
+		b.Fatal(err)
+	}
+	src := `"` + strings.Repeat("aé", 5000) + `" walk`
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Stack = m.Stack[:0]
+		if err := m.RunLine(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
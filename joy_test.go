@@ -1,27 +1,70 @@
-package main
+package joy
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
-// captureOutput runs fn and captures what it prints to stdout.
-func captureOutput(fn func()) string {
-	old := os.Stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
-	fn()
-	w.Close()
-	os.Stdout = old
+// captureOutput runs fn and captures what m prints to its Stdout.
+func captureOutput(m *Machine, fn func()) string {
 	var buf bytes.Buffer
-	io.Copy(&buf, r)
+	old := m.Stdout
+	m.Stdout = &buf
+	fn()
+	m.Stdout = old
 	return buf.String()
 }
 
+// runCase is a program and what running it should print, or the error
+// it should fail with.
+type runCase struct {
+	input string
+	want  string
+}
+
+// checkOutputs runs each program on a fresh machine from newMachine and
+// checks what it prints, and that it leaves no continuation state behind.
+func checkOutputs(t *testing.T, newMachine func() *Machine, tests []runCase) {
+	t.Helper()
+	for _, tt := range tests {
+		m := newMachine()
+		var runErr error
+		out := captureOutput(m, func() {
+			runErr = m.RunLine(tt.input)
+		})
+		if runErr != nil {
+			t.Errorf("%s: error: %v", tt.input, runErr)
+			continue
+		}
+		if out != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, out, tt.want)
+		}
+		if m.Depth != 0 || len(m.marks) != 0 || len(m.held) != 0 || len(m.frames) != 0 {
+			t.Errorf("%s: depth %d, %d marks, %d held values, %d frames left", tt.input,
+				m.Depth, len(m.marks), len(m.held), len(m.frames))
+		}
+	}
+}
+
+// checkErrors runs each program on a fresh machine from newMachine and
+// checks the error it fails with.
+func checkErrors(t *testing.T, newMachine func() *Machine, cases []runCase) {
+	t.Helper()
+	for _, tc := range cases {
+		m := newMachine()
+		captureOutput(m, func() {
+			if err := m.RunLine(tc.input); err == nil || err.Error() != tc.want {
+				t.Errorf("%s: got error %v, want %q", tc.input, err, tc.want)
+			}
+		})
+	}
+}
+
 func TestBasicArithmetic(t *testing.T) {
 	tests := []struct {
 		input  string
@@ -45,7 +88,7 @@ func TestBasicArithmetic(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -74,7 +117,7 @@ func TestComparisons(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -101,7 +144,7 @@ func TestStackOps(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -132,7 +175,7 @@ func TestListOps(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -165,7 +208,7 @@ func TestCombinators(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -189,7 +232,7 @@ func TestTimesAndStep(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -213,7 +256,7 @@ func TestDefine(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				// run all lines
 				for _, line := range strings.Split(tt.input, "\n") {
 					line = strings.TrimSpace(line)
@@ -249,7 +292,7 @@ func TestLogic(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -289,7 +332,7 @@ func TestPredicates(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -312,11 +355,22 @@ func TestSets(t *testing.T) {
 		{"{1 2 3} size .", "3\n"},
 		{"{1 2 3} 5 has .", "false\n"},
 		{"{1 2 3} 2 has .", "true\n"},
+		// members past the small-set range
+		{"{1000000 'z 3} .", "{3 122 1000000}\n"},
+		{"{'a 'z} 'z has . 'é {} cons .", "true\n{233}\n"},
+		{"{1 100} {100 200} and . {1 100} {100 200} xor .", "{100}\n{1 200}\n"},
+		{"{1 100} {1 100} xor null . {100} {2} or {2 100} = .", "true\ntrue\n"},
+		{"{} not size . setsize .", "1114112\n1114112\n"},
+		{"{} not dup first . dup 1114111 has . 1114112 has .", "0\ntrue\nfalse\n"},
+		{"{70 5 300} first . {70 5 300} rest . {70 5} rest .", "5\n{70 300}\n{70}\n"},
+		{"0 {5 70 900} [+] step . {3 97 1000} [2 *] map .", "975\n{6 194 2000}\n"},
+		{"{1 2 1000} [1000 <] filter . {1 2 300} [0] [+] primrec .", "{1 2}\n303\n"},
+		{"5000 {} cons small . 'é {'é} in . {1 2000} {1 3000} < .", "true\ntrue\ntrue\n"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -326,6 +380,15 @@ func TestSets(t *testing.T) {
 			}
 		})
 	}
+
+	for _, input := range []string{"{1114112}", "{-1}", "1114112 {} cons"} {
+		m := NewMachine()
+		captureOutput(m, func() {
+			if err := m.RunLine(input); err == nil || !strings.Contains(err.Error(), "out of range 0..1114111") {
+				t.Errorf("%s: got error %v, want out of range", input, err)
+			}
+		})
+	}
 }
 
 func TestStrings(t *testing.T) {
@@ -340,7 +403,7 @@ func TestStrings(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -354,7 +417,7 @@ func TestStrings(t *testing.T) {
 
 func TestChars(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("'A ord ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -377,7 +440,7 @@ func TestFloat(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -391,7 +454,7 @@ func TestFloat(t *testing.T) {
 
 func TestNullary(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("5 [dup *] nullary .s"); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -404,7 +467,7 @@ func TestNullary(t *testing.T) {
 
 func TestUnary(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("5 [dup *] unary ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -425,7 +488,7 @@ func TestIfteWithQuotation(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -439,7 +502,7 @@ func TestIfteWithQuotation(t *testing.T) {
 
 func TestRecursiveDefine(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("DEFINE factorial == [0 =] [pop 1] [dup 1 - factorial *] ifte ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -454,7 +517,7 @@ func TestRecursiveDefine(t *testing.T) {
 
 func TestWhile(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("1 [10 <] [2 *] while ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -466,7 +529,7 @@ func TestWhile(t *testing.T) {
 
 func TestInfra(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("[1 2 3] [+ +] infra ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -478,7 +541,7 @@ func TestInfra(t *testing.T) {
 
 func TestDip(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("1 2 3 [+] dip .s"); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -500,7 +563,7 @@ func TestChoice(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -523,7 +586,7 @@ func TestComments(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -542,7 +605,7 @@ func TestErrorRecovery(t *testing.T) {
 		t.Error("expected stack underflow error")
 	}
 	// Machine should still be usable after error
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("42 ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -571,7 +634,7 @@ func TestPlanExamples(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -585,7 +648,7 @@ func TestPlanExamples(t *testing.T) {
 
 func TestPlanDefineExample(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("DEFINE sq == dup * ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -611,7 +674,7 @@ func TestTailrec(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -636,7 +699,7 @@ func TestLinrec(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -659,7 +722,7 @@ func TestBinrec(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -682,7 +745,7 @@ func TestGenrec(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -705,7 +768,7 @@ func TestCondlinrec(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -732,7 +795,7 @@ func TestCondnestrec(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -752,7 +815,7 @@ func TestHideInEnd(t *testing.T) {
 		if err := m.RunLine(src); err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		out := captureOutput(func() {
+		out := captureOutput(m, func() {
 			if err := m.RunLine("5 double ."); err != nil {
 				t.Fatalf("error: %v", err)
 			}
@@ -783,7 +846,7 @@ func TestHideInEnd(t *testing.T) {
 		if err := m.RunLine(src); err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		out := captureOutput(func() {
+		out := captureOutput(m, func() {
 			if err := m.RunLine("5 add10 ."); err != nil {
 				t.Fatalf("error: %v", err)
 			}
@@ -791,7 +854,7 @@ func TestHideInEnd(t *testing.T) {
 		if out != "15\n" {
 			t.Errorf("add10: got %q, want %q", out, "15\n")
 		}
-		out = captureOutput(func() {
+		out = captureOutput(m, func() {
 			if err := m.RunLine("5 add100 ."); err != nil {
 				t.Fatalf("error: %v", err)
 			}
@@ -823,7 +886,7 @@ func TestHideInEnd(t *testing.T) {
 		if err := m.RunLine(src); err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		out := captureOutput(func() {
+		out := captureOutput(m, func() {
 			if err := m.RunLine("7 square ."); err != nil {
 				t.Fatalf("error: %v", err)
 			}
@@ -855,7 +918,7 @@ func TestFloatMath(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -870,7 +933,7 @@ func TestFloatMath(t *testing.T) {
 func TestFrexpModf(t *testing.T) {
 	// frexp: 8.0 -> 0.5 3
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("8.0 frexp . ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -881,7 +944,7 @@ func TestFrexpModf(t *testing.T) {
 
 	// modf: 3.75 -> frac=0.75, int=3.0  (frac pushed first, then int on top)
 	m = NewMachine()
-	out = captureOutput(func() {
+	out = captureOutput(m, func() {
 		if err := m.RunLine("3.75 modf . ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -893,7 +956,7 @@ func TestFrexpModf(t *testing.T) {
 
 func TestRandom(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		// Seed with 42, get first random, seed again, should get same
 		if err := m.RunLine("42 srand rand ."); err != nil {
 			t.Fatalf("error: %v", err)
@@ -901,7 +964,7 @@ func TestRandom(t *testing.T) {
 	})
 	first := out
 	m = NewMachine()
-	out = captureOutput(func() {
+	out = captureOutput(m, func() {
 		if err := m.RunLine("42 srand rand ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -926,7 +989,7 @@ func TestPrimrec(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -941,7 +1004,7 @@ func TestPrimrec(t *testing.T) {
 func TestTreestep(t *testing.T) {
 	// Sum all leaves: [1 [2 3]] -> 1+2+3 = 6
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("0 [1 [2 3]] [+] treestep ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -954,7 +1017,7 @@ func TestTreestep(t *testing.T) {
 func TestTreerec(t *testing.T) {
 	// Count leaves: [1 [2 [3 4]]] — 4 leaves
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("[1 [2 [3 4]]] [pop 1] [+] treerec ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -979,7 +1042,7 @@ func TestSomeAll(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1004,7 +1067,7 @@ func TestSort(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1019,7 +1082,7 @@ func TestSort(t *testing.T) {
 func TestTimeBuiltins(t *testing.T) {
 	// 0 gmtime first -> 1970 (year)
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("0 gmtime first ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1031,7 +1094,7 @@ func TestTimeBuiltins(t *testing.T) {
 	// Round-trip: mktime(gmtime(0)) should preserve timestamp
 	// (may differ due to timezone, so use gmtime -> mktime with UTC)
 	m = NewMachine()
-	out = captureOutput(func() {
+	out = captureOutput(m, func() {
 		if err := m.RunLine("0 gmtime size ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1043,7 +1106,7 @@ func TestTimeBuiltins(t *testing.T) {
 
 func TestGetenv(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine(`"HOME" getenv size 0 > .`); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1058,7 +1121,7 @@ func TestUndefs(t *testing.T) {
 	if err := m.RunLine("DEFINE foo == bar baz ."); err != nil {
 		t.Fatalf("error: %v", err)
 	}
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("undefs size ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1097,7 +1160,7 @@ func TestFileIO(t *testing.T) {
 	if err := m.RunLine("5 fread"); err != nil {
 		t.Fatalf("fread: %v", err)
 	}
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("size ."); err != nil {
 			t.Fatalf("size: %v", err)
 		}
@@ -1127,7 +1190,7 @@ func TestFileSeekTell(t *testing.T) {
 	if err := m.RunLine("2 0 fseek"); err != nil {
 		t.Fatalf("fseek: %v", err)
 	}
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("ftell ."); err != nil {
 			t.Fatalf("ftell: %v", err)
 		}
@@ -1150,7 +1213,7 @@ func TestFremove(t *testing.T) {
 		t.Fatalf("create: %v", err)
 	}
 	// Remove it
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine(fmt.Sprintf(`"%s" fremove .`, path)); err != nil {
 			t.Fatalf("fremove: %v", err)
 		}
@@ -1159,7 +1222,7 @@ func TestFremove(t *testing.T) {
 		t.Errorf("fremove: got %q, want %q", out, "true\n")
 	}
 	// Try to remove again — should fail
-	out = captureOutput(func() {
+	out = captureOutput(m, func() {
 		if err := m.RunLine(fmt.Sprintf(`"%s" fremove .`, path)); err != nil {
 			t.Fatalf("fremove2: %v", err)
 		}
@@ -1171,7 +1234,7 @@ func TestFremove(t *testing.T) {
 
 func TestFilePredicate(t *testing.T) {
 	m := NewMachine()
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("stdin file ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1179,7 +1242,7 @@ func TestFilePredicate(t *testing.T) {
 	if out != "true\n" {
 		t.Errorf("file predicate: got %q, want %q", out, "true\n")
 	}
-	out = captureOutput(func() {
+	out = captureOutput(m, func() {
 		if err := m.RunLine("42 file ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1204,7 +1267,7 @@ func TestInclude(t *testing.T) {
 	}
 
 	// Use the definition
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("7 double ."); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1232,7 +1295,7 @@ func TestIncludeGuard(t *testing.T) {
 	}
 
 	// Stack should only have one 42 (guard prevented second load)
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine(".s"); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1254,7 +1317,7 @@ func TestFormatf(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
 			m := NewMachine()
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1291,7 +1354,7 @@ func TestEmbeddedInilib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1329,7 +1392,7 @@ func TestLibAgglib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1356,7 +1419,7 @@ func TestLibSeqlib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1386,7 +1449,7 @@ func TestLibNumlib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1415,7 +1478,7 @@ func TestLibLazlib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1444,7 +1507,7 @@ func TestLibLazlibFilter(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1477,7 +1540,7 @@ func TestLibTyplib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1506,7 +1569,7 @@ func TestModule(t *testing.T) {
 			{`m1.abba .`, "\"abba\"\n"},
 		}
 		for _, tt := range tests {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error on %q: %v", tt.input, err)
 				}
@@ -1556,7 +1619,7 @@ func TestModule(t *testing.T) {
 			{`m2.bcd .`, "\"BCD\"\n"},
 		}
 		for _, tt := range tests {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error on %q: %v", tt.input, err)
 				}
@@ -1585,7 +1648,7 @@ func TestModule(t *testing.T) {
 		if err := m.RunLine(src2); err != nil {
 			t.Fatalf("error: %v", err)
 		}
-		out := captureOutput(func() {
+		out := captureOutput(m, func() {
 			if err := m.RunLine("x.get ."); err != nil {
 				t.Fatalf("error: %v", err)
 			}
@@ -1593,7 +1656,7 @@ func TestModule(t *testing.T) {
 		if out != "10\n" {
 			t.Errorf("x.get: got %q, want %q", out, "10\n")
 		}
-		out = captureOutput(func() {
+		out = captureOutput(m, func() {
 			if err := m.RunLine("y.get ."); err != nil {
 				t.Fatalf("error: %v", err)
 			}
@@ -1619,7 +1682,7 @@ func TestInilibSequor(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1665,7 +1728,7 @@ func TestRefMtrlib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1695,7 +1758,7 @@ func TestRefMthlib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1737,7 +1800,7 @@ func TestRefSymlib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1791,7 +1854,7 @@ func TestRefGrmlib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1821,7 +1884,7 @@ func TestRefPlglib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1860,7 +1923,7 @@ func TestRefLsplib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1915,7 +1978,7 @@ func TestRefReplib(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			out := captureOutput(func() {
+			out := captureOutput(m, func() {
 				if err := m.RunLine(tt.input); err != nil {
 					t.Fatalf("error: %v", err)
 				}
@@ -1931,7 +1994,7 @@ func TestRefFraclib(t *testing.T) {
 	m := newMachineWithStdlib(t)
 	loadLib(t, m, "fraclib")
 	// Just test that mandel runs without error and produces output
-	out := captureOutput(func() {
+	out := captureOutput(m, func() {
 		if err := m.RunLine("mandel"); err != nil {
 			t.Fatalf("error: %v", err)
 		}
@@ -1948,5 +2011,1150 @@ func TestRefFraclib(t *testing.T) {
 	}
 }
 
+func TestPerMachineBuiltins(t *testing.T) {
+	m1 := NewMachine()
+	m2 := NewMachine()
+	m1.Register("answer", func(m *Machine) { m.Push(IntVal(42)) })
+	out := captureOutput(m1, func() {
+		if err := m1.RunLine("answer ."); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	})
+	if out != "42\n" {
+		t.Errorf("got %q, want %q", out, "42\n")
+	}
+	// m2 does not see m1's primitive
+	if err := m2.RunLine("answer"); err == nil || err.Error() != "undefined: answer" {
+		t.Errorf("m2 answer: got %v, want undefined error", err)
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	m := NewMachine()
+	err := m.RegisterFunc("divmod", "I J -> K L", func(args []Value) []Value {
+		a, b := args[0].Int, args[1].Int
+		return []Value{IntVal(a / b), IntVal(a % b)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.RegisterFunc("shout", "S -> T", func(args []Value) []Value {
+		return []Value{StringVal(strings.ToUpper(args[0].Str))}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.RegisterFunc("bad", "X -> X", func(args []Value) []Value { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input  string
+		expect string
+	}{
+		{"17 5 divmod .s", "3 2\n"},
+		{`"joy" shout .`, "\"JOY\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			m.Stack = nil
+			out := captureOutput(m, func() {
+				if err := m.RunLine(tt.input); err != nil {
+					t.Fatalf("error: %v", err)
+				}
+			})
+			if out != tt.expect {
+				t.Errorf("got %q, want %q", out, tt.expect)
+			}
+		})
+	}
+	errTests := []struct {
+		input  string
+		expect string
+	}{
+		{"5 divmod", "divmod: expected 2 parameters, got 1"},
+		{`17 "x" divmod`, "divmod: integer expected as parameter 2"},
+		{"1 bad", "bad: returned 0 values, stack effect declares 1"},
+	}
+	for _, tt := range errTests {
+		m.Stack = nil
+		err := m.RunLine(tt.input)
+		if err == nil || err.Error() != tt.expect {
+			t.Errorf("%s: got %v, want %q", tt.input, err, tt.expect)
+		}
+	}
+	if err := m.RegisterFunc("nope", "I I", nil); err == nil {
+		t.Error("expected error for stack effect without ->")
+	}
+	if err := m.RegisterFunc("nope", "W -> I", nil); err == nil {
+		t.Error("expected error for unknown parameter type")
+	}
+}
+
+func TestRedirectedStreams(t *testing.T) {
+	m := NewMachine()
+	var stdout, stderr bytes.Buffer
+	m.Stdin = strings.NewReader("[1 2 3] size\nline two\n")
+	m.Stdout = &stdout
+	m.Stderr = &stderr
+	input := `get i . stdin fgets swap pop . 'x putch newline ` +
+		`stdout "out" fputchars pop stderr "err" fputchars pop stdout stdout = .`
+	if err := m.RunLine(input); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := "3\n" + ListVal([]Value{CharVal('l'), CharVal('i'), CharVal('n'), CharVal('e'),
+		CharVal(' '), CharVal('t'), CharVal('w'), CharVal('o'), CharVal('\n')}).String() +
+		"\nx\nouttrue\n"
+	if stdout.String() != want {
+		t.Errorf("stdout: got %q, want %q", stdout.String(), want)
+	}
+	if stderr.String() != "err" {
+		t.Errorf("stderr: got %q, want %q", stderr.String(), "err")
+	}
+	if err := m.RunLine("get"); err == nil || err.Error() != "get: end of input" {
+		t.Errorf("get at EOF: got %v", err)
+	}
+	// A count beyond the input reads what there is
+	m.Stdin = strings.NewReader("ab")
+	stdout.Reset()
+	if err := m.RunLine("stdin 1000000000000 fread swap pop ."); err != nil {
+		t.Fatalf("fread: %v", err)
+	}
+	if stdout.String() != "[97 98]\n" {
+		t.Errorf("fread: got %q, want %q", stdout.String(), "[97 98]\n")
+	}
+}
+
+// closeWriter records whether it was closed.
+type closeWriter struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (w *closeWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func TestCloseStandardStreams(t *testing.T) {
+	m := NewMachine()
+	out := &closeWriter{}
+	m.Stdout = out
+	m.Stdin = strings.NewReader("")
+	if err := m.RunLine("stdout fclose stdin fclose stderr fclose 1 ."); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if out.closed || out.String() != "1\n" {
+		t.Errorf("closed %v, output %q; want the writer left open and %q", out.closed, out.String(), "1\n")
+	}
+}
+
+// lineWriter is a writer of a type == cannot compare.
+type lineWriter struct {
+	prefix []byte
+	out    *bytes.Buffer
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w.out.Write(w.prefix)
+	return w.out.Write(p)
+}
+
+func TestUncomparableStreams(t *testing.T) {
+	m := NewMachine()
+	var out bytes.Buffer
+	m.Stdout = lineWriter{[]byte("> "), &out}
+	if err := m.RunLine(`stdout "a" fputchars stdout = .`); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	m.Stdout = lineWriter{[]byte("] "), &out}
+	if err := m.RunLine(`stdout "b" fputchars pop`); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := "> a> true\n] b"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestConcurrentMachines(t *testing.T) {
+	outs := make([]bytes.Buffer, 4)
+	done := make(chan struct{})
+	for i := range outs {
+		go func(i int) {
+			defer func() { done <- struct{}{} }()
+			m := NewMachine()
+			m.Stdout = &outs[i]
+			m.RunLine(fmt.Sprintf("%d 1000 [1 +] times .", i))
+		}(i)
+	}
+	for range outs {
+		<-done
+	}
+	for i := range outs {
+		if want := fmt.Sprintf("%d\n", i+1000); outs[i].String() != want {
+			t.Errorf("machine %d: got %q, want %q", i, outs[i].String(), want)
+		}
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	m := NewMachine()
+	program, err := m.Parse("[true] [] while")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = m.RunContext(ctx, program)
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrCancelled {
+		t.Fatalf("while with deadline: got %v, want cancelled error", err)
+	}
+	if m.Depth != 0 {
+		t.Errorf("depth after cancel: got %d, want 0", m.Depth)
+	}
+
+	m.MaxSteps = 1000
+	program, _ = m.Parse("DEFINE loop == 1 pop loop. loop")
+	err = m.RunContext(context.Background(), program)
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrBudget {
+		t.Fatalf("loop with budget: got %v, want budget error", err)
+	}
+	if m.Steps != 1001 {
+		t.Errorf("steps: got %d, want 1001", m.Steps)
+	}
+	// The budget applies per run, so the machine is usable afterwards
+	m.Stack = nil
+	out := captureOutput(m, func() {
+		if err := m.RunLine("10 5 [1 +] times ."); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	})
+	if out != "15\n" {
+		t.Errorf("got %q, want %q", out, "15\n")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		setup  func(m *Machine)
+		input  string
+		expect string
+	}{
+		{func(m *Machine) { m.MaxStack = 50 }, "1 100 [dup] times",
+			"stack height limit exceeded (MaxStack 50)"},
+		{func(m *Machine) { m.MaxStack = 50 }, "[] 100 [1 swap cons] times unstack 1",
+			"stack height limit exceeded (MaxStack 50)"},
+		{func(m *Machine) { m.MaxListLen = 10 }, "[] 20 [1 swap cons] times",
+			"cons: list length limit exceeded (MaxListLen 10)"},
+		{func(m *Machine) { m.MaxListLen = 10 }, "[1 2 3 4 5 6] dup concat",
+			"concat: list length limit exceeded (MaxListLen 10)"},
+		{func(m *Machine) { m.MaxListLen = 3 }, `"a1b2c3d4" "[0-9]" refindall`,
+			"refindall: list length limit exceeded (MaxListLen 3)"},
+		{func(m *Machine) { m.MaxListLen = 3 }, `"a,b,c,d" "," resplit`,
+			"resplit: list length limit exceeded (MaxListLen 3)"},
+		{func(m *Machine) { m.MaxStringLen = 100 }, `"aaaaaaaaaa" "" "xxxxxxxxxxxxxxxxxxxx" rereplace`,
+			"rereplace: string length limit exceeded (MaxStringLen 100)"},
+		{func(m *Machine) { m.MaxListLen = 3 }, `"abc" "(a)(b)(c)" resubmatch`,
+			"resubmatch: list length limit exceeded (MaxListLen 3)"},
+		{func(m *Machine) { m.MaxListLen = 3 }, `"[1, [2, 3, 4, 5]]" json>`,
+			"json>: list length limit exceeded (MaxListLen 3)"},
+		{func(m *Machine) { m.MaxListLen = 3 }, `"{\"a\": 1, \"b\": 2, \"c\": 3, \"d\": 4}" json>`,
+			"json>: list length limit exceeded (MaxListLen 3)"},
+		{func(m *Machine) { m.MaxStringLen = 4 }, `"[\"abc\", \"abcde\"]" json>`,
+			"json>: string length limit exceeded (MaxStringLen 4)"},
+		{func(m *Machine) { m.MaxStringLen = 100 }, `"ab" 10 [dup concat] times`,
+			"concat: string length limit exceeded (MaxStringLen 100)"},
+		{func(m *Machine) { m.MaxStringLen = 100 }, "1 'd 1000000000 0 format",
+			"format: string length limit exceeded (MaxStringLen 100)"},
+		{func(m *Machine) { m.MaxBytes = 10000 }, "[] 1000 [0 swap cons] times",
+			"memory limit exceeded (MaxBytes 10000)"},
+		{func(m *Machine) { m.MaxBytes = 10000 }, "{1 2} not",
+			"not: memory limit exceeded (MaxBytes 10000)"},
+		{func(m *Machine) {
+			m.MaxListLen = 10
+			m.Stdin = strings.NewReader(strings.Repeat("x", 100) + "\n")
+		}, "stdin fgets", "fgets: list length limit exceeded (MaxListLen 10)"},
+		{func(m *Machine) {
+			m.MaxListLen = 10
+			m.Stdin = strings.NewReader(strings.Repeat("x", 100))
+		}, "stdin 1000000000000 fread", "fread: list length limit exceeded (MaxListLen 10)"},
+		{func(m *Machine) {
+			m.MaxStringLen = 10
+			m.Stdin = strings.NewReader(strings.Repeat("x", 100) + "\n")
+		}, "stdin fgetsb", "fgetsb: string length limit exceeded (MaxStringLen 10)"},
+		{func(m *Machine) {
+			m.MaxStringLen = 10
+			m.Stdin = strings.NewReader(strings.Repeat("x", 100))
+		}, "stdin 1000000000000 freadb", "freadb: string length limit exceeded (MaxStringLen 10)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			m := NewMachine()
+			tt.setup(m)
+			err := m.RunLine(tt.input)
+			je, ok := err.(JoyError)
+			if !ok || je.Kind != ErrLimit || je.Msg != tt.expect {
+				t.Fatalf("got %v, want %q", err, tt.expect)
+			}
+			// Within the limits the machine keeps working
+			m.Stack = nil
+			out := captureOutput(m, func() {
+				if err := m.RunLine("[1 2] [3] concat ."); err != nil {
+					t.Fatalf("error: %v", err)
+				}
+			})
+			if out != "[1 2 3]\n" {
+				t.Errorf("got %q, want %q", out, "[1 2 3]\n")
+			}
+		})
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/ok.joy", []byte("DEFINE okword == 7 ."), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine()
+	m.Capabilities = CapSandbox
+	m.IncludeDirs = []string{dir}
+	denied := []string{
+		`"/tmp/x" "w" fopen`,
+		`"x" fremove`,
+		`"x" "y" frename`,
+		`"HOME" getenv`,
+		`argv`,
+		`argc`,
+		fmt.Sprintf(`"%s/ok.joy" include`, dir),
+		`"../ok.joy" include`,
+	}
+	for _, input := range denied {
+		err := m.RunLine(input)
+		if je, ok := err.(JoyError); !ok || je.Kind != ErrPermission {
+			t.Errorf("%s: got %v, want permission denied", input, err)
+		}
+	}
+	// Allow-listed directory and embedded libraries still load
+	out := captureOutput(m, func() {
+		if err := m.RunLine(`"ok.joy" include okword . "agglib.joy" include 1 2 pairlist .`); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	})
+	if out != "7\n[1 2]\n" {
+		t.Errorf("got %q, want %q", out, "7\n[1 2]\n")
+	}
+	// quit unwinds to the host instead of exiting
+	err := m.RunLine("1 quit 2")
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrQuit {
+		t.Errorf("quit: got %v, want quit error", err)
+	}
+	if err := m.RunLine(`"ok.joy" include quit`); err == nil || err.(JoyError).Kind != ErrQuit {
+		t.Errorf("quit after include: got %v, want quit error", err)
+	}
+}
+
+func TestTraceback(t *testing.T) {
+	m := NewMachine()
+	src := `DEFINE inner == [] first ; outer == inner 1 ; main == outer 2 .
+MODULE m PRIVATE helper == [] rest PUBLIC run == helper 0 END
+DEFINE deep == dup 0 = [[] first] [1 - deep 1 +] ifte .`
+	if err := m.RunLine(src); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"main", "in inner <- in outer <- in main"},
+		{"m.run", "in helper <- in m.run"},
+		{"3 deep", "in deep (x4)"},
+		{"[] first", ""},
+	}
+	for _, tt := range tests {
+		err := m.RunLine(tt.input)
+		je, ok := err.(JoyError)
+		if !ok {
+			t.Errorf("%s: got %v, want JoyError", tt.input, err)
+			continue
+		}
+		if got := je.Traceback(); got != tt.want {
+			t.Errorf("%s: traceback %q, want %q", tt.input, got, tt.want)
+		}
+		if len(m.frames) != 0 {
+			t.Errorf("%s: %d frames left after error", tt.input, len(m.frames))
+		}
+	}
+
+	// A definition ending in a call is entered as a tail frame
+	err := m.RunLine("DEFINE tl == 1 inner . tl")
+	if je := err.(JoyError); len(je.Trace) != 1 || !je.Trace[0].Tail {
+		t.Errorf("tail call: trace %+v, want one tail frame", je.Trace)
+	}
+
+	// Deep traces are shortened
+	long := JoyError{}
+	for i := 0; i < 30; i++ {
+		long.Trace = append(long.Trace, Frame{Name: fmt.Sprintf("w%d", i)})
+	}
+	if got := long.Traceback(); !strings.Contains(got, "in w9 <- ... (19 more) <- in w29") {
+		t.Errorf("long traceback: %q", got)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	toks := NewFileScanner("a.joy", "1 dup\n  (* c\n *) swap").ScanAll()
+	want := []Pos{{"a.joy", 1, 1}, {"a.joy", 1, 3}, {"a.joy", 3, 5}}
+	for i, w := range want {
+		if got := toks[i].Pos(); got != w {
+			t.Errorf("token %d: got %v, want %v", i, got, w)
+		}
+	}
+
+	m := NewMachine()
+	prog, err := m.Parse("\n  dup foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := prog[0].Pos(); p == nil || *p != (Pos{"", 2, 3}) {
+		t.Errorf("builtin pos: got %v", p)
+	}
+	if p := prog[1].Pos(); p == nil || *p != (Pos{"", 2, 7}) {
+		t.Errorf("userdef pos: got %v", p)
+	}
+
+	tests := []struct {
+		file, src string
+		want      string
+	}{
+		// parse error
+		{"p.joy", "DEFINE a == 1 ;\n  [2] == 3 .", "p.joy:2:3"},
+		// runtime error inside a definition
+		{"r.joy", "DEFINE f ==\n  1 [] first .\nf", "r.joy:2:8"},
+		// after a combinator returns
+		{"c.joy", "[1 2]\n\n [pop] map", "c.joy:3:8"},
+	}
+	for _, tt := range tests {
+		m.Stack = m.Stack[:0]
+		err := m.RunSourceFile(tt.file, tt.src)
+		je, ok := err.(JoyError)
+		if !ok {
+			t.Errorf("%s: got %v, want JoyError", tt.file, err)
+			continue
+		}
+		if got := je.Pos().String(); got != tt.want {
+			t.Errorf("%s: error at %s, want %s", tt.file, got, tt.want)
+		}
+	}
+
+	// An error inside an included file keeps the file's position
+	dir := t.TempDir()
+	path := dir + "/inc.joy"
+	if err := os.WriteFile(path, []byte("1\n2 [1] rest rest"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = m.RunLine(fmt.Sprintf("%q include", path))
+	if je, ok := err.(JoyError); !ok || je.Pos() != (Pos{path, 2, 12}) {
+		t.Errorf("include: got %v at %v, want %s:2:12", err, je.Pos(), path)
+	}
+}
+
+func TestVM(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		// specialised builtins behave like the generic ones
+		{"1 2 swap - . 'a 1 + . 1 2.5 + . 3 dup * .", "1\n98\n3.5\n9\n"},
+		{"[1 2] [swap dup +] infra .", "[4 1]\n"},
+		// fused ifte restores the stack after the test
+		{"5 [pop 0 1 2 true] [10 *] [20 *] ifte .", "50\n"},
+		{"5 [3 >] [[1] [2] [3] ifte] [0] ifte .s", "5 2\n"},
+		// fused dip and branch
+		{"1 2 [10 +] dip .s", "11 2\n"},
+		{"1 true [10] [20] branch .s 0 [20] [30] branch .", "1 10\n30\n"},
+	}
+	for _, tt := range tests {
+		m := NewMachine()
+		out := captureOutput(m, func() {
+			if err := m.RunLine(tt.input); err != nil {
+				t.Fatalf("%s: error: %v", tt.input, err)
+			}
+		})
+		if out != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, out, tt.want)
+		}
+	}
+
+	// Errors match the generic builtins, including what is left on the stack
+	m := NewMachine()
+	for _, input := range []string{"dup", "1 swap", "1 +", `"a" 1.0 +`, "[[] first] [1] [2] ifte",
+		"[1] dip", "1 [[] first] dip", "[1] [2] branch", "true [[] first] [2] branch"} {
+		m.Stack = m.Stack[:0]
+		err1 := m.RunLine(input)
+		st1 := m.PrintStack()
+		m.Stack = m.Stack[:0]
+		err2 := m.RunLine("[" + input + "] i")
+		if err1 == nil || err2 == nil || err1.Error() != err2.Error() || st1 != m.PrintStack() {
+			t.Errorf("%s: got %v [%s], generic %v [%s]", input, err1, st1, err2, m.PrintStack())
+		}
+	}
+
+	// A host override of a specialised builtin is honoured
+	m = NewMachine()
+	m.Register("+", func(m *Machine) { m.Pop(); m.Pop(); m.Push(IntVal(42)) })
+	out := captureOutput(m, func() { m.RunLine("1 2 + .") })
+	if out != "42\n" {
+		t.Errorf("override: got %q, want %q", out, "42\n")
+	}
+
+	// Fused combinators count the same steps as pushing their quotations
+	m = NewMachine()
+	for _, input := range []string{"3 [0 =] [pop 1] [dup pred] ifte", "1 2 [dup +] dip", "true [1] [2] branch"} {
+		m.RunLine(input)
+		fused := m.Steps
+		i := strings.LastIndexByte(input, ' ')
+		m.RunLine(input[:i] + " [" + input[i+1:] + "] i")
+		if m.Steps != fused+3 {
+			t.Errorf("%s: steps fused %d, generic %d", input, fused, m.Steps)
+		}
+	}
+
+	// Redefinitions are seen by code compiled earlier
+	m = NewMachine()
+	out = captureOutput(m, func() {
+		m.RunLine("DEFINE host == 1 ; caller == host . caller .")
+		m.RunLine("DEFINE host == 2 . caller .")
+		m.Define("host", []Value{IntVal(7)})
+		m.RunLine("caller .")
+	})
+	if out != "1\n2\n7\n" {
+		t.Errorf("redefinition: got %q, want %q", out, "1\n2\n7\n")
+	}
+}
+
+func TestDefCells(t *testing.T) {
+	m := NewMachine()
+	prog, err := m.Parse("later later")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := prog[0].Def()
+	if d == nil || d != prog[1].Def() || d.Defined {
+		t.Fatalf("references should share one undefined cell, got %+v %+v", prog[0].Def(), prog[1].Def())
+	}
+	// Undefined words fail when called, not when parsed
+	if err := m.RunSafe(prog); err == nil || err.Error() != "undefined: later" {
+		t.Errorf("got %v, want undefined: later", err)
+	}
+	// A later DEFINE fills the same cell
+	if err := m.RunLine("DEFINE later == 5 ."); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Defined || len(d.Body) != 1 {
+		t.Errorf("cell not updated: %+v", d)
+	}
+	m.Stack = m.Stack[:0]
+	if err := m.RunSafe(prog); err != nil || m.PrintStack() != "5 5" {
+		t.Errorf("got %v, stack %q, want 5 5", err, m.PrintStack())
+	}
+	// intern resolves to the same cell
+	m.RunLine(`"later" intern`)
+	if m.Peek().Def() != d {
+		t.Errorf("intern: got cell %p, want %p", m.Peek().Def(), d)
+	}
+	// Lookup, body and helpdetail read the cells, including for host words
+	if _, ok := m.Lookup("nowhere"); ok {
+		t.Error("Lookup: nowhere should be undefined")
+	}
+	m.Define("host", []Value{IntVal(7)})
+	if body, ok := m.Lookup("host"); !ok || len(body) != 1 || body[0].Int != 7 {
+		t.Errorf("Lookup: got %v %v, want [7] true", body, ok)
+	}
+	if body := m.Dict["host"]; len(body) != 1 || body[0].Int != 7 {
+		t.Errorf("Dict: got %v, want [7]", body)
+	}
+	out := captureOutput(m, func() {
+		m.RunLine("[host] first body . [host later nowhere] helpdetail")
+	})
+	want := "[7]\nhost : user-defined\nlater : user-defined\nnowhere : unknown\n"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestCatchThrow(t *testing.T) {
+	tests := []runCase{
+		{"[1 2 +] [pop 0] catch .", "3\n"},
+		// the stack is restored before the handler runs
+		{"1 2 [pop pop 3 [] first] [errmsg] catch .s", "1 2 \"first: empty list\"\n"},
+		{"[[] first] [errkind] catch .", "\"range\"\n"},
+		{"[[] first] [errword] catch .", "\"first\"\n"},
+		{"[pop] [errkind] catch .", "\"underflow\"\n"},
+		{"[nosuchword] [dup errkind put errword] catch .", "\"undefined\"\"nosuchword\"\n"},
+		{"[abort] [errkind] catch .", "\"runtime\"\n"},
+		{"[3 \"a\" take] [errkind] catch .", "\"type\"\n"},
+		// the kind is set where the error is raised, not read off its message
+		{"[1 \"a\" cons] [errkind] catch .", "\"type\"\n"},
+		{"[[nosuchword] first body] [errkind] catch .", "\"undefined\"\n"},
+		{"[\"stack underflow\" throw] [errkind] catch .", "\"user\"\n"},
+		// throw carries any value
+		{"[[1 2] throw] [errdata] catch .", "[1 2]\n"},
+		{"[\"oops\" throw] [dup errkind put errmsg] catch .", "\"user\"\"oops\"\n"},
+		// handlers can rethrow; inner catches see inner errors
+		{"[[[] first] [throw] catch] [errword] catch .", "\"first\"\n"},
+		{"[[1 throw] [errdata 1 +] catch 10 *] [pop 0] catch .", "20\n"},
+		// errors inside user words unwind their frames
+		{"DEFINE bad == [] first 2 . [bad] [pop 1] catch .", "1\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	// Uncaught throws reach the host with their data
+	m := NewMachine()
+	err := m.RunLine("[1 2] throw")
+	if je, ok := err.(JoyError); !ok || je.Data == nil || je.Data.String() != "[1 2]" {
+		t.Errorf("uncaught throw: got %#v", err)
+	}
+	err = m.RunLine("1 0 /")
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrRange {
+		t.Errorf("1 0 /: got %#v, want kind %q", err, ErrRange)
+	}
+
+	// Aborts cannot be caught
+	m.MaxSteps = 100
+	err = m.RunLine("[[true] [] while] [pop] catch")
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrBudget {
+		t.Errorf("budget inside catch: got %v, want budget error", err)
+	}
+	m.MaxSteps = 0
+	err = m.RunLine("[quit] [pop] catch")
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrQuit {
+		t.Errorf("quit inside catch: got %v, want quit error", err)
+	}
+}
+
+func TestContinuations(t *testing.T) {
+	tests := []runCase{
+		// recursion far past the old Go-stack depth of 10000
+		{"20000 [null] [pop 0] [dup pred] [+] linrec .", "200010000\n"},
+		{"DEFINE sum == [null] [] [dup pred sum +] ifte. 50000 sum .", "1250025000\n"},
+		{"15 [small] [] [pred dup pred] [+] binrec .", "610\n"},
+		{"1 20000 [[] cons] times [1 +] [] treerec .", "2\n"},
+		{"0 [] 20000 [[] cons] times [pop 1 +] treestep .", "0\n"},
+		{"0 [1] 20000 [[] cons] times [+] treestep .", "1\n"},
+		// tests leave the stack as it was, however deep it is
+		{"1 2 3 [pop pop pop 0] [4] [5] ifte .s", "1 2 3 5\n"},
+		{"1 2 3 [pop pop pop 7] nullary .s", "1 2 3 7\n"},
+		// catch restores the stack from inside combinators
+		{"[1 2 3] [[dup 2 = [0 throw] [] ifte] [pop 9] catch] map .", "[1 9 3]\n"},
+		{"1 2 [3 [true] [pop pop pop pop] while] [pop] catch .s", "1 2\n"},
+		{"10 [[null] [[] first] [pred] [] linrec] [errword] catch .s", "10 \"first\"\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	// Tests put the stack back even when host builtins change it in place
+	newMachine := func() *Machine {
+		m := NewMachine()
+		m.Register("inc", func(m *Machine) {
+			top := &m.Stack[len(m.Stack)-1]
+			*top = IntVal(top.Int + 1)
+		})
+		return m
+	}
+	checkOutputs(t, newMachine, []runCase{
+		{"5 [inc 100 >] [1] [2] ifte .s", "5 2\n"},
+		{"5 [inc inc] nullary .s", "5 7\n"},
+		{"1 2 [pop inc 0 >] [] [] ifte .s", "1 2\n"},
+	})
+
+	// Runaway recursion is stopped by the frame quota
+	m := NewMachine()
+	m.MaxFrameBytes = 1 << 20
+	err := m.RunLine("DEFINE inf == 1 inf +. inf")
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrLimit || !strings.Contains(je.Msg, "recursion depth exceeded") {
+		t.Errorf("runaway recursion: got %v, want limit error", err)
+	}
+	if m.Depth != 0 {
+		t.Errorf("depth after runaway recursion: got %d, want 0", m.Depth)
+	}
+
+	// or by MaxDepth, if set
+	m = NewMachine()
+	m.MaxDepth = 100
+	err = m.RunLine("200 [null] [] [pred] [] linrec")
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrRuntime || !strings.Contains(je.Msg, "recursion depth exceeded (100)") {
+		t.Errorf("MaxDepth: got %v, want recursion depth error", err)
+	}
+	if err := m.RunLine("50 [null] [] [pred] [] linrec"); err != nil {
+		t.Errorf("within MaxDepth: %v", err)
+	}
+}
+
+func TestCallcc(t *testing.T) {
+	tests := []runCase{
+		{"[conts] i 3 4 .s", "[[] [3 4 .s]] 3 4\n"},
+		{"1 3 [2 conts] dip 4 .s", "1 2 [[] [3] [4 .s]] 3 4\n"},
+		// returning normally from callcc
+		{"1 [pop 7] callcc 2 + .s", "1 9\n"},
+		// resuming carries on after callcc with the stack as it is
+		{"1 [5 swap i 100] callcc 2 + .s", "1 7\n"},
+		// early exit from step and treestep
+		{"[1 2 3 4 5] [swap [dup 3 = [swap i] [pop] ifte] step 0] callcc .s", "3\n"},
+		{"[[1 [2 [3 4]]] [dup 3 = [swap i] [pop] ifte] treestep 0] callcc .s", "3\n"},
+		// re-entering step carries on with the items after the one it left at
+		{"[1 2 3] [dup 2 = [pop [] callcc] [] ifte] step pop dup list [10 swap i] [] ifte .s", "1 10\n"},
+		// a continuation can be resumed again and again
+		{"0 [] callcc swap 1 + swap [dup] dip swap 3 < [dup i] [pop] ifte .s", "3\n"},
+		// with the values dip set aside, and the stack nullary rewinds to
+		{"0 100 [[] callcc] dip pop swap 1 + swap [dup] dip swap 3 < [dup i] [pop] ifte .s", "3\n"},
+		{"5 [[] callcc] nullary dup list [dup [7 8] dip i] [] ifte .s", "5 8\n"},
+		// jumping out of catch leaves the handler behind
+		{"[7 [swap i] [pop 9] catch 100] callcc .s", "7\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	// An abandoned catch does not catch later errors
+	m := NewMachine()
+	err := m.RunLine("[7 [swap i] [pop 9] catch] callcc [] first")
+	if err == nil || err.Error() != "first: empty list" {
+		t.Errorf("abandoned catch: got %v, want first: empty list", err)
+	}
+
+	// A continuation outlives the run that captured it
+	m = NewMachine()
+	if err := m.RunLine("DEFINE twice == 2 *. [] callcc 5 twice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RunLine("swap 1 swap i 3"); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.PrintStack(); got != "10 1 10" {
+		t.Errorf("resumed after the run: got %q, want %q", got, "10 1 10")
+	}
+}
+
+func TestBigInt(t *testing.T) {
+	tests := []runCase{
+		{"30 fact .", "265252859812191058636308480000000\n"},
+		// promotion on overflow, demotion once the result fits
+		{"9223372036854775807 1 + .", "9223372036854775808\n"},
+		{"9223372036854775807 succ pred .", "9223372036854775807\n"},
+		{"-9223372036854775808 pred .", "-9223372036854775809\n"},
+		{"-9223372036854775808 neg . -9223372036854775808 abs .", "9223372036854775808\n9223372036854775808\n"},
+		{"-9223372036854775808 -1 / .", "9223372036854775808\n"},
+		{"4294967296 dup * .", "18446744073709551616\n"},
+		{"18446744073709551616 4294967296 div .", "4294967296\n"},
+		{"100000000000000000000 7 rem .", "2\n"},
+		{"100000000000000000000 100000000000000000000 - .", "0\n"},
+		// still integers, comparable with anything numeric
+		{"100000000000000000000 integer .", "true\n"},
+		{"100000000000000000000 100000000000000000000 = .", "true\n"},
+		{"100000000000000000000 100000000000000000001 < .", "true\n"},
+		{"100000000000000000000 9223372036854775807 > .", "true\n"},
+		{"-100000000000000000000 1.5 < .", "true\n"},
+		{"100000000000000000000 0.5 * .", "5e+19\n"},
+		{"100000000000000000000 null . 100000000000000000000 small .", "false\nfalse\n"},
+		{"1e20 trunc .", "100000000000000000000\n"},
+		{"100000000000000000000 'd 22 0 format .", "\" 100000000000000000000\"\n"},
+		{"100000000000000000000 'x 0 0 format .", "\"56bc75e2d63100000\"\n"},
+		{"\"123456789012345678901234567890\" 10 strtol .", "123456789012345678901234567890\n"},
+		{"\"10000000000000000\" 16 strtol .", "18446744073709551616\n"},
+	}
+	newMachine := func() *Machine {
+		m := newMachineWithStdlib(t)
+		loadLib(t, m, "numlib")
+		return m
+	}
+	checkOutputs(t, newMachine, tests)
+
+	// Counts, indexes and character codes must fit in an int64
+	checkErrors(t, NewMachine, []runCase{
+		{"99999999999999999999 [1] times", "times: 99999999999999999999 out of range"},
+		{"99999999999999999999 chr", "chr: 99999999999999999999 out of range"},
+		{"[1 2] 99999999999999999999 at", "at: 99999999999999999999 out of range"},
+		{"[1 2] -99999999999999999999 drop", "drop: -99999999999999999999 out of range"},
+		{"1 'd 99999999999999999999 0 format", "format: 99999999999999999999 out of range"},
+	})
+}
+
+func TestRational(t *testing.T) {
+	tests := []runCase{
+		{"3/4r .", "3/4r\n"},
+		{"-6/8r .", "-3/4r\n"},
+		{"3 4 ratio .", "3/4r\n"},
+		// exact arithmetic, back to an integer when it is whole
+		{"1/2r 1/3r + .", "5/6r\n"},
+		{"0 [1/2r 1/3r 1/6r] [+] fold .", "1\n"},
+		{"1/10r 3 * 3/10r = .", "true\n"},
+		{"1/2r 1 - .", "-1/2r\n"},
+		{"3 1/2r / .", "6\n"},
+		{"2/3r 3/4r / .", "8/9r\n"},
+		{"1/3r succ . 1/3r neg abs .", "4/3r\n1/3r\n"},
+		// floats make it inexact
+		{"1/2r 0.25 + .", "0.75\n"},
+		{"1/4r tofloat .", "0.25\n"},
+		{"0.1 torational .", "1/10r\n"},
+		{"6/8r numerator . 6/8r denominator . 5 denominator .", "3\n4\n1\n"},
+		{"-7/2r floor . -7/2r ceil . -7/2r trunc .", "-4\n-3\n-3\n"},
+		{"1/3r 1/2r < . 1/3r 0.3 > . 1 1/2r > . 1/3r 1/3r compare .", "true\ntrue\ntrue\n0\n"},
+		{"1/3r rational . 3 rational . 1/3r 1/3r sametype .", "true\nfalse\ntrue\n"},
+		{"100000000000000000000 3 ratio 3 * .", "100000000000000000000\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	for _, input := range []string{"1 0 ratio", "1/2r 0 /", "3/0r", "1/2r 2 rem", "\"x\" torational"} {
+		if err := NewMachine().RunLine(input); err == nil {
+			t.Errorf("%s: expected an error", input)
+		}
+	}
+
+	// A rational is no count, index or character code
+	checkErrors(t, NewMachine, []runCase{
+		{"1/2r [1] times", "times: integer expected"},
+		{"1/2r {} cons", "cons: integer expected"},
+		{"{0} 1/2r has", "has: integer expected"},
+		{"1/2r 'd 5 0 format", "format: integer expected"},
+		{"[1 2] 1/2r at", "at: integer expected"},
+	})
+}
+
+func TestComplex(t *testing.T) {
+	tests := []runCase{
+		{"1+2i .", "1+2i\n"},
+		{"2i . -1.5e+20-3i .", "0+2i\n-1.5e+20-3i\n"},
+		{"1.5 -2 complex .", "1.5-2i\n"},
+		{"1+2i 3-1i + . 1+2i 3-1i - . 1+2i 3-1i * .", "4+1i\n-2+3i\n5+5i\n"},
+		{"1+1i 1-1i / .", "0+1i\n"},
+		{"1+2i 1 + . 1+2i 1/2r * .", "2+2i\n0.5+1i\n"},
+		{"-1.0 0 complex sqrt .", "0+1i\n"},
+		{"2i 2 pow re .", "-4.0\n"},
+		{"0+3.141592653589793i exp re .", "-1.0\n"},
+		{"1 0 complex exp log . 0i sin . 0i cos .", "1+0i\n0+0i\n1-0i\n"},
+		{"3+4i re . 3+4i im . 3+4i conj . 3+4i cabs . 2 im .", "3.0\n4.0\n3-4i\n5.0\n0.0\n"},
+		{"-3+4i abs .", "5.0\n"},
+		{"1+2i neg . 1+2i 1+2i = . 1+2i 1-2i = .", "-1-2i\ntrue\nfalse\n"},
+		// the real functions are unchanged
+		{"-1.0 sqrt .", "NaN\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	// Printed values read back the same
+	m := NewMachine()
+	out := captureOutput(m, func() {
+		if err := m.RunLine("1 3 complex sqrt -1e-300 2.5e300 complex .s"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	m.Stdin = strings.NewReader(out)
+	if err := m.RunLine("get"); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.Stack; len(s) != 4 || !s[0].Equal(s[2]) || !s[1].Equal(s[3]) {
+		t.Errorf("round trip of %q: got %s", out, m.PrintStack())
+	}
+	if err := m.RunLine("1+2i 0 /"); err == nil {
+		t.Error("1+2i 0 /: expected division by zero")
+	}
+
+	checkErrors(t, NewMachine, []runCase{
+		{"1+2i 2 rem", "rem: integers expected"},
+		{"7 2i div", "div: integers expected"},
+		{"1+2i {} cons", "cons: integer expected"},
+		{"1+2i [1] times", "times: integer expected"},
+	})
+}
+
+func TestMaps(t *testing.T) {
+	tests := []runCase{
+		{`() . ("one" 1 'c [1 2] {3} foo) .`, "()\n(\"one\" 1 'c [1 2] {3} foo)\n"},
+		{`("a" 1) "b" 2 mput "a" 10 mput .`, "(\"a\" 10 \"b\" 2)\n"},
+		{`("a" 1 "b" 2 "c" 3) "b" mdel . ("a" 1) "z" mdel .`, "(\"a\" 1 \"c\" 3)\n(\"a\" 1)\n"},
+		{`("a" 1 2 "two") dup "a" mget . 2 mget .`, "1\n\"two\"\n"},
+		{`("a" 1) dup "a" mhas . dup 'a mhas . 1.5 mhas .`, "true\nfalse\nfalse\n"},
+		{`("b" 2 "a" 1) dup mkeys . dup mvals . msize .`, "[\"b\" \"a\"]\n[2 1]\n2\n"},
+		{`([1 "x"] 1 {1 100} 2) dup [1 "x"] mget . {1 100} mget .`, "1\n2\n"},
+		// equality ignores order
+		{`("a" 1 "b" 2) ("b" 2 "a" 1) = . ("a" 1) ("a" 2) = .`, "true\nfalse\n"},
+		// entries are [key value] lists
+		{`("a" 1 "b" 2) [.] step`, "[\"a\" 1]\n[\"b\" 2]\n"},
+		{`0 ("a" 1 "b" 2) [rest first +] fold .`, "3\n"},
+		{`("a" 1 "b" 2) [[first] [rest first 10 *] cleave [] cons cons] map .`, "(\"a\" 10 \"b\" 20)\n"},
+		// results that are not pairs form a list
+		{`("a" 1 "b" 2) [rest first] map . ("a" 1) [pop 3] map . () [rest first] map .`, "[1 2]\n[3]\n()\n"},
+		{`("a" 1 "b" 2) [rest first 1 >] filter .`, "(\"b\" 2)\n"},
+		{`("a" 1) dict . [] dict .`, "true\nfalse\n"},
+		// maps grown from one map do not see each other's keys
+		{`("a" 1) dup "b" 2 mput swap "c" 3 mput . . ("a" 1) dup "b" 2 mput pop .`,
+			"(\"a\" 1 \"c\" 3)\n(\"a\" 1 \"b\" 2)\n(\"a\" 1)\n"},
+		{`( *x 1) .`, "( *x 1)\n"},
+		{`() null . () small . ("a" 1) null . ("a" 1) small . ("a" 1 "b" 2) small .`,
+			"true\ntrue\nfalse\ntrue\nfalse\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	checkErrors(t, NewMachine, []runCase{
+		{`("a" 1) "b" mget`, `mget: key "b" not found`},
+		{`() 1.5 1 mput`, "mput: unhashable key 1.5"},
+		{`(1.5 1)`, "unhashable map key 1.5"},
+		{`("a" 1 "b")`, `map key "b" has no value`},
+		{`("a" 1) [[1.5 1]] map`, "map: unhashable key 1.5"},
+		{`[] "a" mget`, "mget: map expected"},
+	})
+}
+
+func TestBytes(t *testing.T) {
+	tests := []runCase{
+		{`"héllo" tobytes . [0 255 10] tobytes .`, "b\"héllo\"\nb\"\\x00\\xff\\n\"\n"},
+		{`"héllo" tobytes dup size . dup 1 at . 1 swap of .`, "6\n195\n195\n"},
+		{`"héllo" tobytes dup 2 take . 3 drop .`, "b\"h\\xc3\"\nb\"llo\"\n"},
+		{`"ab" tobytes "c" tobytes concat bytestr . [1 2] tobytes bytelist .`, "\"abc\"\n[1 2]\n"},
+		{`"a" tobytes "b" tobytes < . "a" tobytes [97] tobytes = . "" tobytes bytes .`, "true\ntrue\ntrue\n"},
+		{`"" tobytes null . "" tobytes small . "a" tobytes null . "a" tobytes small . "ab" tobytes small .`,
+			"true\ntrue\nfalse\ntrue\nfalse\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	checkErrors(t, NewMachine, []runCase{
+		{`[255] tobytes bytestr`, "bytestr: invalid UTF-8"},
+		{`[256] tobytes`, "tobytes: byte expected, got 256"},
+		{`"a" bytelist`, "bytelist: byte string expected"},
+		{`stdin 99999999999999999999 freadb`, "freadb: 99999999999999999999 out of range"},
+	})
+
+	// Binary data round-trips through a file
+	path := t.TempDir() + "/bytes.bin"
+	m := NewMachine()
+	if err := m.RunLine(fmt.Sprintf(`"%s" "w" fopen [0 1 255 10 65] tobytes fwriteb "x\n" tobytes fwriteb fclose`, path)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	out := captureOutput(m, func() {
+		if err := m.RunLine(fmt.Sprintf(`"%s" "r" fopen 2 freadb . fgetsb . fgetsb . 10 freadb . fclose`, path)); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	})
+	want := "b\"\\x00\\x01\"\nb\"\\xff\\n\"\nb\"Ax\\n\"\nb\"\"\n"
+	if out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	const decl = "DEFINE RECORD point x y END; RECORD empty END. "
+	tests := []runCase{
+		{"1 2 point .", "point{x: 1 y: 2}\n"},
+		{"1 2 point dup point.x . point.y .", "1\n2\n"},
+		{"1 2 point dup 10 point-x! . .", "point{x: 10 y: 2}\npoint{x: 1 y: 2}\n"},
+		{"1 2 point point? . [1 2] point? . empty empty? . empty point? .", "true\nfalse\ntrue\nfalse\n"},
+		{"1 2 point 1 2 point = . 1 2 point 1 3 point = . empty [] = .", "true\nfalse\nfalse\n"},
+		{"1 2 point 1 3 point < . 3 4 point 1 2 point [] cons cons sort .", "true\n[point{x: 1 y: 2} point{x: 3 y: 4}]\n"},
+		{"1 2 point typeof . empty typeof .", "point\nempty\n"},
+		// declaring the same record again keeps its values valid
+		{"1 2 point DEFINE RECORD point x y END. point.y .", "2\n"},
+		{"DEFINE RECORD q a END; f == q.a 1 + . 41 q f .", "42\n"},
+		// records in HIDE and MODULE are named like the definitions there
+		{"HIDE f == pt.a; RECORD pt a END IN g == pt f END 7 g .", "7\n"},
+		{"MODULE geo PRIVATE PUBLIC RECORD point x y z END END 1 2 3 geo.point dup geo.point.z . .",
+			"3\npoint{x: 1 y: 2 z: 3}\n"},
+		{"MODULE geo PRIVATE RECORD v a END PUBLIC mk == v; get == v.a END 5 geo.mk geo.get . 1 2 point point? .",
+			"5\ntrue\n"},
+	}
+	newMachine := func() *Machine {
+		m := NewMachine()
+		if err := m.RunLine(decl); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	checkOutputs(t, newMachine, tests)
+
+	checkErrors(t, newMachine, []runCase{
+		{"3 point.x", "point.x: point expected"},
+		{"empty 1 point-y!", "point-y!: point expected"},
+		{"1 point", "point: expected 2 parameters, got 1"},
+		{"DEFINE RECORD p x x END.", "RECORD p: duplicate field x"},
+		{"DEFINE RECORD dup x END.", "RECORD dup: name is a builtin"},
+		{"DEFINE RECORD p x 1 END.", "expected END for RECORD p"},
+		{"HIDE RECORD pt a END IN g == pt END 1 pt", "undefined: pt"},
+		{"MODULE geo PRIVATE RECORD v a END PUBLIC mk == v END 1 v", "undefined: v"},
+	})
+}
+
+func TestRuneStrings(t *testing.T) {
+	tests := []runCase{
+		{`"héllo" size . "" size .`, "5\n0\n"},
+		{`"héllo" 1 at . 1 "héllo" of . "héllo" first . "héllo" rest .`, "'é\n'é\n'h\n\"éllo\"\n"},
+		{`"héllo" 2 take . "héllo" 2 drop . "héllo" 9 take . "héllo" 9 drop .`, "\"hé\"\n\"llo\"\n\"héllo\"\n\"\"\n"},
+		{`"héllo" uncons . . "héllo" reverse .`, "\"éllo\"\n'h\n\"olléh\"\n"},
+		{`"é" small . "éa" small .`, "true\nfalse\n"},
+		{`"héllo" [succ] map . "héllo" ['l !=] filter .`, "\"iêmmp\"\n\"héo\"\n"},
+		{`"héllo" ['l <] split . .`, "\"éllo\"\n\"h\"\n"},
+		{`0 "héllo" [pop succ] step .`, "5\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	// Long strings, indexed through the machine's rune index
+	m := NewMachine()
+	long := strings.Repeat("aé", 100)
+	ascii := strings.Repeat("ab", 100)
+	out := captureOutput(m, func() {
+		src := fmt.Sprintf(`"%s" "%s" dup size . dup 199 at . swap dup size . dup 199 at . swap 150 take size . dup 151 take size . 151 drop size .`, long, ascii)
+		if err := m.RunLine(src); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if want := "200\n'b\n200\n'é\n150\n151\n49\n"; out != want {
+		t.Errorf("long strings: got %q, want %q", out, want)
+	}
+
+	// Strings used in turn keep their indexes; more of them than the
+	// machine holds are indexed again
+	m = NewMachine()
+	words := []string{long, strings.Repeat("éb", 100), strings.Repeat("ü", 99) + "x", long[1:], ascii}
+	var src, want strings.Builder
+	for _, i := range []int{0, 31, 32, 63, 64, 65, 99} {
+		for _, w := range append(words, words...) {
+			fmt.Fprintf(&src, `"%s" %d at putch `, w, i)
+			want.WriteRune([]rune(w)[i])
+		}
+	}
+	out = captureOutput(m, func() {
+		if err := m.RunLine(src.String()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if out != want.String() {
+		t.Errorf("strings in turn: got %q, want %q", out, want.String())
+	}
+}
+
+func TestRegexp(t *testing.T) {
+	tests := []runCase{
+		{`"hello world" "o w" rematch . "hello world" "^w" rematch .`, "true\nfalse\n"},
+		{`"a1b22c333" "[0-9]+" refind . "abc" "[0-9]" refind .`, "\"1\"\n\"\"\n"},
+		{`"a1b22c333" "[0-9]+" refindall . "abc" "[0-9]" refindall .`, "[\"1\" \"22\" \"333\"]\n[]\n"},
+		{`"key=val" "(\\w+)=(\\w+)" resubmatch . "x" "(y)?x" resubmatch . "x" "=" resubmatch .`,
+			"[\"key=val\" \"key\" \"val\"]\n[\"x\" \"\"]\n[]\n"},
+		{`"john smith" "(\\w+) (\\w+)" "$2 $1" rereplace . "a-b" "-" "+" rereplace .`, "\"smith john\"\n\"a+b\"\n"},
+		{`"a, b,c" ",\\s*" resplit .`, "[\"a\" \"b\" \"c\"]\n"},
+		{`"abc" "" "-" rereplace . "a.b" "\\." "[$0]" rereplace . "ab" "x*" "${1}" rereplace .`, "\"-a-b-c-\"\n\"a[.]b\"\n\"ab\"\n"},
+		{`["ab1" "c" "d23"] ["[0-9]" rematch] filter .`, "[\"ab1\" \"d23\"]\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	m := NewMachine()
+	if err := m.RunLine(`"x" "(" rematch`); err == nil || err.Error() != "rematch: error parsing regexp: missing closing ): `(`" {
+		t.Errorf("invalid pattern: got error %v", err)
+	}
+	if err := m.RunLine(`"x" 1 refind`); err == nil || err.Error() != "refind: string and pattern expected" {
+		t.Errorf("non-string pattern: got error %v", err)
+	}
+
+	// Patterns are compiled once per machine
+	if err := m.RunLine(`["a" "b" "c"] ["[ab]" rematch] map pop`); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.regexps) != 1 {
+		t.Errorf("got %d compiled patterns, want 1", len(m.regexps))
+	}
+}
+
+func TestStringLibrary(t *testing.T) {
+	tests := []runCase{
+		{`"a,b,,c" "," strsplit . "hé" "" strsplit .`, "[\"a\" \"b\" \"\" \"c\"]\n[\"h\" \"é\"]\n"},
+		{`["a" "b" "c"] ", " strjoin . [] "-" strjoin .`, "\"a, b, c\"\n\"\"\n"},
+		{`"  hi there \n" strtrim .`, "\"hi there\"\n"},
+		{`"héllo" strupper . "HÉLLO" strlower .`, "\"HÉLLO\"\n\"héllo\"\n"},
+		{`"héllo" "l" strindex . "héllo" "z" strindex . "abc" "" strindex .`, "2\n-1\n0\n"},
+		{`"a.b.c" "." "::" strreplace .`, "\"a::b::c\"\n"},
+		{`"hello" "he" startswith . "hello" "lo" startswith . "hello" "lo" endswith .`, "true\nfalse\ntrue\n"},
+		{`"ab" 3 strrepeat . "" 5 strrepeat . "ab" 0 strrepeat .`, "\"ababab\"\n\"\"\n\"\"\n"},
+		{`"42" 5 '0 strpad . "é" -3 '. strpad . "long" 2 'x strpad .`, "\"00042\"\n\"é..\"\n\"long\"\n"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	checkErrors(t, NewMachine, []runCase{
+		{`"a" 1 strsplit`, "strsplit: two strings expected"},
+		{`["a" 1] "" strjoin`, "strjoin: list of strings expected"},
+		{`"ab" -1 strrepeat`, "strrepeat: non-negative integer expected"},
+		{`"ab" 99999999999999 strrepeat`, "strrepeat: result too long"},
+		{`3 strupper`, "strupper: string expected"},
+	})
+
+	m := NewMachine()
+	m.MaxStringLen = 10
+	err := m.RunLine(`"abc" 4 strrepeat`)
+	if je, ok := err.(JoyError); !ok || je.Kind != ErrLimit {
+		t.Errorf("strrepeat past MaxStringLen: got %v, want a limit error", err)
+	}
+}
+
+func TestPrintf(t *testing.T) {
+	tests := []runCase{
+		{`"x=%d y=%.3f" [3 2.5] sprintf .`, "\"x=3 y=2.500\"\n"},
+		{`"%5d|%-5d|%05d|%+d|%x|%X|%o|%b|%#x" [42 42 42 42 255 255 8 5 255] sprintf .`,
+			"\"   42|42   |00042|+42|ff|FF|10|101|0xff\"\n"},
+		{`"%s|%6s|%-4s|%.2s|%c|%c|%%" ["hi" "right" 'a "abcdef" 'é 65] sprintf .`,
+			"\"hi| right|a   |ab|é|A|%\"\n"},
+		{`"%v %v %v %4v" [[1 "a"] 1/2r "s" 7] sprintf .`, "\"[1 \\\"a\\\"] 1/2r \\\"s\\\"    7\"\n"},
+		{`"%e %g %8.2f %.1f" [12345.678 0.0001 3 1/4r] sprintf .`, "\"1.234568e+04 0.0001     3.00 0.2\"\n"},
+		{`"%d %x" [100000000000000000000000 "hi"] sprintf .`, "\"100000000000000000000000 6869\"\n"},
+		{`"n=%d\n" [7] printf "no verbs" [] printf`, "n=7\nno verbs"},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	checkErrors(t, NewMachine, []runCase{
+		{`"%d %d" [1] sprintf`, "sprintf: missing argument for %d"},
+		{`"%d" [1 2] printf`, "printf: 2 arguments but the format uses 1"},
+		{`"%d" ["a"] sprintf`, `sprintf: %d expects an integer, got "a"`},
+		{`"%f" [1+2i] sprintf`, "sprintf: %f expects a real number, got 1+2i"},
+		{`"%s" [[1]] sprintf`, "sprintf: %s expects a string, got [1]"},
+		{`"%q" [1] sprintf`, "sprintf: unknown verb %q"},
+		{`"%é" [1] sprintf`, "sprintf: unknown verb %é"},
+		{`"%5é" [1] sprintf`, "sprintf: unknown verb %5é"},
+		{`"abc%5" [] sprintf`, `sprintf: incomplete verb "%5" at end of format`},
+		{`"%99999999d" [1] sprintf`, "sprintf: width or precision 99999999 too large"},
+		{`"%d" 1 sprintf`, "sprintf: format string and list expected"},
+	})
+}
+
+func TestJSON(t *testing.T) {
+	tests := []runCase{
+		{`"{\"b\": [1, 2.5, -3e2, true, null, \"x\\u00e9\"], \"a\": {}}" json> .`,
+			"(\"b\" [1 2.5 -300.0 true null \"xé\"] \"a\" ())\n"},
+		{`"123456789012345678901234" json> . " [] " json> . "\"\"" json> .`, "123456789012345678901234\n[]\n\"\"\n"},
+		{`"{\"a\": 1, \"a\": 2}" json> "a" mget .`, "2\n"},
+		{`"[null]" json> [null] = .`, "true\n"},
+		{`[1 2.0 "a<b" 'c false {2 3} ("k" [])] >json .`, "\"[1,2.0,\\\"a<b\\\",\\\"c\\\",false,[2,3],{\\\"k\\\":[]}]\"\n"},
+		{`DEFINE RECORD p x y END. 1 "v" p >json .`, "\"{\\\"x\\\":1,\\\"y\\\":\\\"v\\\"}\"\n"},
+		{`("a" [1 null]) >jsonpretty putchars`, "{\n  \"a\": [\n    1,\n    null\n  ]\n}"},
+		// text round-trips
+		{`"{\"z\":[1,{\"y\":null}],\"x\":-0.5}" json> >json putchars`, `{"z":[1,{"y":null}],"x":-0.5}`},
+	}
+	checkOutputs(t, NewMachine, tests)
+
+	checkErrors(t, NewMachine, []runCase{
+		{`"[1, 2" json>`, "json>: unexpected end of JSON input at byte 5"},
+		{`"[1 2]" json>`, "json>: invalid character '2' after array element at byte 3"},
+		{`"{1: 2}" json>`, "json>: object member name must be a string at byte 1"},
+		{`"[1]  2" json>`, "json>: unexpected data after the value at byte 5"},
+		{`"" json>`, "json>: unexpected end of JSON input at byte 0"},
+		{`1/2r >json`, ">json: cannot encode 1/2r"},
+		{`(1 2) >json`, ">json: object key 1 is not a string"},
+		{`foo >json`, "undefined: foo"},
+		{`[foo] >json`, ">json: cannot encode foo"},
+	})
+}
+
+func ExampleMachine() {
+	m := NewMachine()
+	if err := m.RunFile("inilib.joy"); err != nil {
+		panic(err)
+	}
+	if err := m.RunSource("3 4 + sqr"); err != nil {
+		panic(err)
+	}
+	fmt.Println(m.Pop())
+	// Output: 49
+}
+
 // Silence unused import warning for fmt
 var _ = fmt.Sprint
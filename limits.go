@@ -0,0 +1,126 @@
+package joy
+
+import (
+	"math"
+	"math/big"
+	"unsafe"
+)
+
+// pollInterval is how many steps run between context and quota checks.
+const pollInterval = 1024
+
+// tick counts one instruction and polls the context and limits when due.
+// It is called for every value Execute dispatches.
+func (m *Machine) tick() {
+	m.Steps++
+	if m.Steps >= m.nextPoll {
+		m.poll()
+	}
+}
+
+func (m *Machine) poll() {
+	if m.ctx != nil {
+		if err := m.ctx.Err(); err != nil {
+			joyErrKind(ErrCancelled, "cancelled: %v", err)
+		}
+	}
+	if m.MaxSteps > 0 && m.Steps > m.MaxSteps {
+		joyErrKind(ErrBudget, "budget exhausted: %d steps", m.MaxSteps)
+	}
+	// Builtins such as unstack and infra replace the stack wholesale
+	if m.MaxStack > 0 && len(m.Stack) > m.MaxStack {
+		m.stackLimit()
+	}
+	if m.MaxBytes > 0 && m.Steps >= m.nextMem {
+		// Measuring walks the whole stack, so wait at least as many steps
+		// as values were visited before measuring again.
+		size, visited := m.stackBytes()
+		if size > m.MaxBytes {
+			joyErrKind(ErrLimit, "memory limit exceeded (MaxBytes %d)", m.MaxBytes)
+		}
+		m.nextMem = m.Steps + max(pollInterval, visited)
+	}
+	m.resetPoll()
+}
+
+// resetPoll schedules the next poll: never when nothing is being
+// enforced, otherwise after pollInterval steps or when the budget runs out.
+func (m *Machine) resetPoll() {
+	m.nextPoll = math.MaxInt64
+	if m.ctx != nil || m.MaxStack > 0 || m.MaxBytes > 0 {
+		m.nextPoll = m.Steps + pollInterval
+	}
+	if m.MaxSteps > 0 && m.MaxSteps+1 < m.nextPoll {
+		m.nextPoll = m.MaxSteps + 1
+	}
+}
+
+func (m *Machine) stackLimit() {
+	joyErrKind(ErrLimit, "stack height limit exceeded (MaxStack %d)", m.MaxStack)
+}
+
+// checkList raises an ErrLimit error if name would build a list of n
+// elements and that exceeds MaxListLen.
+func (m *Machine) checkList(name string, n int) {
+	if m.MaxListLen > 0 && n > m.MaxListLen {
+		joyErrKind(ErrLimit, "%s: list length limit exceeded (MaxListLen %d)", name, m.MaxListLen)
+	}
+}
+
+// checkString is checkList for strings and MaxStringLen.
+func (m *Machine) checkString(name string, n int) {
+	if m.MaxStringLen > 0 && n > m.MaxStringLen {
+		joyErrKind(ErrLimit, "%s: string length limit exceeded (MaxStringLen %d)", name, m.MaxStringLen)
+	}
+}
+
+// checkBytes raises an ErrLimit error if name would build a single value
+// of n bytes, more than MaxBytes allows for the whole stack. The sampled
+// check in poll would catch it too, but only after the value was built.
+func (m *Machine) checkBytes(name string, n int64) {
+	if m.MaxBytes > 0 && n > m.MaxBytes {
+		joyErrKind(ErrLimit, "%s: memory limit exceeded (MaxBytes %d)", name, m.MaxBytes)
+	}
+}
+
+const valueSize = int64(unsafe.Sizeof(Value{}))
+
+const wordSize = int64(unsafe.Sizeof(big.Word(0)))
+
+// stackBytes approximates the memory reachable from the stack, counting
+// each list backing array once however many values share it, plus the
+// continuation stack. It stops
+// early once MaxBytes is exceeded. It also returns how many values it
+// visited.
+func (m *Machine) stackBytes() (size, visited int64) {
+	size = int64(len(m.vframes)) * frameBytes
+	seen := map[*Value]bool{}
+	var walk func(vs []Value)
+	walk = func(vs []Value) {
+		for i := range vs {
+			if size > m.MaxBytes {
+				return
+			}
+			v := &vs[i]
+			visited++
+			size += valueSize + int64(len(v.Str)) + int64(len(v.Bytes()))
+			if b := v.Big(); b != nil {
+				size += int64(len(b.Bits())) * wordSize
+			}
+			if r := v.Rat(); r != nil {
+				size += int64(len(r.Num().Bits())+len(r.Denom().Bits())) * wordSize
+			}
+			if (v.Typ == TypeList || v.Typ == TypeRecord) && len(v.List) > 0 && !seen[&v.List[0]] {
+				seen[&v.List[0]] = true
+				walk(v.List)
+			}
+			if d := v.Map(); d != nil && d.Len() > 0 && !seen[&d.keys[0]] {
+				seen[&d.keys[0]] = true
+				walk(d.keys)
+				walk(d.vals)
+			}
+		}
+	}
+	walk(m.Stack)
+	return size, visited
+}
@@ -1,43 +1,139 @@
-package main
+package joy
 
 import (
-	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
 type Machine struct {
 	Stack      []Value
-	Dict       map[string][]Value
-	Autoput    int              // 0=off, 1=. (print top), 2=.. (print stack)
-	Echo       int              // 0=off, 1=on (echo input lines)
-	UndefError int              // 0=error on undefined, 1=ignore
-	ScopeID    int              // counter for HIDE/IN/END scope name mangling
-	LibPaths   []string         // search directories for .joy files
-	Included   map[string]bool  // include guard (resolved path → loaded)
-	Input      *bufio.Scanner   // input scanner for get builtin
-	Depth      int              // current recursion depth
-	MaxDepth   int              // maximum recursion depth (0 = use default)
+	Dict       map[string][]Value     // Deprecated: a copy of what Define set; use Lookup
+	Builtins   map[string]BuiltinFunc // primitives the parser resolves atoms against; see Register
+	Autoput    int                    // 0=off, 1=. (print top), 2=.. (print stack)
+	Echo       int                    // 0=off, 1=on (echo input lines)
+	UndefError int                    // 0=error on undefined, 1=ignore
+	ScopeID    int                    // counter for HIDE/IN/END scope name mangling
+	LibPaths   []string               // search directories for .joy files
+	Included   map[string]bool        // include guard (resolved path → loaded)
+
+	Capabilities Capabilities // host facilities builtins may use (NewMachine: CapAll)
+	IncludeDirs  []string     // directories include may read without CapInclude
+	Stdin        io.Reader    // read by get and the stdin file value
+	Stdout       io.Writer    // written by put, ., .s, newline, help, ...
+	Stderr       io.Writer    // returned by the stderr file value
+	Depth        int          // frames on the continuation stack
+	MaxDepth     int          // maximum Depth (0 = bounded by MaxFrameBytes only)
+	MaxSteps     int64        // instruction budget per run (0 = unlimited)
+	Steps        int64        // instructions executed by the current run
+
+	// Size quotas (0 = unlimited). Exceeding one raises an ErrLimit error.
+	MaxStack     int   // data stack height
+	MaxListLen   int   // elements in a list built by a builtin
+	MaxStringLen int   // bytes in a string built by a builtin
+	MaxBytes     int64 // approximate bytes reachable from the stack, sampled while running
+
+	// MaxFrameBytes bounds the memory of the continuation stack, and so how
+	// deep programs may recurse (0 = 128 MiB). Exceeding it raises an
+	// ErrLimit error.
+	MaxFrameBytes int64
+
+	stdin, stdout, stderr *Stream // file values wrapping Stdin, Stdout, Stderr
+	frames                []Frame // user definitions being evaluated, outermost first
+	cur                   *Value  // program value being executed (nil = none)
+
+	codes     map[codeKey]*code // compiled programs
+	recent    [256]recentCode   // codes most recently looked up
+	defs      map[string]*Def   // definition cells of user words, defined or not
+	vframes   []frame           // the continuation stack; see exec
+	level     execLevel         // where the innermost exec started
+	marks     []stackMark       // see mark
+	held      []Value           // values set aside by hold
+	maxFrames int               // frames allowed by MaxDepth and MaxFrameBytes; see checkFrames
+	floor     int               // the highest floor of marks; see modify
+	runes     runeCache         // rune offsets of the long strings indexed last
+
+	running  bool            // a Run* call is in progress
+	ctx      context.Context // checked every pollInterval steps (nil = none)
+	nextPoll int64           // value of Steps at which poll runs next
+	nextMem  int64           // value of Steps at which MaxBytes is checked next
+
+	regexps map[string]*regexp.Regexp // compiled patterns; see regexp
 }
 
 func NewMachine() *Machine {
 	return &Machine{
+		nextPoll: math.MaxInt64,
 		Stack:    make([]Value, 0, 256),
 		Dict:     make(map[string][]Value),
+		Builtins: defaultBuiltins(),
+		Stdin:    os.Stdin,
+		Stdout:   os.Stdout,
+		Stderr:   os.Stderr,
 		Included: make(map[string]bool),
+
+		Capabilities: CapAll,
+	}
+}
+
+// def returns the machine's cell for name, creating an undefined one.
+func (m *Machine) def(name string) *Def {
+	d, ok := m.defs[name]
+	if !ok {
+		if m.defs == nil {
+			m.defs = make(map[string]*Def)
+		}
+		d = &Def{Name: name}
+		m.defs[name] = d
+	}
+	return d
+}
+
+// userDef returns a reference to the user word name bound to its cell.
+func (m *Machine) userDef(name string) Value {
+	return Value{Typ: TypeUserDef, Str: name, ref: m.def(name)}
+}
+
+// Define sets the body of a user word, as DEFINE does. It also records the
+// body in Dict for hosts that still read it there; running code and Lookup
+// do not consult Dict, so writing to it has no effect.
+func (m *Machine) Define(name string, body []Value) {
+	if m.Dict != nil {
+		m.Dict[name] = body
 	}
+	d := m.def(name)
+	d.Body, d.Defined, d.code = body, true, nil
+}
+
+// Lookup returns the body of the user word name and whether it is
+// defined.
+func (m *Machine) Lookup(name string) ([]Value, bool) {
+	d, ok := m.defs[name]
+	if !ok || !d.Defined {
+		return nil, false
+	}
+	return d.Body, true
 }
 
 func (m *Machine) Push(v Value) {
+	if m.MaxStack > 0 && len(m.Stack) >= m.MaxStack {
+		m.stackLimit()
+	}
 	m.Stack = append(m.Stack, v)
 }
 
 func (m *Machine) Pop() Value {
 	n := len(m.Stack)
 	if n == 0 {
-		joyErr("stack underflow")
+		joyErrKind(ErrUnderflow, "stack underflow")
+	}
+	if n-1 < m.floor {
+		m.saveBelow(n - 1)
 	}
 	v := m.Stack[n-1]
 	m.Stack = m.Stack[:n-1]
@@ -47,89 +143,102 @@ func (m *Machine) Pop() Value {
 func (m *Machine) Peek() Value {
 	n := len(m.Stack)
 	if n == 0 {
-		joyErr("stack underflow")
+		joyErrKind(ErrUnderflow, "stack underflow")
 	}
 	return m.Stack[n-1]
 }
 
+// NeedStack checks that the stack holds at least n values. Builtins call
+// it before they change the top n values in place, which it allows for.
 func (m *Machine) NeedStack(n int, name string) {
 	if len(m.Stack) < n {
-		joyErr("%s: expected %d parameters, got %d", name, n, len(m.Stack))
-	}
-}
-
-const defaultMaxDepth = 10000
-
-func (m *Machine) maxDepth() int {
-	if m.MaxDepth > 0 {
-		return m.MaxDepth
+		joyErrKind(ErrUnderflow, "%s: expected %d parameters, got %d", name, n, len(m.Stack))
 	}
-	return defaultMaxDepth
+	m.modify(len(m.Stack) - n)
 }
 
+// Execute runs program on the machine. The program is compiled on first
+// use; see exec.
 func (m *Machine) Execute(program []Value) {
-	m.Depth++
-	if m.Depth > m.maxDepth() {
-		m.Depth--
-		joyErr("recursion depth exceeded (%d)", m.maxDepth())
-	}
-	defer func() { m.Depth-- }()
-
-	for {
-		for i, v := range program {
-			switch v.Typ {
-			case TypeBuiltin:
-				v.Fn(m)
-			case TypeUserDef:
-				body, ok := m.Dict[v.Str]
-				if !ok {
-					joyErr("undefined: %s", v.Str)
-				}
-				if i == len(program)-1 {
-					// Tail-call optimization: reuse loop instead of recursing
-					program = body
-					goto tailcall
-				}
-				m.Execute(body)
-			default:
-				// literal — push onto stack
-				m.Push(v)
-			}
-		}
-		return
-	tailcall:
-	}
+	m.exec(m.compile(program))
 }
 
-func (m *Machine) RunSafe(program []Value) (err error) {
+// run calls fn, converting a panic into the returned error. The outermost
+// call starts a fresh step count; a non-nil ctx is polled while fn runs.
+// A JoyError is completed by annotate.
+func (m *Machine) run(ctx context.Context, fn func()) (err error) {
+	base, cur := len(m.frames), m.cur
+	if !m.running {
+		m.running = true
+		m.Steps = 0
+		m.nextMem = 0
+		defer func() { m.running = false }()
+	}
+	if ctx != nil {
+		prev := m.ctx
+		m.ctx = ctx
+		defer func() { m.ctx = prev; m.resetPoll() }()
+	}
+	m.resetPoll()
 	defer func() {
 		if r := recover(); r != nil {
 			if je, ok := r.(JoyError); ok {
-				err = je
+				err = m.annotate(je)
 			} else {
 				err = fmt.Errorf("%v", r)
 			}
+			m.frames, m.cur = m.frames[:base], cur
 		}
 	}()
-	m.Execute(program)
+	fn()
 	return nil
 }
 
-// RunLine parses and executes a single line of Joy source.
-func (m *Machine) RunLine(line string) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if je, ok := r.(JoyError); ok {
-				err = je
-			} else {
-				err = fmt.Errorf("%v", r)
-			}
+// annotate fills in what a raised JoyError does not carry itself: the
+// frames active when it was raised as its Trace and, unless the parser set
+// them, the position and name of the word that raised it.
+func (m *Machine) annotate(je JoyError) JoyError {
+	if je.Trace == nil {
+		je.Trace = m.trace()
+	}
+	if v := m.cur; v != nil {
+		if pos := v.Pos(); je.Line == 0 && pos != nil {
+			je.File, je.Line, je.Col = pos.File, pos.Line, pos.Col
 		}
-	}()
-	tokens := NewScanner(line).ScanAll()
-	program := NewParser(tokens, m).Parse()
-	m.Execute(program)
-	return nil
+		if je.Word == "" && (v.Typ == TypeBuiltin || v.Typ == TypeUserDef) {
+			je.Word = demangle(v.Str)
+		}
+	}
+	return je
+}
+
+func (m *Machine) RunSafe(program []Value) error {
+	return m.run(nil, func() { m.Execute(program) })
+}
+
+// RunContext executes program until it finishes, ctx is done or MaxSteps
+// instructions have run. An aborted run returns a JoyError of kind
+// ErrCancelled or ErrBudget; the machine stays usable afterwards.
+func (m *Machine) RunContext(ctx context.Context, program []Value) error {
+	return m.run(ctx, func() { m.Execute(program) })
+}
+
+// Parse parses Joy source, entering its definitions into the dictionary,
+// and returns the remaining program without running it.
+func (m *Machine) Parse(source string) (program []Value, err error) {
+	err = m.run(nil, func() {
+		program = NewParser(NewScanner(source).ScanAll(), m).Parse()
+	})
+	return program, err
+}
+
+// RunLine parses and executes a single line of Joy source.
+func (m *Machine) RunLine(line string) error {
+	return m.run(nil, func() {
+		tokens := NewScanner(line).ScanAll()
+		program := NewParser(tokens, m).Parse()
+		m.Execute(program)
+	})
 }
 
 // RunSource parses and executes a complete Joy source string.
@@ -137,9 +246,24 @@ func (m *Machine) RunSource(source string) error {
 	return m.RunLine(source)
 }
 
+// RunSourceFile is RunSource for source read from file; positions in
+// errors name that file.
+func (m *Machine) RunSourceFile(file, source string) error {
+	return m.run(nil, func() {
+		tokens := NewFileScanner(file, source).ScanAll()
+		program := NewParser(tokens, m).Parse()
+		m.Execute(program)
+	})
+}
+
 // ReadFile searches for a Joy source file and returns its contents.
 // Search order: absolute/relative path, current dir, LibPaths, embedded FS.
+// Without CapInclude only IncludeDirs and the embedded FS are searched.
 func (m *Machine) ReadFile(name string) ([]byte, string, error) {
+	if m.Capabilities&CapInclude == 0 {
+		return m.readAllowed(name)
+	}
+
 	// Absolute or relative path — try directly
 	if filepath.IsAbs(name) || strings.HasPrefix(name, ".") {
 		data, err := os.ReadFile(name)
@@ -174,6 +298,36 @@ func (m *Machine) ReadFile(name string) ([]byte, string, error) {
 	return nil, "", fmt.Errorf("cannot find %s", name)
 }
 
+// readAllowed is ReadFile for machines without CapInclude. The name must be
+// a local path; it is opened through os.Root so neither ".." nor symlinks
+// can escape an IncludeDirs entry.
+func (m *Machine) readAllowed(name string) ([]byte, string, error) {
+	if !filepath.IsLocal(name) {
+		return nil, "", fmt.Errorf("cannot read %s: %w", name, errPermission)
+	}
+	for _, dir := range m.IncludeDirs {
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			continue
+		}
+		f, err := root.Open(name)
+		root.Close()
+		if err != nil {
+			continue
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err == nil {
+			abs, _ := filepath.Abs(filepath.Join(dir, name))
+			return data, abs, nil
+		}
+	}
+	if data, err := readEmbeddedLib(name); err == nil {
+		return data, "embedded:" + name, nil
+	}
+	return nil, "", fmt.Errorf("cannot find %s", name)
+}
+
 // RunFile reads and executes a Joy source file with include guard.
 func (m *Machine) RunFile(path string) error {
 	data, resolved, err := m.ReadFile(path)
@@ -184,7 +338,7 @@ func (m *Machine) RunFile(path string) error {
 		return nil // already included
 	}
 	m.Included[resolved] = true
-	return m.RunSource(string(data))
+	return m.RunSourceFile(resolved, string(data))
 }
 
 // PrintStack prints the current stack (bottom to top).
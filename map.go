@@ -0,0 +1,222 @@
+package joy
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A Map is an immutable dictionary from hashable values to values, which
+// keeps its entries in the order their keys were first added. Booleans,
+// chars, integers, rationals, strings, byte strings, symbols and sets are
+// hashable, and so are lists of hashable values.
+//
+// Maps built from one another by adding keys share their entries: a Map
+// is a prefix of a table that only grows, so adding a key to the newest
+// map of a table appends to it in place. Any other change copies it.
+type Map struct {
+	keys []Value
+	vals []Value
+	t    *mapTable
+}
+
+type mapTable struct {
+	index map[string]int // hash key -> entry, for every map of the table
+}
+
+func mapVal(d *Map) Value {
+	return Value{Typ: TypeMap, ref: d}
+}
+
+func newMap(n int) *Map {
+	return &Map{
+		keys: make([]Value, 0, n),
+		vals: make([]Value, 0, n),
+		t:    &mapTable{index: make(map[string]int, n)},
+	}
+}
+
+// Len returns the number of entries of d.
+func (d *Map) Len() int {
+	return len(d.keys)
+}
+
+// find returns the entry of the key with hash key h.
+func (d *Map) find(h string) (int, bool) {
+	i, ok := d.t.index[h]
+	return i, ok && i < len(d.keys)
+}
+
+// Get returns the value of key and whether d has it.
+func (d *Map) Get(key Value) (Value, bool) {
+	h, ok := hashKey(key)
+	if !ok {
+		return Value{}, false
+	}
+	if i, ok := d.find(h); ok {
+		return d.vals[i], true
+	}
+	return Value{}, false
+}
+
+// put returns d with key, whose hash key is h, set to val.
+func (d *Map) put(h string, key, val Value) *Map {
+	if i, ok := d.find(h); ok {
+		e := d.clone(d.Len())
+		e.vals[i] = val
+		return e
+	}
+	e := d
+	if len(d.t.index) != d.Len() {
+		// A newer map of the table has added keys after ours
+		e = d.clone(d.Len() + 1)
+	}
+	e.t.index[h] = e.Len()
+	return &Map{keys: append(e.keys, key), vals: append(e.vals, val), t: e.t}
+}
+
+// del returns d without the key with hash key h.
+func (d *Map) del(h string) *Map {
+	i, ok := d.find(h)
+	if !ok {
+		return d
+	}
+	e := newMap(d.Len() - 1)
+	for j := range d.keys {
+		if j != i {
+			k, _ := hashKey(d.keys[j])
+			e.t.index[k] = e.Len()
+			e.keys = append(e.keys, d.keys[j])
+			e.vals = append(e.vals, d.vals[j])
+		}
+	}
+	return e
+}
+
+// clone copies d to a new table with room for n entries.
+func (d *Map) clone(n int) *Map {
+	e := newMap(n)
+	e.keys = append(e.keys, d.keys...)
+	e.vals = append(e.vals, d.vals...)
+	for h, i := range d.t.index {
+		if i < d.Len() {
+			e.t.index[h] = i
+		}
+	}
+	return e
+}
+
+// entries returns the entries of d as [key value] lists, in order.
+func (d *Map) entries() []Value {
+	items := make([]Value, d.Len())
+	for i := range d.keys {
+		items[i] = ListVal([]Value{d.keys[i], d.vals[i]})
+	}
+	return items
+}
+
+// mapKey returns the hash key of key, raising an error naming the builtin
+// if it is not hashable.
+func mapKey(name string, key Value) string {
+	h, ok := hashKey(key)
+	if !ok {
+		joyErrKind(ErrType, "%s: unhashable key %s", name, key)
+	}
+	return h
+}
+
+// pairs reports whether every item is a [key value] list that mapOf
+// accepts.
+func pairs(items []Value) bool {
+	for _, item := range items {
+		if item.Typ != TypeList || len(item.List) != 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// mapOf builds a map from [key value] lists such as entries returns.
+func mapOf(name string, items []Value) Value {
+	d := newMap(len(items))
+	for _, item := range items {
+		if item.Typ != TypeList || len(item.List) != 2 {
+			joyErrKind(ErrType, "%s: [key value] pair expected", name)
+		}
+		d = d.put(mapKey(name, item.List[0]), item.List[0], item.List[1])
+	}
+	return mapVal(d)
+}
+
+// hashKey returns a string that is the same for two hashable values if
+// and only if they are Equal.
+func hashKey(v Value) (string, bool) {
+	var b strings.Builder
+	if !writeKey(&b, v) {
+		return "", false
+	}
+	return b.String(), true
+}
+
+func writeKey(b *strings.Builder, v Value) bool {
+	b.WriteByte(byte(v.Typ))
+	switch v.Typ {
+	case TypeBoolean, TypeChar, TypeInteger, TypeSet:
+		if n := v.Big(); n != nil {
+			b.WriteString(n.Text(16))
+		} else {
+			b.WriteString(strconv.FormatInt(v.Int, 16))
+		}
+		b.WriteByte(';')
+	case TypeRational:
+		b.WriteString(v.Rat().String())
+		b.WriteByte(';')
+	case TypeString, TypeBuiltin, TypeUserDef:
+		b.WriteString(strconv.Itoa(len(v.Str)))
+		b.WriteByte(':')
+		b.WriteString(v.Str)
+	case TypeBytes:
+		b.WriteString(strconv.Itoa(len(v.Bytes())))
+		b.WriteByte(':')
+		b.Write(v.Bytes())
+	case TypeList:
+		b.WriteString(strconv.Itoa(len(v.List)))
+		b.WriteByte(':')
+		for _, item := range v.List {
+			if !writeKey(b, item) {
+				return false
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// equal reports whether d and e have the same keys with equal values, in
+// whatever order.
+func (d *Map) equal(e *Map) bool {
+	if d.Len() != e.Len() {
+		return false
+	}
+	for i, key := range d.keys {
+		val, ok := e.Get(key)
+		if !ok || !val.Equal(d.vals[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// String writes d as the literal the parser reads back, keys and values
+// alternating between parentheses.
+func (d *Map) String() string {
+	parts := make([]string, 0, 2*d.Len())
+	for i := range d.keys {
+		parts = append(parts, d.keys[i].String(), d.vals[i].String())
+	}
+	s := strings.Join(parts, " ")
+	if strings.HasPrefix(s, "*") {
+		s = " " + s // not a comment
+	}
+	return "(" + s + ")"
+}
@@ -1,6 +1,10 @@
-package main
+package joy
 
-import "fmt"
+import (
+	"fmt"
+	"math/big"
+	"slices"
+)
 
 type Parser struct {
 	tokens         []Token
@@ -61,7 +65,9 @@ func (p *Parser) Parse() []Value {
 		case TokSemiCol:
 			p.advance() // skip stray semicolons (e.g. after END;)
 		default:
-			program = append(program, p.parseTerm()...)
+			if v, ok := p.parseTerm(); ok {
+				program = append(program, v)
+			}
 		}
 	}
 	return program
@@ -83,21 +89,24 @@ func (p *Parser) parseDefine() {
 		case TokModule:
 			p.parseModule()
 			continue
+		case TokRecord:
+			p.parseRecord("")
+			continue
 		case TokSemiCol:
 			p.advance() // skip stray semicolons
 			continue
 		}
 		// expect: name == body ;|.
 		if p.peek().Typ != TokAtom {
-			joyErrAt(p.peek().Col, "expected atom in DEFINE, got %s", p.peek().Str)
+			joyErrAt(p.peek().Pos(), "expected atom in DEFINE, got %s", p.peek().Str)
 		}
 		name := p.advance().Str
 		if p.peek().Typ != TokEqDef {
-			joyErrAt(p.peek().Col, "expected == after %s in DEFINE", name)
+			joyErrAt(p.peek().Pos(), "expected == after %s in DEFINE", name)
 		}
 		p.advance() // consume ==
 		body := p.readBody()
-		p.machine.Dict[name] = body
+		p.machine.Define(name, body)
 		// consume optional ;
 		if !p.atEnd() && p.peek().Typ == TokSemiCol {
 			p.advance()
@@ -120,7 +129,7 @@ func (p *Parser) parseHide() {
 	if !p.atEnd() && p.peek().Typ == TokIn {
 		p.advance() // consume IN
 	} else {
-		joyErrAt(p.peek().Col, "expected IN after HIDE definitions")
+		joyErrAt(p.peek().Pos(), "expected IN after HIDE definitions")
 	}
 
 	// Parse public definitions until END.
@@ -131,7 +140,7 @@ func (p *Parser) parseHide() {
 	if !p.atEnd() && p.peek().Typ == TokEnd {
 		p.advance() // consume END
 	} else {
-		joyErrAt(p.peek().Col, "expected END after IN definitions")
+		joyErrAt(p.peek().Pos(), "expected END after IN definitions")
 	}
 
 	p.popScope()
@@ -142,7 +151,7 @@ func (p *Parser) parseHide() {
 func (p *Parser) parseModule() {
 	p.advance() // consume MODULE
 	if p.atEnd() || p.peek().Typ != TokAtom {
-		joyErrAt(p.peek().Col, "expected module name after MODULE")
+		joyErrAt(p.peek().Pos(), "expected module name after MODULE")
 	}
 	modName := p.advance().Str
 
@@ -159,7 +168,7 @@ func (p *Parser) parseModule() {
 	if !p.atEnd() && p.peek().Typ == TokHide {
 		p.advance()
 	} else {
-		joyErrAt(p.peek().Col, "expected PRIVATE after MODULE %s", modName)
+		joyErrAt(p.peek().Pos(), "expected PRIVATE after MODULE %s", modName)
 	}
 
 	// Parse private definitions — stop at PUBLIC (TokDefine) or IN or END
@@ -172,20 +181,23 @@ func (p *Parser) parseModule() {
 			p.parseHide()
 			continue
 		}
+		if tok.Typ == TokRecord {
+			p.parseRecord(prefix)
+			continue
+		}
 		if tok.Typ != TokAtom {
-			joyErrAt(tok.Col, "expected atom in MODULE PRIVATE, got %s", tok.Str)
+			joyErrAt(tok.Pos(), "expected atom in MODULE PRIVATE, got %s", tok.Str)
 		}
 		name := p.advance().Str
 		if p.peek().Typ != TokEqDef {
-			joyErrAt(p.peek().Col, "expected == after %s", name)
+			joyErrAt(p.peek().Pos(), "expected == after %s", name)
 		}
 		p.advance()
 
-		dictName := prefix + name
-		p.scopes[len(p.scopes)-1][name] = dictName
+		dictName := p.scopeName(prefix, name)
 
 		body := p.readBody()
-		p.machine.Dict[dictName] = body
+		p.machine.Define(dictName, body)
 
 		if !p.atEnd() && p.peek().Typ == TokSemiCol {
 			p.advance()
@@ -196,7 +208,7 @@ func (p *Parser) parseModule() {
 	if !p.atEnd() && (p.peek().Typ == TokDefine || p.peek().Typ == TokIn) {
 		p.advance()
 	} else {
-		joyErrAt(p.peek().Col, "expected PUBLIC after MODULE %s PRIVATE definitions", modName)
+		joyErrAt(p.peek().Pos(), "expected PUBLIC after MODULE %s PRIVATE definitions", modName)
 	}
 
 	// Parse public definitions — store as moduleName.fieldName
@@ -206,7 +218,7 @@ func (p *Parser) parseModule() {
 	if !p.atEnd() && p.peek().Typ == TokEnd {
 		p.advance()
 	} else {
-		joyErrAt(p.peek().Col, "expected END for MODULE %s", modName)
+		joyErrAt(p.peek().Pos(), "expected END for MODULE %s", modName)
 	}
 
 	// Restore module context and pop scope
@@ -215,6 +227,33 @@ func (p *Parser) parseModule() {
 	p.popScope()
 }
 
+// parseRecord handles RECORD name field ... END, defining the words of the
+// record type. If prefix is non-empty, the words are mangled as in
+// parseDefSequence.
+func (p *Parser) parseRecord(prefix string) {
+	p.advance() // consume RECORD
+	if p.atEnd() || p.peek().Typ != TokAtom {
+		joyErrAt(p.peek().Pos(), "expected record name after RECORD")
+	}
+	tok := p.advance()
+	rt := &RecordType{Name: tok.Str}
+	if _, ok := p.machine.Builtins[rt.Name]; ok {
+		joyErrAt(tok.Pos(), "RECORD %s: name is a builtin", rt.Name)
+	}
+	for !p.atEnd() && p.peek().Typ == TokAtom {
+		tok := p.advance()
+		if slices.Contains(rt.Fields, tok.Str) {
+			joyErrAt(tok.Pos(), "RECORD %s: duplicate field %s", rt.Name, tok.Str)
+		}
+		rt.Fields = append(rt.Fields, tok.Str)
+	}
+	if p.atEnd() || p.peek().Typ != TokEnd {
+		joyErrAt(p.peek().Pos(), "expected END for RECORD %s", rt.Name)
+	}
+	p.advance() // consume END
+	p.defineRecord(rt, prefix)
+}
+
 // prescanDefNames pre-registers all definition names in the current scope.
 // This enables forward references within HIDE blocks (e.g. I2C calling I2T).
 // The scan is lightweight: it skips bodies by counting bracket depth.
@@ -231,12 +270,12 @@ func (p *Parser) prescanDefNames(prefix string) {
 			break
 		}
 		// Track bracket depth to skip list contents
-		if tok.Typ == TokLBrack || tok.Typ == TokLBrace {
+		if tok.Typ == TokLBrack || tok.Typ == TokLBrace || tok.Typ == TokLParen {
 			depth++
 			p.pos++
 			continue
 		}
-		if tok.Typ == TokRBrack || tok.Typ == TokRBrace {
+		if tok.Typ == TokRBrack || tok.Typ == TokRBrace || tok.Typ == TokRParen {
 			depth--
 			p.pos++
 			continue
@@ -245,6 +284,23 @@ func (p *Parser) prescanDefNames(prefix string) {
 			p.pos++
 			continue
 		}
+		// RECORD name field ... END defines the words of the record
+		if tok.Typ == TokRecord {
+			p.pos++
+			if p.pos < len(p.tokens) && p.tokens[p.pos].Typ == TokAtom {
+				rt := &RecordType{Name: p.tokens[p.pos].Str}
+				for p.pos++; p.pos < len(p.tokens) && p.tokens[p.pos].Typ == TokAtom; p.pos++ {
+					rt.Fields = append(rt.Fields, p.tokens[p.pos].Str)
+				}
+				for _, name := range rt.words() {
+					p.scopes[len(p.scopes)-1][name] = prefix + name
+				}
+			}
+			if p.pos < len(p.tokens) && p.tokens[p.pos].Typ == TokEnd {
+				p.pos++
+			}
+			continue
+		}
 		// At top level: look for name == pattern
 		if tok.Typ == TokAtom && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].Typ == TokEqDef {
 			name := tok.Str
@@ -269,6 +325,10 @@ func (p *Parser) parseDefSequence(prefix string) {
 			p.parseHide()
 			continue
 		}
+		if tok.Typ == TokRecord {
+			p.parseRecord(prefix)
+			continue
+		}
 		if tok.Typ == TokDefine {
 			p.advance() // consume DEFINE keyword (optional inside HIDE blocks)
 			continue
@@ -278,27 +338,19 @@ func (p *Parser) parseDefSequence(prefix string) {
 			continue
 		}
 		if tok.Typ != TokAtom {
-			joyErrAt(tok.Col, "expected atom in definition, got %s", tok.Str)
+			joyErrAt(tok.Pos(), "expected atom in definition, got %s", tok.Str)
 		}
 		name := p.advance().Str
 		if p.peek().Typ != TokEqDef {
-			joyErrAt(p.peek().Col, "expected == after %s", name)
+			joyErrAt(p.peek().Pos(), "expected == after %s", name)
 		}
 		p.advance() // consume ==
 
 		// Register in scope BEFORE parsing body (enables recursive self-references)
-		dictName := name
-		if prefix != "" {
-			dictName = prefix + name
-			p.scopes[len(p.scopes)-1][name] = dictName
-			// Inside MODULE, also register in module scope so names survive nested HIDE pops
-			if p.moduleScopeIdx >= 0 && p.moduleScopeIdx < len(p.scopes)-1 {
-				p.scopes[p.moduleScopeIdx][name] = dictName
-			}
-		}
+		dictName := p.scopeName(prefix, name)
 
 		body := p.readBody()
-		p.machine.Dict[dictName] = body
+		p.machine.Define(dictName, body)
 
 		// consume optional ;
 		if !p.atEnd() && p.peek().Typ == TokSemiCol {
@@ -307,78 +359,127 @@ func (p *Parser) parseDefSequence(prefix string) {
 	}
 }
 
+// scopeName returns the dictionary name of a definition of name. If prefix
+// is non-empty, the name is mangled and registered in the current scope.
+func (p *Parser) scopeName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	dictName := prefix + name
+	p.scopes[len(p.scopes)-1][name] = dictName
+	// Inside MODULE, also register in module scope so names survive nested HIDE pops
+	if p.moduleScopeIdx >= 0 && p.moduleScopeIdx < len(p.scopes)-1 {
+		p.scopes[p.moduleScopeIdx][name] = dictName
+	}
+	return dictName
+}
+
 // readBody reads values until ; or . or IN or END or HIDE (at top level of DEFINE/HIDE)
 func (p *Parser) readBody() []Value {
 	var body []Value
 	for !p.atEnd() {
 		tok := p.peek()
-		if tok.Typ == TokSemiCol || tok.Typ == TokDot || tok.Typ == TokIn || tok.Typ == TokEnd || tok.Typ == TokHide || tok.Typ == TokDefine || tok.Typ == TokModule {
+		if tok.Typ == TokSemiCol || tok.Typ == TokDot || tok.Typ == TokIn || tok.Typ == TokEnd || tok.Typ == TokHide || tok.Typ == TokDefine || tok.Typ == TokModule || tok.Typ == TokRecord {
 			break
 		}
 		// check if next atom looks like start of next definition (atom followed by ==)
 		if tok.Typ == TokAtom && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].Typ == TokEqDef {
 			break
 		}
-		vals := p.parseTerm()
-		body = append(body, vals...)
+		if v, ok := p.parseTerm(); ok {
+			body = append(body, v)
+		}
 	}
 	return body
 }
 
-// parseTerm reads one value (possibly a list) from the token stream.
-func (p *Parser) parseTerm() []Value {
+// parseTerm reads one value (possibly a list) from the token stream. It
+// reports false at the end of the stream.
+func (p *Parser) parseTerm() (Value, bool) {
 	tok := p.peek()
 
 	switch tok.Typ {
 	case TokInt:
 		p.advance()
-		return []Value{IntVal(tok.Int)}
+		if b, ok := tok.Num.(*big.Int); ok {
+			return BigIntVal(b), true
+		}
+		return IntVal(tok.Int), true
 	case TokFloat:
 		p.advance()
-		return []Value{FloatVal(tok.Flt)}
+		return FloatVal(tok.Flt), true
+	case TokRational:
+		p.advance()
+		return RatVal(tok.Num.(*big.Rat)), true
+	case TokComplex:
+		p.advance()
+		return ComplexVal(tok.Num.(complex128)), true
 	case TokChar:
 		p.advance()
-		return []Value{CharVal(tok.Int)}
+		return CharVal(tok.Int), true
 	case TokString:
 		p.advance()
-		return []Value{StringVal(tok.Str)}
+		return StringVal(tok.Str), true
 	case TokLBrack:
-		return []Value{p.parseList()}
+		return p.parseList(), true
 	case TokLBrace:
-		return []Value{p.parseSet()}
+		return p.parseSet(), true
+	case TokLParen:
+		return p.parseMap(), true
 	case TokDot:
 		p.advance()
-		return []Value{p.resolveAtom(".")}
+		return p.resolveAtom(".", tok), true
 	case TokAtom:
 		p.advance()
-		return []Value{p.resolveAtom(tok.Str)}
+		return p.resolveAtom(tok.Str, tok), true
 	case TokEOF:
-		return nil
+		return Value{}, false
 	default:
 		p.advance()
-		joyErrAt(tok.Col, "unexpected token: %s", tok.Str)
-		return nil
+		joyErrAt(tok.Pos(), "unexpected token: %s", tok.Str)
+		return Value{}, false
 	}
 }
 
 func (p *Parser) parseList() Value {
 	p.advance() // consume [
-	var items []Value
+	items := make([]Value, 0, p.listLen())
 	for !p.atEnd() && p.peek().Typ != TokRBrack {
-		items = append(items, p.parseTerm()...)
+		if v, ok := p.parseTerm(); ok {
+			items = append(items, v)
+		}
 	}
 	if !p.atEnd() {
 		p.advance() // consume ]
 	}
-	if items == nil {
-		items = []Value{}
-	}
 	return ListVal(items)
 }
 
+// listLen returns how many terms the list whose [ was just consumed holds
+// at most: the tokens up to its ] that are not nested in brackets.
+func (p *Parser) listLen() int {
+	n, depth := 0, 0
+	for _, tok := range p.tokens[p.pos:] {
+		if depth == 0 {
+			switch tok.Typ {
+			case TokRBrack, TokRBrace, TokRParen, TokEOF:
+				return n
+			}
+			n++
+		}
+		switch tok.Typ {
+		case TokLBrack, TokLBrace, TokLParen:
+			depth++
+		case TokRBrack, TokRBrace, TokRParen:
+			depth--
+		}
+	}
+	return n
+}
+
 func (p *Parser) parseSet() Value {
 	p.advance() // consume {
-	var bits int64
+	bits := new(big.Int)
 	for !p.atEnd() && p.peek().Typ != TokRBrace {
 		tok := p.advance()
 		var n int64
@@ -388,22 +489,62 @@ func (p *Parser) parseSet() Value {
 		case TokChar:
 			n = tok.Int
 		default:
-			joyErrAt(tok.Col, "set members must be small integers or characters, got %s", tok.Str)
+			joyErrAt(tok.Pos(), "set members must be small integers or characters, got %s", tok.Str)
 			continue
 		}
 		if n < 0 || n >= SetSize {
-			joyErrAt(tok.Col, "set member %d out of range 0..%d", n, SetSize-1)
+			joyErrAt(tok.Pos(), "set member %d out of range 0..%d", n, SetSize-1)
 		}
-		bits |= 1 << n
+		bits.SetBit(bits, int(n), 1)
 	}
 	if !p.atEnd() {
 		p.advance() // consume }
 	}
-	return SetVal(bits)
+	return setOf(bits)
+}
+
+// parseMap parses a map literal, its keys and values alternating:
+// ("one" 1 "two" 2).
+func (p *Parser) parseMap() Value {
+	p.advance() // consume (
+	d := newMap(0)
+	for !p.atEnd() && p.peek().Typ != TokRParen {
+		tok := p.peek()
+		key, ok := p.parseTerm()
+		if !ok {
+			break
+		}
+		h, hashable := hashKey(key)
+		if !hashable {
+			joyErrAt(tok.Pos(), "unhashable map key %s", key)
+		}
+		if p.atEnd() || p.peek().Typ == TokRParen {
+			joyErrAt(tok.Pos(), "map key %s has no value", key)
+		}
+		val, ok := p.parseTerm()
+		if !ok {
+			break
+		}
+		d = d.put(h, key, val)
+	}
+	if !p.atEnd() {
+		p.advance() // consume )
+	}
+	return mapVal(d)
+}
+
+// resolveAtom turns an atom read from tok into a builtin, a literal or a
+// (possibly scope-mangled) user word.
+func (p *Parser) resolveAtom(name string, tok Token) Value {
+	v := p.lookupAtom(name)
+	if v.Typ == TypeBuiltin || v.Typ == TypeUserDef {
+		v = v.at(tok.Pos())
+	}
+	return v
 }
 
-func (p *Parser) resolveAtom(name string) Value {
-	if fn, ok := builtins[name]; ok {
+func (p *Parser) lookupAtom(name string) Value {
+	if fn, ok := p.machine.Builtins[name]; ok {
 		return BuiltinVal(name, fn)
 	}
 	// Special literal atoms
@@ -416,8 +557,8 @@ func (p *Parser) resolveAtom(name string) Value {
 	// Check scope stack (inner to outer) for mangled name
 	for i := len(p.scopes) - 1; i >= 0; i-- {
 		if mangled, ok := p.scopes[i][name]; ok {
-			return UserDefVal(mangled)
+			return p.machine.userDef(mangled)
 		}
 	}
-	return UserDefVal(name)
+	return p.machine.userDef(name)
 }
@@ -0,0 +1,45 @@
+package joy
+
+import "math/big"
+
+// Rationals are exact fractions held in Value.Rat. Like big integers
+// they are normalized: a rational that works out to a whole number is
+// an integer, so Rat is never integral and never zero. Arithmetic on
+// integers and rationals stays exact; a float operand makes it inexact.
+
+// RatVal returns the number r, as an integer if it is one. The value
+// keeps r, which must not be changed afterwards.
+func RatVal(r *big.Rat) Value {
+	if r.IsInt() {
+		return BigIntVal(new(big.Int).Set(r.Num()))
+	}
+	return Value{Typ: TypeRational, ref: r}
+}
+
+// rat returns the value of v, a rational or an integer, as a *big.Rat
+// that must not be changed.
+func (v Value) rat() *big.Rat {
+	switch v.Typ {
+	case TypeRational:
+		return v.Rat()
+	case TypeBoolean, TypeChar, TypeInteger:
+		if b := v.Big(); b != nil {
+			return new(big.Rat).SetInt(b)
+		}
+		return new(big.Rat).SetInt64(v.Int)
+	}
+	joyErrKind(ErrType, "rational or integer expected")
+	return nil
+}
+
+// ratInt rounds r to an integer: towards zero, down (floor) or up (ceil).
+func ratInt(r *big.Rat, mode string) Value {
+	q, m := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	switch {
+	case mode == "floor" && m.Sign() < 0:
+		q.Sub(q, big.NewInt(1))
+	case mode == "ceil" && m.Sign() > 0:
+		q.Add(q, big.NewInt(1))
+	}
+	return BigIntVal(q)
+}
@@ -0,0 +1,117 @@
+package joy
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// A RecordType is a record type declared with RECORD name field ... END
+// inside DEFINE, HIDE or MODULE. Its values carry the type in Value.Rec
+// and their fields, in declaration order, in Value.List. Declaring a
+// record again with the same fields declares the same type.
+type RecordType struct {
+	Name   string
+	Fields []string
+}
+
+// same reports whether rt and other are the same record type.
+func (rt *RecordType) same(other *RecordType) bool {
+	return rt == other || rt.Name == other.Name && slices.Equal(rt.Fields, other.Fields)
+}
+
+// RecordVal returns a record of type rt with the given field values. The
+// value keeps fields, which must not be changed afterwards.
+func RecordVal(rt *RecordType, fields []Value) Value {
+	return Value{Typ: TypeRecord, List: fields, ref: rt}
+}
+
+// defineRecord defines the words of the record type rt, for RECORD point x
+// y END:
+//
+//	point     X Y -> P    the record with fields X and Y
+//	point?    X -> B      whether X is a point
+//	point.x   P -> X      field x of P
+//	point-x!  P X -> P'   P with field x set to X
+//
+// The words are named by prefix as in parseDefSequence.
+func (p *Parser) defineRecord(rt *RecordType, prefix string) {
+	name := rt.Name
+	n := len(rt.Fields)
+	p.defineBuiltin(prefix, name, func(m *Machine) {
+		m.NeedStack(n, name)
+		fields := make([]Value, n)
+		for i := n - 1; i >= 0; i-- {
+			fields[i] = m.Pop()
+		}
+		m.Push(RecordVal(rt, fields))
+	})
+	p.defineBuiltin(prefix, name+"?", func(m *Machine) {
+		m.NeedStack(1, name+"?")
+		a := m.Pop()
+		m.Push(BoolVal(a.Typ == TypeRecord && a.Rec().same(rt)))
+	})
+	for i, field := range rt.Fields {
+		get := name + "." + field
+		p.defineBuiltin(prefix, get, func(m *Machine) {
+			m.NeedStack(1, get)
+			r := popRecord(m, get, rt)
+			m.Push(r.List[i])
+		})
+		set := name + "-" + field + "!"
+		p.defineBuiltin(prefix, set, func(m *Machine) {
+			m.NeedStack(2, set)
+			x := m.Pop()
+			r := popRecord(m, set, rt)
+			fields := append([]Value{}, r.List...)
+			fields[i] = x
+			m.Push(RecordVal(r.Rec(), fields))
+		})
+	}
+}
+
+// defineBuiltin defines name as a user word that runs fn, so that it can
+// be redefined like any other. Like any definition in the current scope,
+// the word is mangled by prefix; see scopeName.
+func (p *Parser) defineBuiltin(prefix, name string, fn BuiltinFunc) {
+	p.machine.Define(p.scopeName(prefix, name), []Value{BuiltinVal(name, fn)})
+}
+
+// words returns the names of the words defineRecord defines for rt.
+func (rt *RecordType) words() []string {
+	words := []string{rt.Name, rt.Name + "?"}
+	for _, field := range rt.Fields {
+		words = append(words, rt.Name+"."+field, rt.Name+"-"+field+"!")
+	}
+	return words
+}
+
+func popRecord(m *Machine, word string, rt *RecordType) Value {
+	a := m.Pop()
+	if a.Typ != TypeRecord || !a.Rec().same(rt) {
+		joyErrKind(ErrType, "%s: %s expected", word, rt.Name)
+	}
+	return a
+}
+
+// compareRecords orders records by type name, then field by field.
+func compareRecords(a, b Value) int {
+	if c := strings.Compare(a.Rec().Name, b.Rec().Name); c != 0 {
+		return c
+	}
+	for i := range min(len(a.List), len(b.List)) {
+		if c := a.List[i].Compare(b.List[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a.List), len(b.List))
+}
+
+// formatRecord writes the record v as point{x: 1 y: 2}.
+func formatRecord(v Value) string {
+	parts := make([]string, len(v.List))
+	for i, f := range v.List {
+		parts[i] = v.Rec().Fields[i] + ": " + f.String()
+	}
+	return v.Rec().Name + "{" + strings.Join(parts, " ") + "}"
+}
@@ -0,0 +1,121 @@
+package joy
+
+import (
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// Strings are sequences of Unicode code points: size, at, take, drop and
+// the other aggregate builtins count and index them by rune, not by byte.
+// As strings are kept in UTF-8, finding rune i takes a scan; for long
+// strings the machine keeps the rune count and every runeStride-th rune
+// offset of the last few it indexed, so that walking a string with at,
+// or two strings in turn, stays linear.
+
+// runeIndexMin is the length in bytes from which strings are indexed.
+const runeIndexMin = 64
+
+// runeStride is the number of runes between two offsets of an index; a
+// lookup scans at most runeStride-1 runes past the nearest one.
+const runeStride = 32
+
+// runeSlots is the number of strings the machine keeps indexed.
+const runeSlots = 4
+
+// A runeIndex holds the rune count of s and the byte offset of every
+// runeStride-th rune.
+type runeIndex struct {
+	s     string
+	n     int     // runes in s
+	marks []int32 // nil if s is ASCII
+}
+
+// A runeCache holds the indexes of the last runeSlots strings indexed.
+type runeCache struct {
+	slots [runeSlots]runeIndex
+	next  int // the slot to index into next
+}
+
+// indexed returns the index of s if the machine holds one, or nil.
+func (m *Machine) indexed(s string) *runeIndex {
+	for i := range m.runes.slots {
+		x := &m.runes.slots[i]
+		if len(s) == len(x.s) && unsafe.StringData(s) == unsafe.StringData(x.s) {
+			return x
+		}
+	}
+	return nil
+}
+
+// runeIndex returns the index of s, building it in place of the oldest
+// one unless the machine holds it.
+func (m *Machine) runeIndex(s string) *runeIndex {
+	if x := m.indexed(s); x != nil {
+		return x
+	}
+	c := &m.runes
+	x := &c.slots[c.next]
+	c.next = (c.next + 1) % runeSlots
+	*x = runeIndex{s: s, n: utf8.RuneCountInString(s)}
+	if x.n == len(s) {
+		return x
+	}
+	marks := make([]int32, 0, (x.n+runeStride-1)/runeStride)
+	i := 0
+	for off := range s {
+		if i%runeStride == 0 {
+			marks = append(marks, int32(off))
+		}
+		i++
+	}
+	x.marks = marks
+	return x
+}
+
+// runeLen returns the number of runes in s.
+func (m *Machine) runeLen(s string) int {
+	if len(s) >= runeIndexMin {
+		if x := m.indexed(s); x != nil {
+			return x.n
+		}
+	}
+	return utf8.RuneCountInString(s)
+}
+
+// runeOffset returns the byte offset of rune i of s, which is len(s) if
+// s has no more than i runes. i must not be negative.
+func (m *Machine) runeOffset(s string, i int) int {
+	off := 0
+	if len(s) >= runeIndexMin {
+		x := m.runeIndex(s)
+		switch {
+		case x.marks == nil:
+			return min(i, len(s))
+		case i >= x.n:
+			return len(s)
+		}
+		off = int(x.marks[i/runeStride])
+		i %= runeStride
+	}
+	for ; i > 0 && off < len(s); i-- {
+		_, size := utf8.DecodeRuneInString(s[off:])
+		off += size
+	}
+	return off
+}
+
+// runeString returns the string of the chars cs.
+func runeString(cs []Value) Value {
+	var b strings.Builder
+	for _, c := range cs {
+		b.WriteRune(rune(c.Int))
+	}
+	return StringVal(b.String())
+}
+
+// runeAt returns rune i of s, which must have more than i runes.
+func (m *Machine) runeAt(s string, i int) rune {
+	r, _ := utf8.DecodeRuneInString(s[m.runeOffset(s, i):])
+	return r
+}
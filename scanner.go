@@ -1,49 +1,103 @@
-package main
+package joy
 
 import (
+	"fmt"
+	"math/big"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type TokenType int
 
 const (
-	TokAtom    TokenType = iota // identifier or operator name
-	TokInt                      // integer literal
-	TokFloat                    // float literal
-	TokChar                     // character literal 'x
-	TokString                   // string literal "..."
-	TokLBrack                   // [
-	TokRBrack                   // ]
-	TokLBrace                   // {
-	TokRBrace                   // }
-	TokDot                      // .  (auto-put)
-	TokSemiCol                  // ;
-	TokDefine                   // DEFINE keyword
-	TokHide                     // HIDE, PRIVATE
-	TokIn                       // IN
-	TokEnd                      // END
-	TokModule                   // MODULE
-	TokEqDef                    // ==
+	TokAtom     TokenType = iota // identifier or operator name
+	TokInt                       // integer literal
+	TokFloat                     // float literal
+	TokRational                  // rational literal 3/4r
+	TokComplex                   // complex literal 1+2i or 2i
+	TokChar                      // character literal 'x
+	TokString                    // string literal "..."
+	TokLBrack                    // [
+	TokRBrack                    // ]
+	TokLBrace                    // {
+	TokRBrace                    // }
+	TokLParen                    // (  map literal
+	TokRParen                    // )
+	TokDot                       // .  (auto-put)
+	TokSemiCol                   // ;
+	TokDefine                    // DEFINE keyword
+	TokHide                      // HIDE, PRIVATE
+	TokIn                        // IN
+	TokEnd                       // END
+	TokModule                    // MODULE
+	TokRecord                    // RECORD
+	TokEqDef                     // ==
 	TokEOF
 )
 
 type Token struct {
-	Typ TokenType
-	Str string  // raw text for atoms, string value for strings
-	Int int64   // integer or char value
-	Flt float64 // float value
-	Col int     // 1-indexed column in source (0 = unknown)
+	Typ  TokenType
+	Str  string  // raw text for atoms, string value for strings
+	Int  int64   // integer or char value
+	Flt  float64 // float value
+	Num  any     // a value Int and Flt cannot hold: *big.Int, *big.Rat or complex128
+	Col  int     // 1-indexed column in line (0 = unknown)
+	Line int     // 1-indexed line in source (0 = unknown)
+	File string  // source file name ("" = not from a file)
+}
+
+// Pos returns the token's source position.
+func (t Token) Pos() Pos {
+	return Pos{File: t.File, Line: t.Line, Col: t.Col}
+}
+
+// Pos is a position in Joy source.
+type Pos struct {
+	File string // "" for source not read from a file
+	Line int    // 1-indexed
+	Col  int    // 1-indexed, counted in runes
+}
+
+// String formats p as file:line:col, or line:col without a file.
+func (p Pos) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
 }
 
 type Scanner struct {
-	src []rune
-	pos int
+	src       []rune
+	text      string // the source, when it is all ASCII; see slice
+	pos       int
+	file      string
+	line      int // line of src[pos]
+	lineStart int // index in src of the first rune of line
 }
 
 func NewScanner(source string) *Scanner {
-	return &Scanner{src: []rune(source), pos: 0}
+	return NewFileScanner("", source)
+}
+
+// NewFileScanner returns a scanner whose tokens record file as their
+// source file.
+func NewFileScanner(file, source string) *Scanner {
+	s := &Scanner{src: []rune(source), pos: 0, file: file, line: 1}
+	if len(s.src) == len(source) && utf8.ValidString(source) {
+		s.text = source
+	}
+	return s
+}
+
+// slice returns the text of src[i:j], without copying it when the source
+// is ASCII and so indexed alike as runes and bytes.
+func (s *Scanner) slice(i, j int) string {
+	if s.text != "" {
+		return s.text[i:j]
+	}
+	return string(s.src[i:j])
 }
 
 func (s *Scanner) atEnd() bool {
@@ -60,9 +114,23 @@ func (s *Scanner) peek() rune {
 func (s *Scanner) advance() rune {
 	ch := s.src[s.pos]
 	s.pos++
+	if ch == '\n' {
+		s.line++
+		s.lineStart = s.pos
+	}
 	return ch
 }
 
+// column returns the 1-indexed column of src[pos].
+func (s *Scanner) column() int {
+	return s.pos - s.lineStart + 1
+}
+
+// errorf raises a scan error at the current position.
+func (s *Scanner) errorf(format string, args ...any) {
+	joyErrAt(Pos{File: s.file, Line: s.line, Col: s.column()}, format, args...)
+}
+
 func (s *Scanner) skipWhitespaceAndComments() {
 	for !s.atEnd() {
 		ch := s.peek()
@@ -151,7 +219,7 @@ func isAtomChar(ch rune) bool {
 }
 
 func (s *Scanner) ScanAll() []Token {
-	var tokens []Token
+	tokens := make([]Token, 0, len(s.src)/2+1) // most tokens are followed by a space
 	for {
 		tok := s.Next()
 		tokens = append(tokens, tok)
@@ -164,11 +232,20 @@ func (s *Scanner) ScanAll() []Token {
 
 func (s *Scanner) Next() Token {
 	s.skipWhitespaceAndComments()
+	line := s.line
+	tok := s.next()
+	tok.Line = line
+	tok.File = s.file
+	return tok
+}
+
+// next scans one token; Next fills in its line and file.
+func (s *Scanner) next() Token {
 	if s.atEnd() {
-		return Token{Typ: TokEOF, Col: s.pos + 1}
+		return Token{Typ: TokEOF, Col: s.column()}
 	}
 
-	col := s.pos + 1 // 1-indexed column
+	col := s.column() // 1-indexed column
 	ch := s.peek()
 
 	switch ch {
@@ -184,6 +261,12 @@ func (s *Scanner) Next() Token {
 	case '}':
 		s.advance()
 		return Token{Typ: TokRBrace, Str: "}", Col: col}
+	case '(':
+		s.advance()
+		return Token{Typ: TokLParen, Str: "(", Col: col}
+	case ')':
+		s.advance()
+		return Token{Typ: TokRParen, Str: ")", Col: col}
 	case '.':
 		s.advance()
 		// .s and similar: dot followed by letter is an atom
@@ -192,7 +275,7 @@ func (s *Scanner) Next() Token {
 			for !s.atEnd() && isAtomChar(s.peek()) {
 				s.advance()
 			}
-			name := "." + string(s.src[start:s.pos])
+			name := s.slice(start-1, s.pos)
 			return Token{Typ: TokAtom, Str: name, Col: col}
 		}
 		return Token{Typ: TokDot, Str: ".", Col: col}
@@ -202,7 +285,7 @@ func (s *Scanner) Next() Token {
 	case '\'':
 		s.advance()
 		if s.atEnd() {
-			joyErr("unexpected end of input after '")
+			s.errorf("unexpected end of input after '")
 		}
 		var c rune
 		if s.peek() == '\\' {
@@ -239,7 +322,7 @@ func (s *Scanner) Next() Token {
 }
 
 func (s *Scanner) scanNumber() Token {
-	col := s.pos + 1
+	col := s.column()
 	start := s.pos
 	if s.peek() == '-' {
 		s.advance()
@@ -247,6 +330,9 @@ func (s *Scanner) scanNumber() Token {
 	for !s.atEnd() && s.peek() >= '0' && s.peek() <= '9' {
 		s.advance()
 	}
+	if tok, ok := s.scanRational(start, col); ok {
+		return tok
+	}
 	isFloat := false
 	if !s.atEnd() && s.peek() == '.' && s.pos+1 < len(s.src) && s.src[s.pos+1] >= '0' && s.src[s.pos+1] <= '9' {
 		isFloat = true
@@ -265,23 +351,119 @@ func (s *Scanner) scanNumber() Token {
 			s.advance()
 		}
 	}
-	text := string(s.src[start:s.pos])
+	if tok, ok := s.scanComplex(start, col); ok {
+		return tok
+	}
+	text := s.slice(start, s.pos)
 	if isFloat {
 		f, err := strconv.ParseFloat(text, 64)
 		if err != nil {
-			joyErr("invalid float: %s", text)
+			joyErrAt(Pos{File: s.file, Line: s.line, Col: col}, "invalid float: %s", text)
 		}
 		return Token{Typ: TokFloat, Flt: f, Str: text, Col: col}
 	}
 	n, err := strconv.ParseInt(text, 10, 64)
 	if err != nil {
-		joyErr("invalid integer: %s", text)
+		// ParseInt clamps an out of range n, as Value.Int is clamped
+		b, ok := new(big.Int).SetString(text, 10)
+		if !ok {
+			joyErrAt(Pos{File: s.file, Line: s.line, Col: col}, "invalid integer: %s", text)
+		}
+		return Token{Typ: TokInt, Int: n, Num: b, Str: text, Col: col}
 	}
 	return Token{Typ: TokInt, Int: n, Str: text, Col: col}
 }
 
+// scanRational scans the rest of a rational literal such as 3/4r, whose
+// numerator starts at start, if one follows.
+func (s *Scanner) scanRational(start, col int) (Token, bool) {
+	if s.peek() != '/' {
+		return Token{}, false
+	}
+	j := s.pos + 1
+	for j < len(s.src) && s.src[j] >= '0' && s.src[j] <= '9' {
+		j++
+	}
+	if j == s.pos+1 || j == len(s.src) || s.src[j] != 'r' ||
+		j+1 < len(s.src) && isAtomChar(s.src[j+1]) && s.src[j+1] != '.' {
+		return Token{}, false
+	}
+	for s.pos <= j {
+		s.advance()
+	}
+	text := s.slice(start, s.pos)
+	r, ok := new(big.Rat).SetString(text[:len(text)-1])
+	if !ok {
+		joyErrAt(Pos{File: s.file, Line: s.line, Col: col}, "invalid rational: %s", text)
+	}
+	return Token{Typ: TokRational, Num: r, Str: text, Col: col}, true
+}
+
+// scanComplex scans the rest of a complex literal such as 1+2i or 2i,
+// whose real part (or imaginary part, for 2i) starts at start and has
+// just been scanned, if one follows.
+func (s *Scanner) scanComplex(start, col int) (Token, bool) {
+	mid, end := s.pos, s.pos
+	switch s.peek() {
+	case 'i':
+	case '+', '-':
+		end = s.numberEnd(s.pos + 1)
+		if end == s.pos+1 || end == len(s.src) || s.src[end] != 'i' {
+			return Token{}, false
+		}
+	default:
+		return Token{}, false
+	}
+	if end+1 < len(s.src) && isAtomChar(s.src[end+1]) && s.src[end+1] != '.' {
+		return Token{}, false
+	}
+	for s.pos <= end {
+		s.advance()
+	}
+	text := s.slice(start, s.pos)
+	re, err1 := strconv.ParseFloat(s.slice(start, mid), 64)
+	im, err2 := 0.0, error(nil)
+	if end > mid {
+		im, err2 = strconv.ParseFloat(s.slice(mid, end), 64)
+	} else {
+		re, im = 0, re
+	}
+	if err1 != nil || err2 != nil {
+		joyErrAt(Pos{File: s.file, Line: s.line, Col: col}, "invalid complex: %s", text)
+	}
+	return Token{Typ: TokComplex, Num: complex(re, im), Str: text, Col: col}, true
+}
+
+// numberEnd returns where the unsigned decimal number starting at src[i]
+// ends, or i if there is none there.
+func (s *Scanner) numberEnd(i int) int {
+	digits := func(j int) int {
+		for j < len(s.src) && s.src[j] >= '0' && s.src[j] <= '9' {
+			j++
+		}
+		return j
+	}
+	j := digits(i)
+	if j == i {
+		return i
+	}
+	if j+1 < len(s.src) && s.src[j] == '.' && s.src[j+1] >= '0' && s.src[j+1] <= '9' {
+		j = digits(j + 1)
+	}
+	if j < len(s.src) && (s.src[j] == 'e' || s.src[j] == 'E') {
+		k := j + 1
+		if k < len(s.src) && (s.src[k] == '+' || s.src[k] == '-') {
+			k++
+		}
+		if e := digits(k); e > k {
+			j = e
+		}
+	}
+	return j
+}
+
 func (s *Scanner) scanAtom() Token {
-	col := s.pos + 1
+	col := s.column()
 	start := s.pos
 	for !s.atEnd() && isAtomChar(s.peek()) {
 		// Only include '.' if followed by another atom char (module dot-notation: m1.ab)
@@ -293,10 +475,10 @@ func (s *Scanner) scanAtom() Token {
 		}
 		s.advance()
 	}
-	text := string(s.src[start:s.pos])
+	text := s.slice(start, s.pos)
 	if text == "" {
 		ch := s.advance()
-		joyErr("unexpected character: %c", ch)
+		joyErrAt(Pos{File: s.file, Line: s.line, Col: col}, "unexpected character: %c", ch)
 	}
 	switch text {
 	case "DEFINE", "PUBLIC", "LIBRA":
@@ -309,6 +491,8 @@ func (s *Scanner) scanAtom() Token {
 		return Token{Typ: TokEnd, Str: text, Col: col}
 	case "MODULE":
 		return Token{Typ: TokModule, Str: text, Col: col}
+	case "RECORD":
+		return Token{Typ: TokRecord, Str: text, Col: col}
 	case "==":
 		return Token{Typ: TokEqDef, Str: text, Col: col}
 	default:
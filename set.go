@@ -0,0 +1,121 @@
+package joy
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// A set is a bitset of its members. Sets whose members are all below
+// smallSet keep the bits in Value.Int; larger ones keep them in Value.Big
+// and have Int 0. Like big integers, sets are normalized, so Big is only
+// set when Int could not hold the members.
+
+const smallSet = 64
+
+// setOf returns the set with the members set in b, which it keeps.
+func setOf(b *big.Int) Value {
+	if b.BitLen() <= smallSet {
+		return SetVal(int64(b.Uint64()))
+	}
+	return Value{Typ: TypeSet, ref: b}
+}
+
+// setBits returns the members of the set v as the bits of a new *big.Int.
+func (v Value) setBits() *big.Int {
+	if b := v.Big(); b != nil {
+		return new(big.Int).Set(b)
+	}
+	return new(big.Int).SetUint64(uint64(v.Int))
+}
+
+func (v Value) setEmpty() bool {
+	return v.Int == 0 && v.Big() == nil
+}
+
+// setHas reports whether n is a member of the set v.
+func (v Value) setHas(n int64) bool {
+	switch {
+	case n < 0 || n >= SetSize:
+		return false
+	case v.Big() != nil:
+		return v.Big().Bit(int(n)) == 1
+	case n < smallSet:
+		return uint64(v.Int)>>n&1 == 1
+	}
+	return false
+}
+
+// setWith returns the set v with n added, or removed if bit is 0. A
+// member outside 0..SetSize-1 is an error.
+func (v Value) setWith(name string, n int64, bit uint) Value {
+	if n < 0 || n >= SetSize {
+		joyErrKind(ErrRange, "%s: set member %d out of range 0..%d", name, n, SetSize-1)
+	}
+	if v.Big() == nil && n < smallSet {
+		if bit == 1 {
+			return SetVal(v.Int | 1<<n)
+		}
+		return SetVal(v.Int &^ (1 << n))
+	}
+	b := v.setBits()
+	return setOf(b.SetBit(b, int(n), bit))
+}
+
+// setFirst returns the least member of the set v, which is not empty.
+func (v Value) setFirst() int64 {
+	b := v.Big()
+	if b == nil {
+		return int64(bits.TrailingZeros64(uint64(v.Int)))
+	}
+	return int64(b.TrailingZeroBits())
+}
+
+// setMembers returns the members of the set v in ascending order.
+func (v Value) setMembers() []int64 {
+	var members []int64
+	x := v.Big()
+	if x == nil {
+		for w := uint64(v.Int); w != 0; w &= w - 1 {
+			members = append(members, int64(bits.TrailingZeros64(w)))
+		}
+		return members
+	}
+	for i, w := range x.Bits() {
+		for w != 0 {
+			b := bits.TrailingZeros(uint(w))
+			members = append(members, int64(i*bits.UintSize+b))
+			w &= w - 1
+		}
+	}
+	return members
+}
+
+// setSize returns the number of members of the set v.
+func (v Value) setSize() int {
+	b := v.Big()
+	if b == nil {
+		return bits.OnesCount64(uint64(v.Int))
+	}
+	n := 0
+	for _, w := range b.Bits() {
+		n += bits.OnesCount(uint(w))
+	}
+	return n
+}
+
+// setOp combines the sets a and b bit by bit: op is one of the big.Int
+// methods And, Or, Xor or AndNot, small is the same on int64s.
+func setOp(a, b Value, small func(x, y int64) int64, op func(z, x, y *big.Int) *big.Int) Value {
+	if a.Big() == nil && b.Big() == nil {
+		return SetVal(small(a.Int, b.Int))
+	}
+	z := new(big.Int)
+	return setOf(op(z, a.setBits(), b.setBits()))
+}
+
+// setComplement returns the members of 0..SetSize-1 not in the set v.
+func setComplement(v Value) Value {
+	all := new(big.Int).Lsh(big.NewInt(1), SetSize)
+	all.Sub(all, big.NewInt(1))
+	return setOf(all.AndNot(all, v.setBits()))
+}
@@ -0,0 +1,83 @@
+package joy
+
+// Combinators that run a quotation and then put the stack back as it was
+// (the test of ifte, linrec and the other recursion combinators, nullary
+// and friends, catch) mark the stack instead of copying it, so that a
+// test costs what it disturbs rather than the height of the stack. The
+// stack is changed through Pop, NeedStack and a few VM instructions, and
+// each of them first calls modify with the lowest height it will change;
+// a mark saves the values it would lose just before they are changed.
+
+// stackMark is a stack height to rewind to, with the values that have
+// since been changed.
+type stackMark struct {
+	height int     // len(m.Stack) when marked
+	floor  int     // the stack below floor is as it was when marked
+	undo   []Value // the marked values from floor up to height, topmost first
+	outer  int     // m.floor when marked
+}
+
+// mark marks the stack for rewind and returns the mark.
+func (m *Machine) mark() int {
+	h := len(m.Stack)
+	n := len(m.marks)
+	if n < cap(m.marks) {
+		// Reuse the undo buffer of an earlier mark
+		m.marks = m.marks[:n+1]
+		mk := &m.marks[n]
+		mk.height, mk.floor, mk.outer = h, h, m.floor
+	} else {
+		m.marks = append(m.marks, stackMark{height: h, floor: h, outer: m.floor})
+	}
+	if h > m.floor {
+		m.floor = h
+	}
+	return len(m.marks) - 1
+}
+
+// rewind puts the stack back as it was when mark i was made and drops
+// the mark, along with any made after it.
+func (m *Machine) rewind(i int) {
+	mk := &m.marks[i]
+	m.Stack = m.Stack[:mk.floor]
+	for j := len(mk.undo) - 1; j >= 0; j-- {
+		m.Stack = append(m.Stack, mk.undo[j])
+	}
+	m.dropMarks(i)
+}
+
+// dropMarks forgets mark i and the marks made after it.
+func (m *Machine) dropMarks(i int) {
+	if i >= len(m.marks) {
+		return
+	}
+	// outer may be higher than the floors left, which only makes modify
+	// take the slow path once
+	m.floor = m.marks[i].outer
+	for j := i; j < len(m.marks); j++ {
+		mk := &m.marks[j]
+		clear(mk.undo)
+		mk.undo = mk.undo[:0]
+	}
+	m.marks = m.marks[:i]
+}
+
+// modify is called before the stack is changed from height h up. Code
+// that gives m.Stack a different backing array calls modify(0) first.
+func (m *Machine) modify(h int) {
+	if h < m.floor {
+		m.saveBelow(h)
+	}
+}
+
+// saveBelow saves, for every mark, the values from h up to its floor.
+func (m *Machine) saveBelow(h int) {
+	for i := len(m.marks) - 1; i >= 0; i-- {
+		mk := &m.marks[i]
+		for mk.floor > h {
+			mk.floor--
+			mk.undo = append(mk.undo, m.Stack[mk.floor])
+		}
+	}
+	m.floor = h
+}
@@ -0,0 +1,186 @@
+package joy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Stream is the payload of a TypeFile value: a file opened by fopen or one
+// of the machine's standard streams. Operations the underlying reader or
+// writer does not support fail with an error instead of panicking.
+type Stream struct {
+	r   io.Reader
+	w   io.Writer
+	src io.Reader // unbuffered reader behind r, when r is a read buffer
+	std bool      // one of the machine's standard streams; see Close
+}
+
+var (
+	errNotReadable = errors.New("stream not open for reading")
+	errNotWritable = errors.New("stream not open for writing")
+	errNotSeekable = errors.New("stream not seekable")
+)
+
+// NewStream wraps a reader and/or writer for use as a Joy file value.
+// Either may be nil. Seek, Close and flushing are passed through when r or
+// w implements them.
+func NewStream(r io.Reader, w io.Writer) *Stream {
+	return &Stream{r: r, w: w}
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	if s.r == nil {
+		return 0, errNotReadable
+	}
+	return s.r.Read(p)
+}
+
+func (s *Stream) Write(p []byte) (int, error) {
+	if s.w == nil {
+		return 0, errNotWritable
+	}
+	return s.w.Write(p)
+}
+
+// Seek repositions a seekable stream. Buffered streams (stdin) cannot seek.
+func (s *Stream) Seek(offset int64, whence int) (int64, error) {
+	if s.src == nil {
+		if sk, ok := s.r.(io.Seeker); ok {
+			return sk.Seek(offset, whence)
+		}
+		if sk, ok := s.w.(io.Seeker); ok {
+			return sk.Seek(offset, whence)
+		}
+	}
+	return 0, errNotSeekable
+}
+
+// Close closes the underlying reader and writer if they are closers. A
+// machine's standard streams are only flushed: the host owns what they
+// wrap, and closing it would silence the machine for the rest of the
+// session.
+func (s *Stream) Close() error {
+	if s.std {
+		return s.Flush()
+	}
+	var err error
+	if c, ok := s.r.(io.Closer); ok {
+		err = c.Close()
+	}
+	if c, ok := s.w.(io.Closer); ok && any(s.w) != any(s.r) {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Flush flushes buffered output, or syncs it to disk for files.
+func (s *Stream) Flush() error {
+	switch w := s.w.(type) {
+	case interface{ Flush() error }:
+		return w.Flush()
+	case interface{ Sync() error }:
+		return w.Sync()
+	}
+	return nil
+}
+
+// AtEOF reports whether a read would return end of file.
+func (s *Stream) AtEOF() bool {
+	if br, ok := s.r.(*bufio.Reader); ok {
+		_, err := br.Peek(1)
+		return err != nil
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false
+	}
+	end, _ := s.Seek(0, io.SeekEnd)
+	s.Seek(cur, io.SeekStart)
+	return cur >= end
+}
+
+// readLine reads up to and including the next newline. It returns io.EOF
+// only when no bytes were read.
+func (s *Stream) readLine() (string, error) {
+	if br, ok := s.r.(*bufio.Reader); ok {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return line, err
+	}
+	var b strings.Builder
+	buf := make([]byte, 1)
+	for {
+		n, err := s.Read(buf)
+		if n > 0 {
+			b.WriteByte(buf[0])
+			if buf[0] == '\n' {
+				return b.String(), nil
+			}
+		}
+		if err != nil {
+			if b.Len() > 0 {
+				return b.String(), nil
+			}
+			return "", err
+		}
+	}
+}
+
+func fileStream(f *os.File) *Stream {
+	return &Stream{r: f, w: f}
+}
+
+// stdinStream returns the buffered stream over m.Stdin shared by get,
+// ReadLine and the stdin file value, recreating it if Stdin was replaced.
+func (m *Machine) stdinStream() *Stream {
+	if m.stdin == nil || !sameIO(m.stdin.src, m.Stdin) {
+		m.stdin = &Stream{r: bufio.NewReader(m.Stdin), src: m.Stdin, std: true}
+	}
+	return m.stdin
+}
+
+// stdoutStream and stderrStream wrap m.Stdout and m.Stderr, keeping one
+// Stream per writer so repeated stdout values compare equal.
+func (m *Machine) stdoutStream() *Stream {
+	if m.stdout == nil || !sameIO(m.stdout.w, m.Stdout) {
+		m.stdout = &Stream{w: m.Stdout, std: true}
+	}
+	return m.stdout
+}
+
+func (m *Machine) stderrStream() *Stream {
+	if m.stderr == nil || !sameIO(m.stderr.w, m.Stderr) {
+		m.stderr = &Stream{w: m.Stderr, std: true}
+	}
+	return m.stderr
+}
+
+// sameIO reports whether the readers or writers a and b are the same. A
+// host may supply one of a type == would panic on, such as a struct
+// holding a slice; such values are compared by content instead.
+func sameIO(a, b any) bool {
+	ta := reflect.TypeOf(a)
+	if ta != reflect.TypeOf(b) {
+		return false
+	}
+	if ta != nil && !ta.Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// ReadLine reads the next line from m.Stdin without its trailing newline.
+// It shares the read buffer used by get, so a host loop reading commands
+// and Joy code calling get can be mixed on one input.
+func (m *Machine) ReadLine() (string, error) {
+	line, err := m.stdinStream().readLine()
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), err
+}
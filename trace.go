@@ -0,0 +1,77 @@
+package joy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Frame is one user definition being evaluated. A tail call replaces the
+// caller's last tail frame instead of nesting, so Tail frames stand for a
+// chain of tail calls of which only the most recent is kept.
+type Frame struct {
+	Name string // as written in the source (HIDE/MODULE mangling removed)
+	Tail bool   // entered by a tail call
+}
+
+// maxTraceShown bounds the frames Traceback prints; the middle of a deeper
+// trace is elided.
+const maxTraceShown = 12
+
+// demangle strips the __scope_N_ prefix the parser gives HIDE and MODULE
+// private definitions.
+func demangle(name string) string {
+	for strings.HasPrefix(name, "__scope_") {
+		rest := name[len("__scope_"):]
+		i := strings.IndexByte(rest, '_')
+		if i <= 0 || strings.Trim(rest[:i], "0123456789") != "" {
+			break
+		}
+		name = rest[i+1:]
+	}
+	return name
+}
+
+// trace returns the active frames innermost first, for a JoyError.
+func (m *Machine) trace() []Frame {
+	if len(m.frames) == 0 {
+		return nil
+	}
+	t := make([]Frame, len(m.frames))
+	for i, f := range m.frames {
+		f.Name = demangle(f.Name)
+		t[len(t)-1-i] = f
+	}
+	return t
+}
+
+// Traceback formats e.Trace as "in fib <- in main", innermost first.
+// Repeated frames are collapsed and very deep traces are shortened.
+func (e JoyError) Traceback() string {
+	type run struct {
+		name  string
+		count int
+	}
+	var runs []run
+	for _, f := range e.Trace {
+		if n := len(runs); n > 0 && runs[n-1].name == f.Name {
+			runs[n-1].count++
+		} else {
+			runs = append(runs, run{f.Name, 1})
+		}
+	}
+	var parts []string
+	for i, r := range runs {
+		if len(runs) > maxTraceShown && i == maxTraceShown-2 {
+			parts = append(parts, fmt.Sprintf("... (%d more)", len(runs)-maxTraceShown+1))
+		}
+		if len(runs) > maxTraceShown && i >= maxTraceShown-2 && i < len(runs)-1 {
+			continue
+		}
+		s := "in " + r.name
+		if r.count > 1 {
+			s += fmt.Sprintf(" (x%d)", r.count)
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " <- ")
+}
@@ -1,9 +1,12 @@
-package main
+package joy
 
 import (
+	"bytes"
 	"fmt"
 	"math"
+	"math/big"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -15,25 +18,141 @@ const (
 	TypeInteger
 	TypeFloat
 	TypeString
-	TypeSet     // 32-bit bitmask stored in Int
-	TypeList    // quotations are lists
-	TypeFile    // carries *os.File
-	TypeBuiltin // carries Fn + Name
-	TypeUserDef // carries Name, resolved at execution time
+	TypeSet      // bitset stored in Int, or in Big if it has members of 64 or more
+	TypeList     // quotations are lists
+	TypeFile     // carries *Stream
+	TypeBuiltin  // carries BuiltinFunc + Name
+	TypeUserDef  // carries Name, resolved at execution time
+	TypeError    // carries *JoyError; pushed by catch
+	TypeRational // carries *big.Rat
+	TypeComplex  // carries complex128
+	TypeMap      // carries *Map
+	TypeBytes    // carries []byte
+	TypeRecord   // carries *RecordType, fields in List
 )
 
-const SetSize = 32
+// SetSize bounds set members to 0..SetSize-1, which holds any Unicode
+// character. The cap is what setsize reports; it keeps the complement
+// taken by not finite, so {} not has SetSize members.
+const SetSize = 0x110000
 
+// BuiltinFunc implements a primitive. One stored into Machine.Builtins
+// directly, rather than through Register, must change the stack only
+// through Pop and Push, or in place within the values NeedStack has
+// checked for; combinators that put the stack back rely on it.
 type BuiltinFunc func(m *Machine)
 
 type Value struct {
 	Typ  ValueType
-	Int  int64       // Boolean, Char, Integer, Set
-	Flt  float64     // Float
-	Str  string      // String, UserDef name, Builtin name
-	List []Value     // List / Quotation
-	Fn   BuiltinFunc // Builtin
-	File *os.File    // File
+	Int  int64   // Boolean, Char, Integer (clamped if it is big), Set
+	Flt  float64 // Float
+	Str  string  // String, UserDef name, Builtin name
+	List []Value // List / Quotation; Record: the fields
+	ref  any     // Builtin function, or the payload of a rarer type; see below
+}
+
+// The rarer types keep their payload in Value.ref, behind accessors, so
+// that Value, which the stack and lists hold by value, stays small: a
+// *big.Int for an Integer or Set too large for Int, a *big.Rat, a
+// complex128, a *Map, a []byte, a *RecordType, a *JoyError, a *Stream,
+// and for a word the parser read, its position and definition cell. A
+// Builtin keeps its function there too.
+
+// wordRef is the ref of a word the parser read: a user word with both a
+// position and a cell, or a builtin with a position.
+type wordRef struct {
+	pos Pos
+	def *Def
+	fn  BuiltinFunc
+}
+
+// Fn returns the function of a Builtin.
+func (v Value) Fn() BuiltinFunc {
+	switch r := v.ref.(type) {
+	case BuiltinFunc:
+		return r
+	case *wordRef:
+		return r.fn
+	}
+	return nil
+}
+
+// Big returns the value of an Integer outside the int64 range, or the
+// members of a large Set, and nil for any other value.
+func (v Value) Big() *big.Int {
+	b, _ := v.ref.(*big.Int)
+	return b
+}
+
+// Rat returns the value of a Rational.
+func (v Value) Rat() *big.Rat {
+	r, _ := v.ref.(*big.Rat)
+	return r
+}
+
+// Map returns the map of a Map value.
+func (v Value) Map() *Map {
+	d, _ := v.ref.(*Map)
+	return d
+}
+
+// Bytes returns the bytes of a byte string, which must not be changed.
+func (v Value) Bytes() []byte {
+	b, _ := v.ref.([]byte)
+	return b
+}
+
+// Rec returns the type of a Record.
+func (v Value) Rec() *RecordType {
+	rt, _ := v.ref.(*RecordType)
+	return rt
+}
+
+// File returns the stream of a File (nil = none).
+func (v Value) File() *Stream {
+	s, _ := v.ref.(*Stream)
+	return s
+}
+
+// Err returns the error of an Error value.
+func (v Value) Err() *JoyError {
+	e, _ := v.ref.(*JoyError)
+	return e
+}
+
+// Pos returns where the parser read a Builtin or UserDef (nil = unknown).
+func (v Value) Pos() *Pos {
+	switch r := v.ref.(type) {
+	case *Pos:
+		return r
+	case *wordRef:
+		return &r.pos
+	}
+	return nil
+}
+
+// Def returns the definition cell of a UserDef (nil = resolve by name when
+// run).
+func (v Value) Def() *Def {
+	switch r := v.ref.(type) {
+	case *Def:
+		return r
+	case *wordRef:
+		return r.def
+	}
+	return nil
+}
+
+// at returns the word v marked as read at pos.
+func (v Value) at(pos Pos) Value {
+	if fn := v.Fn(); fn != nil {
+		v.ref = &wordRef{pos: pos, fn: fn}
+	} else if d := v.Def(); d != nil {
+		v.ref = &wordRef{pos: pos, def: d}
+	} else {
+		v.ref = &pos
+	}
+	return v
 }
 
 func BoolVal(b bool) Value {
@@ -60,6 +179,12 @@ func StringVal(s string) Value {
 	return Value{Typ: TypeString, Str: s}
 }
 
+// BytesVal returns the byte string b. The value keeps b, which must not be
+// changed afterwards.
+func BytesVal(b []byte) Value {
+	return Value{Typ: TypeBytes, ref: b}
+}
+
 func SetVal(bits int64) Value {
 	return Value{Typ: TypeSet, Int: bits}
 }
@@ -69,17 +194,41 @@ func ListVal(items []Value) Value {
 }
 
 func BuiltinVal(name string, fn BuiltinFunc) Value {
-	return Value{Typ: TypeBuiltin, Str: name, Fn: fn}
+	return Value{Typ: TypeBuiltin, Str: name, ref: fn}
 }
 
+// FileVal wraps an open file. A nil f yields the value fopen pushes on
+// failure.
 func FileVal(f *os.File, name string) Value {
-	return Value{Typ: TypeFile, File: f, Str: name}
+	if f == nil {
+		return Value{Typ: TypeFile, Str: name}
+	}
+	return StreamVal(fileStream(f), name)
+}
+
+func StreamVal(s *Stream, name string) Value {
+	return Value{Typ: TypeFile, ref: s, Str: name}
+}
+
+// ErrorVal wraps a caught error for a catch handler.
+func ErrorVal(e JoyError) Value {
+	return Value{Typ: TypeError, ref: &e}
 }
 
 func UserDefVal(name string) Value {
 	return Value{Typ: TypeUserDef, Str: name}
 }
 
+// Def is the definition cell of a user word. Every reference to the word
+// parsed by a machine shares its cell, so a later DEFINE of the word,
+// which updates the cell in place, is seen by code parsed before it.
+type Def struct {
+	Name    string
+	Body    []Value
+	Defined bool  // false for a word referenced but not (yet) defined
+	code    *code // Body compiled on first call
+}
+
 func (v Value) IsTruthy() bool {
 	switch v.Typ {
 	case TypeBoolean:
@@ -88,14 +237,20 @@ func (v Value) IsTruthy() bool {
 		return v.Int != 0
 	case TypeFloat:
 		return v.Flt != 0
+	case TypeComplex:
+		return v.complex() != 0
 	case TypeString:
 		return v.Str != ""
 	case TypeList:
 		return len(v.List) > 0
 	case TypeSet:
-		return v.Int != 0
+		return !v.setEmpty()
+	case TypeMap:
+		return v.Map().Len() > 0
+	case TypeBytes:
+		return len(v.Bytes()) > 0
 	case TypeFile:
-		return v.File != nil
+		return v.File() != nil
 	default:
 		return true
 	}
@@ -106,10 +261,19 @@ func (v Value) Equal(other Value) bool {
 		return false
 	}
 	switch v.Typ {
-	case TypeBoolean, TypeChar, TypeInteger, TypeSet:
+	case TypeBoolean, TypeChar:
+		return v.Int == other.Int
+	case TypeInteger, TypeSet:
+		if v.Big() != nil || other.Big() != nil {
+			return v.Big() != nil && other.Big() != nil && v.Big().Cmp(other.Big()) == 0
+		}
 		return v.Int == other.Int
 	case TypeFloat:
 		return v.Flt == other.Flt
+	case TypeRational:
+		return v.Rat().Cmp(other.Rat()) == 0
+	case TypeComplex:
+		return v.complex() == other.complex()
 	case TypeString:
 		return v.Str == other.Str
 	case TypeList:
@@ -122,8 +286,16 @@ func (v Value) Equal(other Value) bool {
 			}
 		}
 		return true
+	case TypeMap:
+		return v.Map().equal(other.Map())
+	case TypeRecord:
+		return v.Rec().same(other.Rec()) && ListVal(v.List).Equal(ListVal(other.List))
+	case TypeBytes:
+		return bytes.Equal(v.Bytes(), other.Bytes())
 	case TypeFile:
-		return v.File == other.File
+		return v.File() == other.File()
+	case TypeError:
+		return v.Err() == other.Err()
 	case TypeBuiltin:
 		return v.Str == other.Str
 	case TypeUserDef:
@@ -138,6 +310,9 @@ func (v Value) Compare(other Value) int {
 	case TypeBoolean, TypeChar, TypeInteger:
 		switch other.Typ {
 		case TypeBoolean, TypeChar, TypeInteger:
+			if v.Big() != nil || other.Big() != nil {
+				return v.bigInt().Cmp(other.bigInt())
+			}
 			if v.Int < other.Int {
 				return -1
 			}
@@ -145,8 +320,10 @@ func (v Value) Compare(other Value) int {
 				return 1
 			}
 			return 0
+		case TypeRational:
+			return v.rat().Cmp(other.Rat())
 		case TypeFloat:
-			fv := float64(v.Int)
+			fv := v.NumericVal()
 			if fv < other.Flt {
 				return -1
 			}
@@ -158,12 +335,12 @@ func (v Value) Compare(other Value) int {
 	case TypeFloat:
 		var ov float64
 		switch other.Typ {
-		case TypeBoolean, TypeChar, TypeInteger:
-			ov = float64(other.Int)
+		case TypeBoolean, TypeChar, TypeInteger, TypeRational:
+			ov = other.NumericVal()
 		case TypeFloat:
 			ov = other.Flt
 		default:
-			joyErr("compare: incompatible types")
+			joyErrKind(ErrType, "compare: incompatible types")
 		}
 		if v.Flt < ov {
 			return -1
@@ -172,9 +349,16 @@ func (v Value) Compare(other Value) int {
 			return 1
 		}
 		return 0
+	case TypeRational:
+		switch other.Typ {
+		case TypeBoolean, TypeChar, TypeInteger, TypeRational:
+			return v.Rat().Cmp(other.rat())
+		case TypeFloat:
+			return -other.Compare(v)
+		}
 	case TypeString:
 		if other.Typ != TypeString {
-			joyErr("compare: incompatible types")
+			joyErrKind(ErrType, "compare: incompatible types")
 		}
 		if v.Str < other.Str {
 			return -1
@@ -183,30 +367,52 @@ func (v Value) Compare(other Value) int {
 			return 1
 		}
 		return 0
+	case TypeRecord:
+		if other.Typ != TypeRecord {
+			joyErrKind(ErrType, "compare: incompatible types")
+		}
+		return compareRecords(v, other)
+	case TypeBytes:
+		if other.Typ != TypeBytes {
+			joyErrKind(ErrType, "compare: incompatible types")
+		}
+		return bytes.Compare(v.Bytes(), other.Bytes())
 	case TypeSet:
 		if other.Typ != TypeSet {
-			joyErr("compare: incompatible types")
+			joyErrKind(ErrType, "compare: incompatible types")
+		}
+		if v.Big() != nil || other.Big() != nil {
+			return v.setBits().Cmp(other.setBits())
 		}
-		if v.Int < other.Int {
+		if uint64(v.Int) < uint64(other.Int) {
 			return -1
 		}
-		if v.Int > other.Int {
+		if uint64(v.Int) > uint64(other.Int) {
 			return 1
 		}
 		return 0
 	}
-	joyErr("compare: unsupported types")
+	joyErrKind(ErrType, "compare: unsupported types")
 	return 0
 }
 
 func (v Value) NumericVal() float64 {
 	switch v.Typ {
 	case TypeInteger, TypeChar, TypeBoolean:
+		if b := v.Big(); b != nil {
+			return bigFloat(b)
+		}
 		return float64(v.Int)
 	case TypeFloat:
 		return v.Flt
+	case TypeRational:
+		f, _ := v.Rat().Float64()
+		return f
+	case TypeComplex:
+		joyErrKind(ErrType, "real number expected")
+		return 0
 	default:
-		joyErr("numeric value expected")
+		joyErrKind(ErrType, "numeric value expected")
 		return 0
 	}
 }
@@ -221,6 +427,9 @@ func (v Value) String() string {
 	case TypeChar:
 		return fmt.Sprintf("'%c", rune(v.Int))
 	case TypeInteger:
+		if b := v.Big(); b != nil {
+			return b.String()
+		}
 		return fmt.Sprintf("%d", v.Int)
 	case TypeFloat:
 		s := fmt.Sprintf("%g", v.Flt)
@@ -230,14 +439,16 @@ func (v Value) String() string {
 			}
 		}
 		return s
+	case TypeRational:
+		return v.Rat().String() + "r"
+	case TypeComplex:
+		return formatComplex(v.complex())
 	case TypeString:
 		return fmt.Sprintf("%q", v.Str)
 	case TypeSet:
 		var parts []string
-		for i := 0; i < SetSize; i++ {
-			if v.Int&(1<<i) != 0 {
-				parts = append(parts, fmt.Sprintf("%d", i))
-			}
+		for _, n := range v.setMembers() {
+			parts = append(parts, strconv.FormatInt(n, 10))
 		}
 		return "{" + strings.Join(parts, " ") + "}"
 	case TypeList:
@@ -246,8 +457,14 @@ func (v Value) String() string {
 			parts = append(parts, item.String())
 		}
 		return "[" + strings.Join(parts, " ") + "]"
+	case TypeMap:
+		return v.Map().String()
+	case TypeBytes:
+		return fmt.Sprintf("b%q", v.Bytes())
+	case TypeRecord:
+		return formatRecord(v)
 	case TypeFile:
-		if v.File == nil {
+		if v.File() == nil {
 			return "file:nil"
 		}
 		return "file:" + v.Str
@@ -255,24 +472,69 @@ func (v Value) String() string {
 		return v.Str
 	case TypeUserDef:
 		return v.Str
+	case TypeError:
+		return "<error: " + v.Err().Msg + ">"
 	default:
 		return "???"
 	}
 }
 
+// ErrorKind classifies a JoyError so hosts can tell an aborted run apart
+// from an error raised by the program itself, and programs can tell what
+// went wrong (see errkind).
+type ErrorKind string
+
+const (
+	ErrRuntime    ErrorKind = ""                  // any other error a builtin, the parser or the program raises
+	ErrType       ErrorKind = "type"              // an operand of the wrong type
+	ErrUnderflow  ErrorKind = "underflow"         // too few values on the stack
+	ErrUndefined  ErrorKind = "undefined"         // an undefined word was run
+	ErrRange      ErrorKind = "range"             // an index out of range, a division by zero, an empty aggregate
+	ErrCancelled  ErrorKind = "cancelled"         // the RunContext context was cancelled or timed out
+	ErrBudget     ErrorKind = "budget exhausted"  // MaxSteps instructions were executed
+	ErrLimit      ErrorKind = "limit exceeded"    // a MaxStack/MaxListLen/MaxStringLen/MaxBytes quota was hit
+	ErrPermission ErrorKind = "permission denied" // the builtin needs a capability the machine lacks
+	ErrQuit       ErrorKind = "quit"              // the program ran quit
+)
+
+// catchable reports whether catch handles errors of kind k: those a
+// program raises, as opposed to the aborts of a run.
+func (k ErrorKind) catchable() bool {
+	switch k {
+	case ErrCancelled, ErrBudget, ErrLimit, ErrQuit:
+		return false
+	}
+	return true
+}
+
 type JoyError struct {
-	Msg string
-	Col int // 1-indexed column (0 = unknown)
+	Kind  ErrorKind
+	Msg   string
+	Word  string  // builtin or user word that raised the error ("" = unknown)
+	Data  *Value  // the value passed to throw (nil for other errors)
+	File  string  // source file of the failing token or word ("" = none)
+	Line  int     // 1-indexed line (0 = unknown)
+	Col   int     // 1-indexed column (0 = unknown)
+	Trace []Frame // user definitions active when raised, innermost first
 }
 
 func (e JoyError) Error() string {
 	return e.Msg
 }
 
+// Pos returns the source position the error was raised at.
+func (e JoyError) Pos() Pos {
+	return Pos{File: e.File, Line: e.Line, Col: e.Col}
+}
+
 func joyErr(format string, args ...any) {
 	panic(JoyError{Msg: fmt.Sprintf(format, args...)})
 }
 
-func joyErrAt(col int, format string, args ...any) {
-	panic(JoyError{Msg: fmt.Sprintf(format, args...), Col: col})
+func joyErrKind(kind ErrorKind, format string, args ...any) {
+	panic(JoyError{Kind: kind, Msg: fmt.Sprintf(format, args...)})
+}
+
+func joyErrAt(pos Pos, format string, args ...any) {
+	panic(JoyError{Msg: fmt.Sprintf(format, args...), File: pos.File, Line: pos.Line, Col: pos.Col})
 }
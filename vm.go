@@ -0,0 +1,596 @@
+package joy
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// Programs are compiled to code before they run: builtins become direct
+// calls, user words call through their Def cells, and a few hot
+// builtins get opcodes of their own. Compiled code is cached per program
+// slice, so a quotation that is executed repeatedly (a definition body,
+// the branches of a loop) is compiled once.
+
+type opcode uint8
+
+const (
+	opPush   opcode = iota // push the literal
+	opCall                 // call the builtin
+	opUser                 // call words[arg]
+	opTail                 // call words[arg] in place of the current frame
+	opDup                  // the default dup
+	opSwap                 // the default swap
+	opAdd                  // the default +
+	opIfte                 // [B] [T] [F] ifte with literal quotations: iftes[arg]
+	opDip                  // [P] dip with a literal quotation: quots[arg]
+	opBranch               // [T] [F] branch with literal quotations: quots[arg], quots[arg+1]
+)
+
+// literals returns how many literal quotations the fused instruction op
+// replaces.
+func (op opcode) literals() int {
+	switch op {
+	case opDip:
+		return 1
+	case opBranch:
+		return 2
+	case opIfte:
+		return 3
+	}
+	return 0
+}
+
+// instr is one instruction; at indexes the program value it was compiled
+// from, which holds the literal, the builtin and the source position.
+type instr struct {
+	op  opcode
+	arg int32
+	at  int32
+}
+
+type code struct {
+	ins   []instr
+	words []*Def
+	iftes []ifteCode
+	quots []*code // the quotations of fused dips and branches
+	src   []Value // the compiled program
+}
+
+// ifteCode holds the compiled quotations of a fused ifte.
+type ifteCode struct {
+	test, then, els *code
+}
+
+type codeKey struct {
+	p *Value
+	n int
+}
+
+// recentCode is a slot of the small direct-mapped cache in front of
+// m.codes; combinators look up the same few quotations over and over. A
+// slot with a nil c records a program compiled once but not cached.
+type recentCode struct {
+	p *Value
+	n int
+	c *code
+}
+
+// maxCodes bounds the compiled-code cache. Programs built at runtime each
+// get their own entry, so the cache is dropped when it grows this large.
+const maxCodes = 1 << 10
+
+var emptyCode = &code{}
+
+// compile returns the code for program, reusing earlier code for the same
+// slice when there is any.
+func (m *Machine) compile(program []Value) *code {
+	if len(program) == 0 {
+		return emptyCode
+	}
+	p := &program[0]
+	slot := &m.recent[uintptr(unsafe.Pointer(p))*0x9E3779B97F4A7C15>>56]
+	seen := slot.p == p && slot.n == len(program)
+	if seen && slot.c != nil {
+		return slot.c
+	}
+	key := codeKey{p, len(program)}
+	if c, ok := m.codes[key]; ok {
+		*slot = recentCode{p, len(program), c}
+		return c
+	}
+	c := newCode(program)
+	if seen {
+		// Only programs run more than once are cached; most programs
+		// built at runtime (lazy list thunks, say) run just once.
+		if m.codes == nil || len(m.codes) >= maxCodes {
+			m.codes = make(map[codeKey]*code)
+		}
+		m.codes[key] = c
+		*slot = recentCode{p, len(program), c}
+	} else {
+		*slot = recentCode{p, len(program), nil}
+	}
+	for i, v := range program {
+		in := instr{op: opPush, at: int32(i)}
+		switch v.Typ {
+		case TypeBuiltin:
+			in.op = specialOp(v)
+			if k := in.op.literals(); k > 0 {
+				// The quotations were pushed as literals just before;
+				// they run from here without being pushed at all.
+				n := len(c.ins)
+				if !listPushes(c, n-k, n) {
+					in.op = opCall
+				} else if in.op == opIfte {
+					in.arg = int32(len(c.iftes))
+					c.iftes = append(c.iftes, ifteCode{
+						test: m.compile(program[c.ins[n-3].at].List),
+						then: m.compile(program[c.ins[n-2].at].List),
+						els:  m.compile(program[c.ins[n-1].at].List),
+					})
+					c.ins = c.ins[:n-k]
+				} else {
+					in.arg = int32(len(c.quots))
+					for _, lit := range c.ins[n-k:] {
+						c.quots = append(c.quots, m.compile(program[lit.at].List))
+					}
+					c.ins = c.ins[:n-k]
+				}
+			}
+		case TypeUserDef:
+			in.op = opUser
+			if i == len(program)-1 {
+				in.op = opTail
+			}
+			d := v.Def()
+			if d == nil {
+				d = m.def(v.Str)
+			}
+			if cap(c.words) == 0 {
+				c.words = make([]*Def, 0, len(program)-i)
+			}
+			in.arg = int32(len(c.words))
+			c.words = append(c.words, d)
+		}
+		c.ins = append(c.ins, in)
+	}
+	return c
+}
+
+// smallCode holds a short program's code together with room for its
+// instructions and words, so that compiling it allocates once. Most
+// programs built at runtime are short.
+type smallCode struct {
+	code
+	ins   [8]instr
+	words [4]*Def
+}
+
+// newCode returns empty code for program, with room for its instructions.
+func newCode(program []Value) *code {
+	if len(program) > len(smallCode{}.ins) {
+		return &code{src: program, ins: make([]instr, 0, len(program))}
+	}
+	b := &smallCode{}
+	b.code = code{src: program, ins: b.ins[:0], words: b.words[:0]}
+	return &b.code
+}
+
+// listPushes reports whether c.ins[i:j] all push literal lists.
+func listPushes(c *code, i, j int) bool {
+	if i < 0 {
+		return false
+	}
+	for _, in := range c.ins[i:j] {
+		if in.op != opPush || c.src[in.at].Typ != TypeList {
+			return false
+		}
+	}
+	return true
+}
+
+// link returns the code for d's current body.
+func (m *Machine) link(d *Def) *code {
+	if !d.Defined {
+		joyErrKind(ErrUndefined, "undefined: %s", d.Name)
+	}
+	if d.code == nil {
+		d.code = m.compile(d.Body)
+	}
+	return d.code
+}
+
+var specials struct {
+	once sync.Once
+	ops  map[uintptr]opcode
+}
+
+// specialOp returns the opcode for the builtin v: a dedicated one when v
+// is the default implementation of a hot builtin, opCall otherwise. The
+// name rules most builtins out before the slower look at the function.
+func specialOp(v Value) opcode {
+	switch v.Str {
+	case "dup", "swap", "+", "ifte", "dip", "branch":
+	default:
+		return opCall
+	}
+	specials.once.Do(func() {
+		specials.ops = make(map[uintptr]opcode)
+		for name, op := range map[string]opcode{"dup": opDup, "swap": opSwap, "+": opAdd,
+			"ifte": opIfte, "dip": opDip, "branch": opBranch} {
+			specials.ops[reflect.ValueOf(builtins[name]).Pointer()] = op
+		}
+	})
+	if op, ok := specials.ops[reflect.ValueOf(v.Fn()).Pointer()]; ok {
+		return op
+	}
+	return opCall
+}
+
+type frameKind uint8
+
+const (
+	frameExec  frameKind = iota // a quotation run by Execute or a combinator, or a fused ifte or branch
+	frameCall                   // a user word called from another frame
+	frameTest                   // the test of a fused ifte
+	frameCont                   // a continuation a combinator left to run after the frames above it
+	frameHold                   // values dip and friends set aside, pushed back after the frames above it
+	frameKeep                   // keeps the result of the frames above it and rewinds the stack under it
+	frameCatch                  // the handler of a catch, guarding the frames above it
+	frameEach                   // runs its code once for each item of a held list; see each
+)
+
+// frame is one entry of the continuation stack: an activation of compiled
+// code, or the rest of a combinator's work. Builtins that run quotations
+// push frames instead of calling back into exec, so neither user
+// recursion nor combinators grow the Go stack.
+type frame struct {
+	c    *code  // code frames; frameCatch: the handler
+	pc   int    // frameKeep: the arguments to drop; frameEach: the next item
+	base int    // len(m.frames) on entry
+	cur  *Value // m.cur on entry
+	kind frameKind
+	ifte int32            // frameTest: index into the caller's iftes
+	mark int              // frameTest, frameKeep, frameCatch: the stack mark to rewind to; frameHold, frameEach: start in m.held
+	k    func(m *Machine) // frameCont
+}
+
+// frameBytes is what one frame costs against MaxFrameBytes: the frame and
+// the trace entry a user call adds.
+const frameBytes = int64(unsafe.Sizeof(frame{}) + unsafe.Sizeof(Frame{}))
+
+// defaultMaxFrameBytes bounds the continuation stack when MaxFrameBytes is
+// 0, so that runaway recursion fails instead of exhausting memory.
+const defaultMaxFrameBytes = 128 << 20
+
+// pushFrame pushes f onto the continuation stack, enforcing MaxDepth and
+// MaxFrameBytes.
+func (m *Machine) pushFrame(f frame) {
+	if len(m.vframes) >= m.maxFrames {
+		m.checkFrames()
+	}
+	m.vframes = append(m.vframes, f)
+	m.Depth = len(m.vframes)
+}
+
+// checkFrames raises an error if another frame would exceed MaxDepth or
+// MaxFrameBytes, and caches how many frames they allow in m.maxFrames.
+func (m *Machine) checkFrames() {
+	n := len(m.vframes)
+	if m.MaxDepth > 0 && n >= m.MaxDepth {
+		joyErr("recursion depth exceeded (%d)", m.MaxDepth)
+	}
+	quota := m.MaxFrameBytes
+	if quota <= 0 {
+		quota = defaultMaxFrameBytes
+	}
+	if int64(n+1)*frameBytes > quota {
+		joyErrKind(ErrLimit, "recursion depth exceeded (MaxFrameBytes %d)", quota)
+	}
+	m.maxFrames = int(quota / frameBytes)
+	if m.MaxDepth > 0 && m.MaxDepth < m.maxFrames {
+		m.maxFrames = m.MaxDepth
+	}
+}
+
+// enter pushes a frame running c and counts it against the step budget.
+func (m *Machine) enter(c *code, kind frameKind) {
+	m.pushFrame(frame{c: c, base: len(m.frames), cur: m.cur, kind: kind})
+	m.tick()
+}
+
+// call schedules program to run when the running builtin returns, and
+// then k, if it is not nil. A combinator that has more to do after the
+// quotation passes the rest as k; frames scheduled later run first, so a
+// builtin that calls call twice runs the second program first.
+func (m *Machine) call(program []Value, k func(m *Machine)) {
+	if k != nil {
+		m.then(k)
+	}
+	m.enter(m.compile(program), frameExec)
+}
+
+// then schedules k to run once the frames scheduled after it finish.
+func (m *Machine) then(k func(m *Machine)) {
+	m.pushFrame(frame{base: len(m.frames), cur: m.cur, kind: frameCont, k: k})
+}
+
+// hold sets vs aside until the frames scheduled after it finish, then
+// pushes them back. It is call with a continuation that pushes vs, for
+// dip and friends, without allocating one.
+func (m *Machine) hold(vs ...Value) {
+	m.pushFrame(frame{base: len(m.frames), cur: m.cur, kind: frameHold, mark: len(m.held)})
+	m.held = append(m.held, vs...)
+}
+
+// keep schedules program like call, and then puts the stack back as it
+// was before program ran, less the n values on top, with the value
+// program left on top pushed (nullary and friends, and tests).
+func (m *Machine) keep(program []Value, n int) {
+	m.pushFrame(frame{base: len(m.frames), cur: m.cur, kind: frameKeep, pc: n, mark: m.mark()})
+	m.enter(m.compile(program), frameExec)
+}
+
+// guard schedules body like call, with handler run in its place should
+// it raise an error a program may handle; see unwind.
+func (m *Machine) guard(body, handler []Value) {
+	m.pushFrame(frame{c: m.compile(handler), base: len(m.frames), cur: m.cur,
+		kind: frameCatch, mark: m.mark()})
+	m.enter(m.compile(body), frameExec)
+}
+
+// exec runs c to completion, together with every frame it schedules.
+// Execute, and so exec, is only re-entered by the host and by builtins
+// such as include that run a whole program before returning.
+func (m *Machine) exec(c *code) {
+	outer := m.level
+	m.level = execLevel{len(m.vframes), len(m.marks), len(m.held), len(m.frames)}
+	base := m.level.vframes
+	if base == 0 {
+		m.maxFrames = 0 // the limits may have changed since the last run
+	}
+	defer func() {
+		m.cut(m.level)
+		m.level = outer
+		if base == 0 && cap(m.vframes) > maxIdleFrames {
+			// Let a deep recursion's stack go once the run is over
+			m.vframes = nil
+		}
+	}()
+	m.enter(c, frameExec)
+	for m.resume(base) {
+	}
+}
+
+// execLevel records how much of the continuation state belonged to the
+// callers of a running exec.
+type execLevel struct {
+	vframes, marks, held, frames int
+}
+
+// cut drops the continuation state above lv, along with the stack marks
+// and held values that went with it.
+func (m *Machine) cut(lv execLevel) {
+	clear(m.vframes[lv.vframes:])
+	m.vframes, m.Depth = m.vframes[:lv.vframes], lv.vframes
+	m.dropMarks(lv.marks)
+	clear(m.held[lv.held:])
+	m.held = m.held[:lv.held]
+}
+
+// maxIdleFrames is the continuation stack capacity kept between runs.
+const maxIdleFrames = 1 << 12
+
+// resume runs frames until only base remain. It reports whether it
+// stopped early because a catch frame caught an error, in which case the
+// handler is waiting on top.
+func (m *Machine) resume(base int) (caught bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if !m.unwind(r, base) {
+				panic(r)
+			}
+			caught = true
+		}
+	}()
+	m.loop(base)
+	return false
+}
+
+// unwind looks for a catch frame above base for the error r was raised
+// with. Only errors a program may handle are caught; aborts (quit,
+// cancellation, budgets and quotas) and Go panics keep unwinding. The
+// frames above the catch frame are dropped, the stack is put back as it
+// was when catch ran, the error is pushed and the handler replaces the
+// catch frame.
+func (m *Machine) unwind(r any, base int) bool {
+	e, ok := r.(JoyError)
+	if !ok || !e.Kind.catchable() {
+		return false
+	}
+	held := len(m.held)
+	for i := len(m.vframes) - 1; i >= base; i-- {
+		fr := m.vframes[i]
+		if fr.kind == frameHold || fr.kind == frameEach {
+			held = fr.mark
+		}
+		if fr.kind != frameCatch {
+			continue
+		}
+		je := m.annotate(e)
+		m.rewind(fr.mark)
+		clear(m.held[held:])
+		m.held = m.held[:held]
+		m.frames, m.cur = m.frames[:fr.base], fr.cur
+		clear(m.vframes[i:])
+		m.vframes, m.Depth = m.vframes[:i], i
+		m.Push(ErrorVal(je))
+		m.enter(fr.c, frameExec)
+		return true
+	}
+	return false
+}
+
+// leave pops the finished frame on top of the continuation stack and does
+// what its kind requires next.
+func (m *Machine) leave() {
+	top := len(m.vframes) - 1
+	fr := m.vframes[top]
+	m.vframes[top].k = nil
+	m.vframes, m.Depth = m.vframes[:top], top
+	m.frames, m.cur = m.frames[:fr.base], fr.cur
+	switch fr.kind {
+	case frameCall:
+		m.frames = m.frames[:len(m.frames)-1]
+	case frameTest:
+		cond := m.Pop()
+		m.rewind(fr.mark)
+		ifte := &m.vframes[top-1].c.iftes[fr.ifte]
+		branch := ifte.els
+		if cond.IsTruthy() {
+			branch = ifte.then
+		}
+		m.enter(branch, frameExec)
+	case frameCont:
+		fr.k(m)
+	case frameHold:
+		for _, v := range m.held[fr.mark:] {
+			m.Push(v)
+		}
+		clear(m.held[fr.mark:])
+		m.held = m.held[:fr.mark]
+	case frameKeep:
+		result := m.Pop()
+		m.rewind(fr.mark)
+		m.modify(len(m.Stack) - fr.pc)
+		m.Stack = m.Stack[:len(m.Stack)-fr.pc]
+		m.Push(result)
+	case frameCatch:
+		// The guarded code finished without an error
+		m.dropMarks(fr.mark)
+	case frameEach:
+		items := m.held[fr.mark].List
+		if fr.pc == len(items) {
+			m.held[fr.mark] = Value{}
+			m.held = m.held[:fr.mark]
+			return
+		}
+		fr.pc++
+		m.pushFrame(fr)
+		m.Push(items[fr.pc-1])
+		m.enter(fr.c, frameExec)
+	}
+}
+
+// loop runs the continuation stack down to base frames.
+func (m *Machine) loop(base int) {
+frames:
+	for n := len(m.vframes); n > base; n = len(m.vframes) {
+		fr := &m.vframes[n-1]
+		if fr.kind >= frameCont {
+			m.leave()
+			continue
+		}
+		for fr.pc < len(fr.c.ins) {
+			in := fr.c.ins[fr.pc]
+			m.tick()
+			m.cur = &fr.c.src[in.at]
+			fr.pc++
+			switch in.op {
+			case opPush:
+				m.Push(fr.c.src[in.at])
+			case opCall:
+				fr.c.src[in.at].Fn()(m)
+				if len(m.vframes) != n || &m.vframes[n-1] != fr {
+					// The builtin scheduled frames, or ran a nested exec
+					// that moved the continuation stack
+					continue frames
+				}
+			case opUser:
+				d := fr.c.words[in.arg]
+				body := m.link(d)
+				m.frames = append(m.frames, Frame{Name: d.Name})
+				m.enter(body, frameCall)
+				continue frames
+			case opTail:
+				d := fr.c.words[in.arg]
+				body := m.link(d)
+				m.frames = append(m.frames[:fr.base], Frame{Name: d.Name, Tail: true})
+				fr.c, fr.pc = body, 0
+			case opDup:
+				n := len(m.Stack)
+				if n < 1 {
+					m.NeedStack(1, "dup")
+				}
+				m.Push(m.Stack[n-1])
+			case opSwap:
+				n := len(m.Stack)
+				if n < 2 || n-2 < m.floor {
+					m.NeedStack(2, "swap")
+				}
+				m.Stack[n-1], m.Stack[n-2] = m.Stack[n-2], m.Stack[n-1]
+			case opAdd:
+				n := len(m.Stack)
+				if n < 2 || n-2 < m.floor {
+					m.NeedStack(2, "+")
+				}
+				a, b := m.Stack[n-2], m.Stack[n-1]
+				if s := a.Int + b.Int; a.Typ <= TypeInteger && b.Typ <= TypeInteger &&
+					a.Big() == nil && b.Big() == nil && (s^a.Int)&(s^b.Int) >= 0 {
+					m.Stack[n-2] = IntVal(s)
+					m.Stack = m.Stack[:n-1]
+				} else {
+					m.Stack = m.Stack[:n-2]
+					m.Push(add(a, b))
+				}
+			case opIfte:
+				// Count the three literals the fused instruction replaces
+				m.tick()
+				m.tick()
+				m.tick()
+				if m.MaxStack > 0 && len(m.Stack)+3 > m.MaxStack {
+					m.stackLimit()
+				}
+				test := fr.c.iftes[in.arg].test
+				m.pushFrame(frame{c: test, base: len(m.frames), cur: m.cur,
+					kind: frameTest, ifte: in.arg, mark: m.mark()})
+				m.tick()
+				continue frames
+			case opDip:
+				m.tick() // the literal the fused instruction replaces
+				if len(m.Stack) < 1 || m.MaxStack > 0 && len(m.Stack)+1 > m.MaxStack {
+					m.unfuse(fr.c, in)
+					continue frames
+				}
+				m.hold(m.Pop())
+				m.enter(fr.c.quots[in.arg], frameExec)
+				continue frames
+			case opBranch:
+				m.tick()
+				m.tick()
+				if len(m.Stack) < 1 || m.MaxStack > 0 && len(m.Stack)+2 > m.MaxStack {
+					m.unfuse(fr.c, in)
+					continue frames
+				}
+				branch := fr.c.quots[in.arg+1]
+				if m.Pop().IsTruthy() {
+					branch = fr.c.quots[in.arg]
+				}
+				m.enter(branch, frameExec)
+				continue frames
+			}
+		}
+		m.leave()
+	}
+}
+
+// unfuse runs a fused dip or branch as the builtin it was compiled from,
+// with its quotations pushed, in the cases the fused code leaves to the
+// builtin: too few values on the stack, or no room for the quotations.
+func (m *Machine) unfuse(c *code, in instr) {
+	for j := in.op.literals(); j > 0; j-- {
+		m.Push(c.src[int(in.at)-j])
+	}
+	c.src[in.at].Fn()(m)
+}